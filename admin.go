@@ -0,0 +1,168 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/apptainer/apptheus/internal/admin"
+)
+
+// outputFlag adds the output format flag of the admin commands.
+func outputFlag(cmd *kingpin.CmdClause) *string {
+	return cmd.Flag("output", "Output format: table or json.").Short('o').Default("table").Enum("table", "json")
+}
+
+// runAdminCommand runs an admin command against the running daemon and
+// returns the exit code of the process.
+func runAdminCommand(run func(ctx context.Context) error) int {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := run(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "apptheus:", err)
+		return 1
+	}
+	return 0
+}
+
+func listContainers(ctx context.Context, c *admin.Client, output string) error {
+	containers, err := c.List(ctx)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		return printJSON(os.Stdout, containers)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPID\tEXE\tOWNER PID\tOWNER UID\tSTARTED\tLABELS")
+	for _, container := range containers {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%d\t%s\t%s\n",
+			container.ID,
+			container.Pid,
+			container.Exe,
+			container.Owner.Pid,
+			container.Owner.UID,
+			container.Started.Format(time.RFC3339),
+			formatLabels(container.Labels),
+		)
+	}
+	return w.Flush()
+}
+
+func inspectContainer(ctx context.Context, c *admin.Client, id, output string) error {
+	inspection, err := c.Inspect(ctx, id)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		return printJSON(os.Stdout, inspection)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", inspection.ID)
+	fmt.Fprintf(w, "Pid:\t%d\n", inspection.Pid)
+	fmt.Fprintf(w, "Exe:\t%s\n", inspection.Exe)
+	fmt.Fprintf(w, "Started:\t%s\n", inspection.Started.Format(time.RFC3339))
+	fmt.Fprintf(w, "Owner:\tpid %d, uid %d, gid %d\n", inspection.Owner.Pid, inspection.Owner.UID, inspection.Owner.GID)
+	fmt.Fprintf(w, "Labels:\t%s\n", formatLabels(inspection.Labels))
+	fmt.Fprintf(w, "System labels:\t%s\n", formatLabels(inspection.SystemLabels))
+
+	fmt.Fprintln(w, "Cgroups:")
+	for _, controller := range sortedKeys(inspection.CgroupPaths) {
+		name := controller
+		if name == "" {
+			name = "unified"
+		}
+		fmt.Fprintf(w, "  %s\t%s\n", name, inspection.CgroupPaths[controller])
+	}
+
+	fmt.Fprintln(w, "Metrics:")
+	for _, name := range sortedKeys(inspection.Metrics) {
+		fmt.Fprintf(w, "  %s\t%g\n", name, inspection.Metrics[name])
+	}
+	return w.Flush()
+}
+
+func showHistory(ctx context.Context, c *admin.Client, id, metric, since, output string) error {
+	series, err := c.History(ctx, id, metric, since)
+	if err != nil {
+		return err
+	}
+	if output == "json" {
+		return printJSON(os.Stdout, series)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "METRIC	TIME	VALUE")
+	for _, s := range series {
+		for _, sample := range s.Samples {
+			fmt.Fprintf(w, "%s\t%s\t%g\n", s.Metric, sample.Time.Format(time.RFC3339), sample.Value)
+		}
+	}
+	return w.Flush()
+}
+
+func checkHealth(ctx context.Context, c *admin.Client, output string) error {
+	health, err := c.Health(ctx)
+	if err != nil {
+		return err
+	}
+
+	if output == "json" {
+		err = printJSON(os.Stdout, health)
+	} else {
+		status := "healthy"
+		if !health.Healthy {
+			status = "unhealthy: " + health.Error
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "Status:\t%s\n", status)
+		fmt.Fprintf(w, "Version:\t%s\n", health.Version)
+		fmt.Fprintf(w, "Uptime:\t%s\n", time.Since(health.Started).Round(time.Second))
+		fmt.Fprintf(w, "Containers:\t%d\n", health.Containers)
+		err = w.Flush()
+	}
+	if err == nil && !health.Healthy {
+		err = errors.New("daemon is unhealthy")
+	}
+	return err
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, name := range sortedKeys(labels) {
+		pairs = append(pairs, name+"="+labels[name])
+	}
+	if len(pairs) == 0 {
+		return "-"
+	}
+	return strings.Join(pairs, ",")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -14,6 +14,7 @@ require (
 	github.com/prometheus/exporter-toolkit v0.11.0
 	github.com/stretchr/testify v1.8.4
 	golang.org/x/sys v0.17.0
+	gopkg.in/yaml.v2 v2.4.0
 	toolman.org/net/peercred v0.6.1
 )
 
@@ -44,6 +45,5 @@ require (
 	golang.org/x/text v0.14.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.32.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,295 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/api"
+	"github.com/apptainer/apptheus/internal/monitor"
+	"github.com/apptainer/apptheus/internal/storage"
+	v1 "github.com/apptainer/apptheus/pkg/api"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/route"
+	"golang.org/x/sys/unix"
+	"toolman.org/net/peercred"
+)
+
+type credKey struct{}
+
+// Server serves the admin API, giving a view on every monitored container.
+// It is only reachable by root and by the user running apptheus. The owners
+// of the containers control theirs through the control socket.
+type Server struct {
+	registry *monitor.Registry
+	ms       storage.MetricStore
+	logger   log.Logger
+	version  string
+	started  time.Time
+}
+
+func NewServer(registry *monitor.Registry, ms storage.MetricStore, version string, logger log.Logger) *Server {
+	return &Server{
+		registry: registry,
+		ms:       ms,
+		logger:   logger,
+		version:  version,
+		started:  time.Now(),
+	}
+}
+
+// Listen creates the admin socket, only accessible to the user running
+// apptheus.
+func Listen(socketPath string) (*peercred.Listener, error) {
+	return listen(socketPath, 0o600)
+}
+
+// ListenControl creates the control socket. Every user can connect to it,
+// the requests being authorized from the credentials of the peer.
+func ListenControl(socketPath string) (*peercred.Listener, error) {
+	return listen(socketPath, 0o666)
+}
+
+func listen(socketPath string, mode os.FileMode) (*peercred.Listener, error) {
+	listener, err := peercred.Listen(context.Background(), socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// ConnContext is meant to be used as http.Server.ConnContext on a listener
+// created by Listen or ListenControl.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if pc, ok := c.(*peercred.Conn); ok {
+		return context.WithValue(ctx, credKey{}, pc.Ucred)
+	}
+	return ctx
+}
+
+// Register registers the admin handlers on the router.
+func (s *Server) Register(r *route.Router) {
+	r.Get(Prefix+"/containers", s.authorized(s.listContainers))
+	r.Get(Prefix+"/containers/:id", s.authorized(s.inspectContainer))
+	r.Del(Prefix+"/containers/:id", s.authorized(s.stopMonitoring))
+	r.Get(Prefix+"/health", s.authorized(s.health))
+	r.Post(Prefix+"/containers/:id/freeze", s.authorized(s.control(s.freezeContainer)))
+	r.Post(Prefix+"/containers/:id/thaw", s.authorized(s.control(s.thawContainer)))
+	r.Post(Prefix+"/containers/:id/kill", s.authorized(s.control(s.killContainer)))
+	r.Get(Prefix+"/containers/:id/history", s.authorized(s.control(s.containerHistory)))
+}
+
+// RegisterControl registers the handlers of the control socket on the router,
+// which only act on the containers owned by the peer, unless privileged.
+func (s *Server) RegisterControl(r *route.Router) {
+	r.Post(Prefix+"/containers/:id/freeze", s.control(s.freezeContainer))
+	r.Post(Prefix+"/containers/:id/thaw", s.control(s.thawContainer))
+	r.Post(Prefix+"/containers/:id/kill", s.control(s.killContainer))
+	r.Get(Prefix+"/containers/:id/history", s.control(s.containerHistory))
+}
+
+// authorized only lets root and the user running apptheus through, the
+// permissions of the socket being the first barrier.
+func (s *Server) authorized(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ucred, ok := r.Context().Value(credKey{}).(*unix.Ucred)
+		if !ok || !privileged(ucred) {
+			s.respondError(w, http.StatusForbidden, errors.New("admin socket is restricted to root"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// control lets root, the user running apptheus and the user owning the
+// container through.
+func (s *Server) control(h func(http.ResponseWriter, *http.Request, *monitor.Instance)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ucred, ok := r.Context().Value(credKey{}).(*unix.Ucred)
+		if !ok {
+			s.respondError(w, http.StatusForbidden, errors.New("unverified connection"))
+			return
+		}
+		instance, ok := s.instance(w, r)
+		if !ok {
+			return
+		}
+		if !privileged(ucred) && ucred.Uid != instance.Container.Owner.UID {
+			s.respondError(w, http.StatusForbidden, fmt.Errorf("container %s is not owned by uid %d", instance.Container.ID, ucred.Uid))
+			return
+		}
+		h(w, r, instance)
+	}
+}
+
+func privileged(ucred *unix.Ucred) bool {
+	return ucred.Uid == 0 || int(ucred.Uid) == os.Geteuid()
+}
+
+func (s *Server) listContainers(w http.ResponseWriter, _ *http.Request) {
+	containers := []v1.Container{}
+	for _, instance := range s.registry.List(nil) {
+		containers = append(containers, api.ToContainer(instance))
+	}
+	s.respond(w, http.StatusOK, containers)
+}
+
+func (s *Server) inspectContainer(w http.ResponseWriter, r *http.Request) {
+	instance, ok := s.instance(w, r)
+	if !ok {
+		return
+	}
+
+	inspection := Inspection{
+		Container: api.ToContainer(instance),
+		Metrics:   make(map[string]float64),
+	}
+	if instance.CGroup != nil {
+		inspection.CgroupPaths = instance.GetPaths()
+	}
+	for _, group := range s.ms.GetMetricFamiliesMap() {
+		if group.Labels["job"] != instance.Container.ID {
+			continue
+		}
+		for name, mf := range group.Metrics {
+			if value, ok := sampleValue(mf.GetMetricFamily()); ok {
+				inspection.Metrics[name] = value
+			}
+		}
+	}
+	s.respond(w, http.StatusOK, inspection)
+}
+
+func (s *Server) stopMonitoring(w http.ResponseWriter, r *http.Request) {
+	instance, ok := s.instance(w, r)
+	if !ok {
+		return
+	}
+	instance.Stop()
+	level.Info(s.logger).Log("msg", "Container monitoring stopped by an administrator", "container id", instance.Container.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) freezeContainer(w http.ResponseWriter, r *http.Request, instance *monitor.Instance) {
+	s.setFrozen(w, r, instance, true)
+}
+
+func (s *Server) thawContainer(w http.ResponseWriter, r *http.Request, instance *monitor.Instance) {
+	s.setFrozen(w, r, instance, false)
+}
+
+func (s *Server) setFrozen(w http.ResponseWriter, r *http.Request, instance *monitor.Instance, frozen bool) {
+	if err := instance.SetFrozen(frozen); err != nil {
+		s.respondControlError(w, err)
+		return
+	}
+	level.Info(s.logger).Log("msg", "Container freezer state changed", "frozen", frozen, "uid", uidOf(r), "container id", instance.Container.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) killContainer(w http.ResponseWriter, r *http.Request, instance *monitor.Instance) {
+	if err := instance.Kill(); err != nil {
+		s.respondControlError(w, err)
+		return
+	}
+	level.Info(s.logger).Log("msg", "Container killed", "uid", uidOf(r), "container id", instance.Container.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// containerHistory returns the recent samples of the container, as the
+// history endpoint of the verification socket, which only serves the client
+// which registered the container.
+func (s *Server) containerHistory(w http.ResponseWriter, r *http.Request, instance *monitor.Instance) {
+	history := instance.History()
+	if history == nil {
+		s.respondError(w, http.StatusNotFound, errors.New("history is disabled"))
+		return
+	}
+	since, err := api.ParseSince(r.URL.Query().Get("since"))
+	if err != nil {
+		s.respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.respond(w, http.StatusOK, api.ToSeries(history.Query(r.URL.Query().Get("metric"), since)))
+}
+
+func (s *Server) respondControlError(w http.ResponseWriter, err error) {
+	if errors.Is(err, monitor.ErrNotSetUp) {
+		s.respondError(w, http.StatusConflict, err)
+		return
+	}
+	s.respondError(w, http.StatusInternalServerError, err)
+}
+
+func uidOf(r *http.Request) uint32 {
+	if ucred, ok := r.Context().Value(credKey{}).(*unix.Ucred); ok {
+		return ucred.Uid
+	}
+	return 0
+}
+
+func (s *Server) health(w http.ResponseWriter, _ *http.Request) {
+	health := Health{
+		Healthy:    true,
+		Version:    s.version,
+		Started:    s.started,
+		Containers: len(s.registry.List(nil)),
+	}
+	if err := s.ms.Healthy(); err != nil {
+		health.Healthy = false
+		health.Error = err.Error()
+	}
+	s.respond(w, http.StatusOK, health)
+}
+
+func (s *Server) instance(w http.ResponseWriter, r *http.Request) (*monitor.Instance, bool) {
+	id := route.Param(r.Context(), "id")
+	instance, ok := s.registry.Get(id)
+	if !ok {
+		s.respondError(w, http.StatusNotFound, fmt.Errorf("container %s is not monitored", id))
+	}
+	return instance, ok
+}
+
+func (s *Server) respond(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		level.Error(s.logger).Log("msg", "error writing response", "err", err)
+	}
+}
+
+func (s *Server) respondError(w http.ResponseWriter, status int, err error) {
+	s.respond(w, status, v1.Error{Error: err.Error()})
+}
+
+// sampleValue returns the value of the first sample of a gauge, a counter or
+// an untyped metric family.
+func sampleValue(mf *dto.MetricFamily) (float64, bool) {
+	if mf == nil || len(mf.GetMetric()) == 0 {
+		return 0, false
+	}
+	m := mf.GetMetric()[0]
+	switch {
+	case m.Gauge != nil:
+		return m.GetGauge().GetValue(), true
+	case m.Counter != nil:
+		return m.GetCounter().GetValue(), true
+	case m.Untyped != nil:
+		return m.GetUntyped().GetValue(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,142 @@
+package admin_test
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/admin"
+	"github.com/apptainer/apptheus/internal/monitor"
+	"github.com/apptainer/apptheus/internal/storage"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/route"
+	"github.com/stretchr/testify/require"
+	"toolman.org/net/peercred"
+)
+
+const helperEnv = "APPTHEUS_ADMIN_HELPER"
+
+// unprivilegedUID is the uid the helper process connects to the admin socket
+// with, nobody on most systems.
+const unprivilegedUID = 65534
+
+// newServer serves the admin API on the admin and control sockets in dir.
+func newServer(t *testing.T, dir string) (adminPath, controlPath string) {
+	logger := log.NewNopLogger()
+	ms := storage.NewDiskMetricStore("", time.Minute, prometheus.NewRegistry(), logger)
+	t.Cleanup(func() { ms.Shutdown() })
+	scheduler := monitor.NewScheduler(monitor.SchedulerConfig{Interval: time.Hour}, ms, logger)
+	t.Cleanup(scheduler.Stop)
+	s := admin.NewServer(monitor.NewRegistry(scheduler), ms, "1.2.3", logger)
+
+	serve := func(path string, listen func(string) (*peercred.Listener, error), register func(*route.Router)) {
+		r := route.New()
+		register(r)
+		listener, err := listen(path)
+		require.NoError(t, err)
+		server := &http.Server{Handler: r, ReadHeaderTimeout: time.Second, ConnContext: admin.ConnContext}
+		go server.Serve(listener)
+		t.Cleanup(func() { server.Close() })
+	}
+	adminPath = filepath.Join(dir, "admin.sock")
+	controlPath = filepath.Join(dir, "control.sock")
+	serve(adminPath, admin.Listen, s.Register)
+	serve(controlPath, admin.ListenControl, s.RegisterControl)
+	return adminPath, controlPath
+}
+
+func TestAdmin(t *testing.T) {
+	socketPath, controlPath := newServer(t, t.TempDir())
+	require.FileExists(t, socketPath)
+
+	info, err := os.Stat(socketPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	info, err = os.Stat(controlPath)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o666), info.Mode().Perm())
+
+	ctx := context.Background()
+	c := admin.NewClient(socketPath)
+
+	containers, err := c.List(ctx)
+	require.NoError(t, err)
+	require.Empty(t, containers)
+
+	health, err := c.Health(ctx)
+	require.NoError(t, err)
+	require.True(t, health.Healthy)
+	require.Equal(t, "1.2.3", health.Version)
+	require.Zero(t, health.Containers)
+
+	_, err = c.Inspect(ctx, "unknown")
+	require.ErrorContains(t, err, "not monitored")
+	require.ErrorContains(t, c.StopMonitoring(ctx, "unknown"), "not monitored")
+	require.ErrorContains(t, c.Freeze(ctx, "unknown"), "not monitored")
+	require.ErrorContains(t, c.Thaw(ctx, "unknown"), "not monitored")
+	require.ErrorContains(t, c.Kill(ctx, "unknown"), "not monitored")
+	_, err = c.History(ctx, "unknown", "memory_usage", "10m")
+	require.ErrorContains(t, err, "not monitored")
+
+	// the control socket only serves the control requests
+	control := admin.NewClient(controlPath)
+	require.ErrorContains(t, control.Freeze(ctx, "unknown"), "not monitored")
+	_, err = control.History(ctx, "unknown", "", "")
+	require.ErrorContains(t, err, "not monitored")
+	_, err = control.List(ctx)
+	require.Error(t, err)
+
+	_, err = admin.NewClient(filepath.Join(t.TempDir(), "missing.sock")).Health(ctx)
+	require.Error(t, err)
+}
+
+// TestUnprivilegedHelper is run in a subprocess by TestUnprivileged, as the
+// uid can't be restored once dropped.
+func TestUnprivilegedHelper(t *testing.T) {
+	dir := os.Getenv(helperEnv)
+	if dir == "" {
+		t.Skip("only run as a helper process")
+	}
+	require.NoError(t, syscall.Setresuid(unprivilegedUID, unprivilegedUID, unprivilegedUID))
+
+	ctx := context.Background()
+
+	// the admin socket can't even be connected to
+	c := admin.NewClient(filepath.Join(dir, "admin.sock"))
+	_, err := c.List(ctx)
+	require.ErrorIs(t, err, syscall.EACCES)
+	_, err = c.Health(ctx)
+	require.ErrorIs(t, err, syscall.EACCES)
+	require.ErrorIs(t, c.Freeze(ctx, "unknown"), syscall.EACCES)
+
+	// while the control socket serves the owners of the containers
+	control := admin.NewClient(filepath.Join(dir, "control.sock"))
+	require.ErrorContains(t, control.Kill(ctx, "unknown"), "not monitored")
+	_, err = control.List(ctx)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, syscall.EACCES)
+}
+
+func TestUnprivileged(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to connect as another user")
+	}
+	// the sockets must be reachable by the unprivileged user
+	dir, err := os.MkdirTemp("", "apptheus-admin")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	require.NoError(t, os.Chmod(dir, 0o755))
+	newServer(t, dir)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestUnprivilegedHelper$", "-test.v")
+	cmd.Env = append(os.Environ(), helperEnv+"="+dir)
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	require.Contains(t, string(out), "--- PASS: TestUnprivilegedHelper")
+}
@@ -0,0 +1,123 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	v1 "github.com/apptainer/apptheus/pkg/api"
+)
+
+// Client talks to a running daemon over its admin socket, or its control
+// socket for the freeze, thaw, kill and history requests.
+type Client struct {
+	http *http.Client
+}
+
+func NewClient(socketPath string) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	return &Client{http: &http.Client{Transport: transport, Timeout: 10 * time.Second}}
+}
+
+// List returns every monitored container.
+func (c *Client) List(ctx context.Context) ([]v1.Container, error) {
+	var containers []v1.Container
+	err := c.do(ctx, http.MethodGet, Prefix+"/containers", &containers)
+	return containers, err
+}
+
+// Inspect returns the detailed status of a monitored container.
+func (c *Client) Inspect(ctx context.Context, id string) (*Inspection, error) {
+	inspection := &Inspection{}
+	if err := c.do(ctx, http.MethodGet, Prefix+"/containers/"+url.PathEscape(id), inspection); err != nil {
+		return nil, err
+	}
+	return inspection, nil
+}
+
+// StopMonitoring stops monitoring a container, whoever registered it.
+func (c *Client) StopMonitoring(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, Prefix+"/containers/"+url.PathEscape(id), nil)
+}
+
+// Freeze freezes the processes of a container.
+func (c *Client) Freeze(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, Prefix+"/containers/"+url.PathEscape(id)+"/freeze", nil)
+}
+
+// Thaw thaws the processes of a frozen container.
+func (c *Client) Thaw(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, Prefix+"/containers/"+url.PathEscape(id)+"/thaw", nil)
+}
+
+// Kill kills all the processes of a container.
+func (c *Client) Kill(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, Prefix+"/containers/"+url.PathEscape(id)+"/kill", nil)
+}
+
+// History returns the recent samples of a container, of all its metrics unless
+// metric is set, taken since a RFC 3339 time or a duration ago unless since is
+// empty.
+func (c *Client) History(ctx context.Context, id, metric, since string) ([]v1.Series, error) {
+	query := url.Values{}
+	if metric != "" {
+		query.Set("metric", metric)
+	}
+	if since != "" {
+		query.Set("since", since)
+	}
+	path := Prefix + "/containers/" + url.PathEscape(id) + "/history"
+	if len(query) != 0 {
+		path += "?" + query.Encode()
+	}
+	var series []v1.Series
+	err := c.do(ctx, http.MethodGet, path, &series)
+	return series, err
+}
+
+// Health returns the status of the daemon.
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	health := &Health{}
+	if err := c.do(ctx, http.MethodGet, Prefix+"/health", health); err != nil {
+		return nil, err
+	}
+	return health, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, out interface{}) error {
+	// the host is ignored when dialing the socket
+	req, err := http.NewRequestWithContext(ctx, method, "http://apptheus"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		var apiErr v1.Error
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+			return errors.New(http.StatusText(resp.StatusCode))
+		}
+		return errors.New(apiErr.Error)
+	}
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,31 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package admin
+
+import (
+	"time"
+
+	"github.com/apptainer/apptheus/pkg/api"
+)
+
+// Prefix is the path prefix of the admin API.
+const Prefix = "/admin/v1"
+
+// Inspection is the detailed status of a monitored container.
+type Inspection struct {
+	api.Container
+	// CgroupPaths are the directories of the container cgroup, keyed by
+	// controller.
+	CgroupPaths map[string]string `json:"cgroup_paths,omitempty"`
+	// Metrics are the latest values of the container metrics.
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+}
+
+// Health is the status of the daemon.
+type Health struct {
+	Healthy    bool      `json:"healthy"`
+	Error      string    `json:"error,omitempty"`
+	Version    string    `json:"version"`
+	Started    time.Time `json:"started"`
+	Containers int       `json:"containers"`
+}
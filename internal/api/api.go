@@ -0,0 +1,442 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/cgroup"
+	"github.com/apptainer/apptheus/internal/monitor"
+	"github.com/apptainer/apptheus/internal/network"
+	"github.com/apptainer/apptheus/internal/proc"
+	"github.com/apptainer/apptheus/internal/push"
+	"github.com/apptainer/apptheus/internal/storage"
+	v1 "github.com/apptainer/apptheus/pkg/api"
+	"github.com/go-kit/log/level"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/route"
+)
+
+// maxBodySize bounds the size of the request bodies.
+const maxBodySize = 1 << 20
+
+// reservedLabels can't be set by clients.
+var reservedLabels = map[string]struct{}{
+	"job":       {},
+	"instance":  {},
+	"ancestors": {},
+}
+
+// pushMetricNames are the metrics added by the store to every group.
+var pushMetricNames = []string{"push_time_seconds", "push_failure_time_seconds", storage.StaleMetricName}
+
+// API serves the versioned registration API on the verification socket. Every
+// request is authorised against the peer credentials of its connection: a
+// client can only act on the containers it registered, and the processes of a
+// container can only push metrics into the group of their container.
+type API struct {
+	option *network.ServerOption
+	// reservedMetrics can't be pushed by the containers.
+	reservedMetrics map[string]struct{}
+}
+
+func New(option *network.ServerOption) *API {
+	reserved := cgroup.StatNames()
+	for name := range cgroup.LimitNames() {
+		reserved[name] = struct{}{}
+	}
+	for _, name := range pushMetricNames {
+		reserved[name] = struct{}{}
+	}
+	reserved[monitor.IntervalMetric] = struct{}{}
+	reserved[monitor.FrozenMetric] = struct{}{}
+	return &API{option: option, reservedMetrics: reserved}
+}
+
+// Register registers the API handlers on the router.
+func (a *API) Register(r *route.Router) {
+	r.Post(v1.Prefix+"/containers", a.registerContainer)
+	r.Get(v1.Prefix+"/containers", a.listContainers)
+	r.Get(v1.Prefix+"/containers/:id", a.containerStatus)
+	r.Del(v1.Prefix+"/containers/:id", a.deregisterContainer)
+	r.Put(v1.Prefix+"/containers/:id/labels", a.updateLabels)
+	r.Post(v1.Prefix+"/containers/:id/done", a.containerDone)
+	r.Get(v1.Prefix+"/containers/:id/history", a.containerHistory)
+	r.Post(v1.HeartbeatPath, a.heartbeat)
+	r.Post(v1.MetricsPath, a.pushMetrics)
+}
+
+func (a *API) registerContainer(w http.ResponseWriter, r *http.Request) {
+	peer, ok := a.trustedPeer(w, r)
+	if !ok {
+		return
+	}
+
+	var req v1.RegisterRequest
+	if err := decode(r, &req); err != nil {
+		a.respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateLabels(req.Labels); err != nil {
+		a.respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	var interval time.Duration
+	if req.Interval != "" {
+		var err error
+		interval, err = time.ParseDuration(req.Interval)
+		if err != nil {
+			a.respondError(w, http.StatusBadRequest, fmt.Errorf("invalid interval: %w", err))
+			return
+		}
+		if interval < v1.MinInterval {
+			a.respondError(w, http.StatusBadRequest, fmt.Errorf("interval must be at least %s", v1.MinInterval))
+			return
+		}
+	}
+	if req.Pid == 0 {
+		req.Pid = int(peer.Pid)
+	}
+
+	instance, err := network.Register(a.option, peer, req.Pid, req.Labels)
+	switch {
+	case errors.Is(err, network.ErrNotDescendant):
+		a.respondError(w, http.StatusForbidden, err)
+		return
+	case errors.Is(err, monitor.ErrRegistered):
+		a.respondError(w, http.StatusConflict, err)
+		return
+	case err != nil:
+		a.respondError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// the container may have been registered before with other labels
+	if req.Labels != nil {
+		if err := network.UpdateLabels(a.option, instance, peer, req.Labels); err != nil {
+			a.respondError(w, http.StatusForbidden, err)
+			return
+		}
+	}
+	if interval != 0 {
+		instance.SetInterval(interval)
+	}
+	// the container is notified when the client closes this connection
+	if conn, ok := network.ConnFromContext(r.Context()); ok {
+		conn.Hold(instance)
+	}
+	a.respond(w, http.StatusOK, ToContainer(instance))
+}
+
+func (a *API) listContainers(w http.ResponseWriter, r *http.Request) {
+	peer, ok := a.trustedPeer(w, r)
+	if !ok {
+		return
+	}
+
+	containers := []v1.Container{}
+	for _, instance := range a.option.Registry.List(monitor.OwnedBy(peer.Pid, peer.StartTime)) {
+		containers = append(containers, ToContainer(instance))
+	}
+	a.respond(w, http.StatusOK, containers)
+}
+
+func (a *API) containerStatus(w http.ResponseWriter, r *http.Request) {
+	instance, ok := a.authorize(w, r)
+	if !ok {
+		return
+	}
+	a.respond(w, http.StatusOK, ToContainer(instance))
+}
+
+func (a *API) deregisterContainer(w http.ResponseWriter, r *http.Request) {
+	instance, ok := a.authorize(w, r)
+	if !ok {
+		return
+	}
+	instance.Stop()
+	level.Info(a.option.Logger).Log("msg", "Container deregistered", "container id", instance.Container.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) containerDone(w http.ResponseWriter, r *http.Request) {
+	instance, ok := a.authorize(w, r)
+	if !ok {
+		return
+	}
+	instance.Release()
+	level.Info(a.option.Logger).Log("msg", "Client is done with the container, releasing it", "container id", instance.Container.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// containerHistory returns the recent samples of the container, of all its
+// metrics unless the metric parameter is set. The since parameter restricts
+// them to the samples taken since a RFC 3339 time or a duration ago.
+func (a *API) containerHistory(w http.ResponseWriter, r *http.Request) {
+	instance, ok := a.authorize(w, r)
+	if !ok {
+		return
+	}
+	history := instance.History()
+	if history == nil {
+		a.respondError(w, http.StatusNotFound, errors.New("history is disabled"))
+		return
+	}
+	since, err := ParseSince(r.URL.Query().Get("since"))
+	if err != nil {
+		a.respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.respond(w, http.StatusOK, ToSeries(history.Query(r.URL.Query().Get("metric"), since)))
+}
+
+// ToSeries returns the samples of a history query as series sorted by metric
+// name.
+func ToSeries(points map[string][]monitor.Point) []v1.Series {
+	series := []v1.Series{}
+	for name, points := range points {
+		samples := make([]v1.Sample, len(points))
+		for n, p := range points {
+			samples[n] = v1.Sample{Time: p.Time, Value: p.Value}
+		}
+		series = append(series, v1.Series{Metric: name, Samples: samples})
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Metric < series[j].Metric })
+	return series
+}
+
+// ParseSince parses the since parameter of a history query, a RFC 3339 time
+// or a duration ago.
+func ParseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid since %q, expected a RFC 3339 time or a duration", s)
+	}
+	return t, nil
+}
+
+// heartbeat tells that the caller is still alive, for all the containers it
+// registered.
+func (a *API) heartbeat(w http.ResponseWriter, r *http.Request) {
+	peer, ok := a.trustedPeer(w, r)
+	if !ok {
+		return
+	}
+	for _, instance := range a.option.Registry.List(monitor.OwnedBy(peer.Pid, peer.StartTime)) {
+		instance.Heartbeat()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) updateLabels(w http.ResponseWriter, r *http.Request) {
+	instance, ok := a.authorize(w, r)
+	if !ok {
+		return
+	}
+
+	var req v1.LabelsRequest
+	if err := decode(r, &req); err != nil {
+		a.respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := validateLabels(req.Labels); err != nil {
+		a.respondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// the peer has been checked by authorize
+	peer, _ := network.PeerFromContext(r.Context())
+	if err := network.UpdateLabels(a.option, instance, peer, req.Labels); err != nil {
+		a.respondError(w, http.StatusForbidden, err)
+		return
+	}
+	a.respond(w, http.StatusOK, ToContainer(instance))
+}
+
+// pushMetrics adds the application metrics pushed by a process of a monitored
+// container to the metrics of its container. The pushed metrics can't shadow
+// the ones reported by apptheus, and their grouping labels are overwritten by
+// the ones of the container.
+func (a *API) pushMetrics(w http.ResponseWriter, r *http.Request) {
+	peer, ok := network.PeerFromContext(r.Context())
+	if !ok {
+		a.respondError(w, http.StatusForbidden, errors.New("unverified connection"))
+		return
+	}
+
+	instance, err := a.containerOf(peer)
+	if err != nil {
+		a.respondError(w, http.StatusForbidden, err)
+		return
+	}
+	if peer.UID != 0 && peer.UID != instance.Container.Owner.UID {
+		a.respondError(w, http.StatusForbidden, fmt.Errorf("uid %d can't push metrics for container %s", peer.UID, instance.Container.ID))
+		return
+	}
+
+	metricFamilies, err := push.Parse(http.MaxBytesReader(nil, r.Body, maxBodySize), r.Header.Get("Content-Type"))
+	if err != nil {
+		a.respondError(w, http.StatusBadRequest, fmt.Errorf("invalid metrics: %w", err))
+		return
+	}
+	if err := a.validateMetrics(metricFamilies); err != nil {
+		a.respondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := push.Submit(a.option.MetricStore, metricFamilies, instance.GroupingLabels()); err != nil {
+		level.Debug(a.option.Logger).Log("msg", "pushed metrics rejected", "container id", instance.Container.ID, "err", err)
+		a.respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// containerOf returns the monitored container the peer belongs to. The start
+// time of the peer is checked around the cgroup lookup, so that a process
+// which reused the pid of the peer is not mistaken for it.
+func (a *API) containerOf(peer *network.Peer) (*monitor.Instance, error) {
+	if err := checkStartTime(peer); err != nil {
+		return nil, err
+	}
+	instance, ok, err := a.option.Registry.ContainerOf(int(peer.Pid))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStartTime(peer); err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("caller does not belong to a monitored container")
+	}
+	return instance, nil
+}
+
+func checkStartTime(peer *network.Peer) error {
+	stat, err := proc.StatOf(int(peer.Pid))
+	if err != nil {
+		return fmt.Errorf("could not verify the caller: %w", err)
+	}
+	if stat.StartTime != peer.StartTime {
+		return errors.New("caller exited")
+	}
+	return nil
+}
+
+func (a *API) validateMetrics(metricFamilies map[string]*dto.MetricFamily) error {
+	for name := range metricFamilies {
+		if _, ok := a.reservedMetrics[name]; ok {
+			return fmt.Errorf("metric name %q is reserved", name)
+		}
+	}
+	return nil
+}
+
+// trustedPeer returns the peer of the request if it is allowed to manage
+// containers, otherwise an error response is sent.
+func (a *API) trustedPeer(w http.ResponseWriter, r *http.Request) (*network.Peer, bool) {
+	peer, ok := network.PeerFromContext(r.Context())
+	if !ok {
+		a.respondError(w, http.StatusForbidden, errors.New("unverified connection"))
+		return nil, false
+	}
+	if !peer.Trusted {
+		a.respondError(w, http.StatusForbidden, errors.New("caller is not trusted"))
+		return nil, false
+	}
+	return peer, true
+}
+
+// authorize returns the instance addressed by the request if the peer of the
+// connection registered it, otherwise an error response is sent.
+func (a *API) authorize(w http.ResponseWriter, r *http.Request) (*monitor.Instance, bool) {
+	peer, ok := a.trustedPeer(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	id := route.Param(r.Context(), "id")
+	instance, ok := a.option.Registry.Get(id)
+	if !ok {
+		a.respondError(w, http.StatusNotFound, fmt.Errorf("container %s is not monitored", id))
+		return nil, false
+	}
+	if !monitor.OwnedBy(peer.Pid, peer.StartTime)(instance) {
+		a.respondError(w, http.StatusForbidden, fmt.Errorf("container %s has not been registered by the caller", id))
+		return nil, false
+	}
+	return instance, true
+}
+
+func (a *API) respond(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		level.Error(a.option.Logger).Log("msg", "error writing response", "err", err)
+	}
+}
+
+func (a *API) respondError(w http.ResponseWriter, status int, err error) {
+	a.respond(w, status, v1.Error{Error: err.Error()})
+}
+
+func decode(r *http.Request, v interface{}) error {
+	d := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	d.DisallowUnknownFields()
+	// an empty body is an empty request
+	if err := d.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+func validateLabels(labels map[string]string) error {
+	for name := range labels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if _, ok := reservedLabels[name]; ok {
+			return fmt.Errorf("label %q is reserved", name)
+		}
+	}
+	return nil
+}
+
+// ToContainer returns the status of the container monitored by instance.
+func ToContainer(instance *monitor.Instance) v1.Container {
+	c := instance.Container
+	var interval string
+	if d := instance.Interval(); d != 0 {
+		interval = d.String()
+	}
+	return v1.Container{
+		ID:           c.ID,
+		Pid:          c.Pid,
+		Exe:          c.FullPath,
+		StartTime:    c.StartTime,
+		Started:      instance.Started,
+		Labels:       instance.Labels(),
+		SystemLabels: c.Labels,
+		Owner: v1.Owner{
+			Pid: c.Owner.Pid,
+			UID: c.Owner.UID,
+			GID: c.Owner.GID,
+		},
+		Interval: interval,
+		Limits:   instance.Limits(),
+	}
+}
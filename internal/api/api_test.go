@@ -0,0 +1,133 @@
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/api"
+	"github.com/apptainer/apptheus/internal/monitor"
+	"github.com/apptainer/apptheus/internal/network"
+	"github.com/apptainer/apptheus/internal/proc"
+	v1 "github.com/apptainer/apptheus/pkg/api"
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/route"
+	"github.com/stretchr/testify/require"
+)
+
+func newRouter(t *testing.T) *route.Router {
+	scheduler := monitor.NewScheduler(monitor.SchedulerConfig{Interval: time.Hour}, nil, log.NewNopLogger())
+	t.Cleanup(scheduler.Stop)
+
+	option := &network.ServerOption{
+		Registry: monitor.NewRegistry(scheduler),
+		Logger:   log.NewNopLogger(),
+	}
+	r := route.New()
+	api.New(option).Register(r)
+	return r
+}
+
+func serve(r *route.Router, req *http.Request, peer *network.Peer) *httptest.ResponseRecorder {
+	if peer != nil {
+		conn := &network.PeerConn{Peer: peer}
+		req = req.WithContext(network.ConnContext(context.Background(), conn))
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAPIAuthorization(t *testing.T) {
+	r := newRouter(t)
+	peer := &network.Peer{Pid: 42, StartTime: 1000, Trusted: true}
+
+	// connections not verified by the listener are refused
+	rec := serve(r, httptest.NewRequest(http.MethodGet, v1.Prefix+"/containers", nil), nil)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	rec = serve(r, httptest.NewRequest(http.MethodPost, v1.Prefix+"/containers", nil), nil)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	// nothing registered yet
+	rec = serve(r, httptest.NewRequest(http.MethodGet, v1.Prefix+"/containers", nil), peer)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var containers []v1.Container
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&containers))
+	require.Empty(t, containers)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, v1.Prefix+"/containers/unknown", nil),
+		httptest.NewRequest(http.MethodDelete, v1.Prefix+"/containers/unknown", nil),
+		httptest.NewRequest(http.MethodPut, v1.Prefix+"/containers/unknown/labels", strings.NewReader(`{"labels":{}}`)),
+		httptest.NewRequest(http.MethodGet, v1.Prefix+"/containers/unknown/history?metric=memory_usage", nil),
+	} {
+		rec = serve(r, req, peer)
+		require.Equal(t, http.StatusNotFound, rec.Code, req.Method)
+		var apiErr v1.Error
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&apiErr))
+		require.Contains(t, apiErr.Error, "unknown")
+	}
+}
+
+func TestAPIInvalidRequests(t *testing.T) {
+	r := newRouter(t)
+	peer := &network.Peer{Pid: 42, StartTime: 1000, Trusted: true}
+
+	for _, body := range []string{
+		`not json`,
+		`{"unknown": 1}`,
+		`{"labels": {"job": "override"}}`,
+		`{"labels": {"ancestors": "override"}}`,
+		`{"labels": {"__name__": "x"}}`,
+		`{"labels": {"in-valid": "x"}}`,
+		`{"interval": "often"}`,
+		`{"interval": "1ms"}`,
+	} {
+		rec := serve(r, httptest.NewRequest(http.MethodPost, v1.Prefix+"/containers", strings.NewReader(body)), peer)
+		require.Equal(t, http.StatusBadRequest, rec.Code, body)
+	}
+}
+
+func TestAPIUntrustedPeer(t *testing.T) {
+	r := newRouter(t)
+	peer := &network.Peer{Pid: 42, StartTime: 1000}
+
+	// container members can't manage containers
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, v1.Prefix+"/containers", nil),
+		httptest.NewRequest(http.MethodPost, v1.Prefix+"/containers", nil),
+		httptest.NewRequest(http.MethodGet, v1.Prefix+"/containers/unknown", nil),
+	} {
+		rec := serve(r, req, peer)
+		require.Equal(t, http.StatusForbidden, rec.Code, req.Method)
+	}
+}
+
+func TestAPIPushMetrics(t *testing.T) {
+	r := newRouter(t)
+	body := "training_loss 0.25\n"
+
+	rec := serve(r, httptest.NewRequest(http.MethodPost, v1.MetricsPath, strings.NewReader(body)), nil)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	// the test process is not in a monitored container
+	stat, err := proc.StatOf(os.Getpid())
+	require.NoError(t, err)
+	peer := &network.Peer{Pid: int32(stat.Pid), StartTime: stat.StartTime}
+	rec = serve(r, httptest.NewRequest(http.MethodPost, v1.MetricsPath, strings.NewReader(body)), peer)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	var apiErr v1.Error
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&apiErr))
+	require.Contains(t, apiErr.Error, "monitored container")
+
+	// a different start time means the pid has been reused
+	peer.StartTime++
+	rec = serve(r, httptest.NewRequest(http.MethodPost, v1.MetricsPath, strings.NewReader(body)), peer)
+	require.Equal(t, http.StatusForbidden, rec.Code)
+}
@@ -0,0 +1,219 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type Decision string
+
+const (
+	Accepted Decision = "accepted"
+	Rejected Decision = "rejected"
+	Failed   Decision = "error"
+)
+
+// Entry is one line of the audit log, describing a single connection attempt
+// on the verification socket and what has been decided about it.
+type Entry struct {
+	Time        time.Time `json:"time"`
+	Pid         int32     `json:"pid"`
+	UID         uint32    `json:"uid"`
+	GID         uint32    `json:"gid"`
+	Exe         string    `json:"exe,omitempty"`
+	Digest      string    `json:"exe_sha256,omitempty"`
+	Rule        string    `json:"rule,omitempty"`
+	Ancestors   string    `json:"ancestors,omitempty"`
+	Decision    Decision  `json:"decision"`
+	ContainerID string    `json:"container_id,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+
+	// Hash is only set when the hash chain is enabled. It is the hex encoded
+	// sha256 of the previous entry's Hash followed by the JSON encoding of
+	// this entry without the Hash field.
+	Hash string `json:"hash,omitempty"`
+}
+
+// Sink appends audit entries as JSON lines to a file. The file is only ever
+// opened in append mode, and can be reopened (e.g. after logrotate moved it
+// away) by calling Reopen. All methods are safe to be called concurrently.
+type Sink struct {
+	mu    sync.Mutex
+	path  string
+	file  *os.File
+	chain bool
+	last  string
+}
+
+// NewSink opens (or creates) the audit log at path. If chain is true, every
+// entry is signed with a running hash chain; the chain is continued from the
+// last entry already present in the file, if any.
+func NewSink(path string, chain bool) (*Sink, error) {
+	s := &Sink{path: path, chain: chain}
+	if chain {
+		last, err := lastHash(path)
+		if err != nil {
+			return nil, err
+		}
+		s.last = last
+	}
+	f, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s.file = f
+	return s, nil
+}
+
+func openFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+}
+
+// Record appends the entry to the audit log. If the time of the entry is not
+// set, the current time is used.
+func (s *Sink) Record(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return errors.New("audit log is closed")
+	}
+
+	if s.chain {
+		hash, err := chainHash(s.last, e)
+		if err != nil {
+			return err
+		}
+		e.Hash = hash
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.last = e.Hash
+	return nil
+}
+
+// Reopen opens the configured path again and closes the current file, which
+// is what is needed after the file has been rotated. If the path can't be
+// opened, the entries keep being appended to the current file. The hash chain
+// carries on across files.
+func (s *Sink) Reopen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := openFile(s.path)
+	if err != nil {
+		return err
+	}
+	previous := s.file
+	s.file = f
+	if previous != nil {
+		if err := previous.Close(); err != nil {
+			return fmt.Errorf("closing the rotated audit log: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the audit log. Any further Record call will fail.
+func (s *Sink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Verify reads a hash chained audit log and checks that no entry has been
+// modified, removed or inserted. prev is the hash of the entry preceding the
+// first one in r, and is empty for the very first file of a chain. The hash of
+// the last entry is returned, so that rotated files can be verified in order.
+func Verify(r io.Reader, prev string) (string, error) {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return "", fmt.Errorf("line %d: %w", line, err)
+		}
+		expected, err := chainHash(prev, e)
+		if err != nil {
+			return "", fmt.Errorf("line %d: %w", line, err)
+		}
+		if e.Hash != expected {
+			return "", fmt.Errorf("line %d: hash mismatch, the audit log has been tampered with", line)
+		}
+		prev = e.Hash
+	}
+	return prev, scanner.Err()
+}
+
+func chainHash(prev string, e Entry) (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write([]byte(prev))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// lastHash returns the hash of the last entry in the file at path, or the empty
+// string if there is no such file or entry. A line which can't be parsed
+// breaks the chain, the chain can't be continued from it.
+func lastHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	last := ""
+	line := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return "", fmt.Errorf("%s line %d: the hash chain is broken: %w", path, line, err)
+		}
+		last = e.Hash
+	}
+	return last, scanner.Err()
+}
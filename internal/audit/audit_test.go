@@ -0,0 +1,126 @@
+package audit_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apptainer/apptheus/internal/audit"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSinkHashChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	sink, err := audit.NewSink(path, true)
+	require.NoError(t, err)
+	require.NoError(t, sink.Record(audit.Entry{Pid: 1, Exe: "/usr/libexec/apptainer/bin/starter", Decision: audit.Accepted, ContainerID: "starter_1"}))
+	require.NoError(t, sink.Record(audit.Entry{Pid: 2, Exe: "/bin/sh", Decision: audit.Rejected}))
+
+	// rotate the file, the chain must continue in the new one
+	rotated := path + ".1"
+	require.NoError(t, os.Rename(path, rotated))
+	require.NoError(t, sink.Reopen())
+	require.NoError(t, sink.Record(audit.Entry{Pid: 3, Exe: "/bin/sh", Decision: audit.Rejected}))
+	require.NoError(t, sink.Close())
+
+	// reopening an existing log continues its chain
+	sink, err = audit.NewSink(path, true)
+	require.NoError(t, err)
+	require.NoError(t, sink.Record(audit.Entry{Pid: 4, Decision: audit.Failed, Reason: "no such process"}))
+	require.NoError(t, sink.Close())
+
+	f, err := os.Open(rotated)
+	require.NoError(t, err)
+	defer f.Close()
+	last, err := audit.Verify(f, "")
+	require.NoError(t, err)
+	require.NotEmpty(t, last)
+
+	f2, err := os.Open(path)
+	require.NoError(t, err)
+	defer f2.Close()
+	_, err = audit.Verify(f2, last)
+	require.NoError(t, err)
+
+	// tampering with any entry breaks the chain
+	data, err := os.ReadFile(rotated)
+	require.NoError(t, err)
+	tampered := strings.Replace(string(data), `"decision":"rejected"`, `"decision":"accepted"`, 1)
+	_, err = audit.Verify(strings.NewReader(tampered), "")
+	require.Error(t, err)
+}
+
+func TestSinkWithoutChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	sink, err := audit.NewSink(path, false)
+	require.NoError(t, err)
+	require.NoError(t, sink.Record(audit.Entry{Pid: 1, Decision: audit.Accepted}))
+	require.NoError(t, sink.Close())
+	require.Error(t, sink.Record(audit.Entry{Pid: 2, Decision: audit.Accepted}))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Len(t, strings.Split(strings.TrimSpace(string(data)), "\n"), 1)
+	require.NotContains(t, string(data), `"hash"`)
+	require.Contains(t, string(data), `"decision":"accepted"`)
+}
+
+func TestSinkReopenFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+
+	sink, err := audit.NewSink(path, true)
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+	require.NoError(t, sink.Record(audit.Entry{Pid: 1, Decision: audit.Accepted}))
+
+	// the path can't be opened anymore, the current file is kept
+	rotated := path + ".1"
+	require.NoError(t, os.Rename(path, rotated))
+	require.NoError(t, os.Mkdir(path, 0o700))
+	require.Error(t, sink.Reopen())
+	require.NoError(t, sink.Record(audit.Entry{Pid: 2, Decision: audit.Rejected}))
+
+	f, err := os.Open(rotated)
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = audit.Verify(f, "")
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(rotated)
+	require.NoError(t, err)
+	require.Len(t, strings.Split(strings.TrimSpace(string(data)), "\n"), 2)
+}
+
+func TestSinkBrokenChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	sink, err := audit.NewSink(path, true)
+	require.NoError(t, err)
+	require.NoError(t, sink.Record(audit.Entry{Pid: 1, Decision: audit.Accepted}))
+	require.NoError(t, sink.Close())
+
+	// blank lines are ignored
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString("\n")
+	require.NoError(t, err)
+	sink, err = audit.NewSink(path, true)
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+
+	// but the chain can't be continued from a line which can't be parsed
+	_, err = f.WriteString(`{"pid":2,"decision":"acc` + "\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	_, err = audit.NewSink(path, true)
+	require.ErrorContains(t, err, "line 3: the hash chain is broken")
+
+	// which doesn't matter without the chain
+	sink, err = audit.NewSink(path, false)
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+}
@@ -4,28 +4,392 @@ package cgroup
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/apptainer/apptheus/internal/cgroup/parser"
 	"github.com/opencontainers/runc/libcontainer/cgroups"
+	"github.com/opencontainers/runc/libcontainer/cgroups/fs2"
 	"github.com/opencontainers/runc/libcontainer/cgroups/manager"
 	"github.com/opencontainers/runc/libcontainer/configs"
+	"golang.org/x/sys/unix"
 )
 
-const gateway = "metric_gateway"
+// DefaultRoot is the default parent of all the cgroups created by apptheus.
+const DefaultRoot = "/metric_gateway"
+
+// Layout is where the cgroups of the containers are created.
+type Layout struct {
+	// Root is the parent of all the cgroups created by apptheus, relative
+	// to the root of the cgroup hierarchies, e.g. /apptheus.slice.
+	Root string
+	// PerUser creates the cgroups of the containers under a parent per
+	// owner, <root>/user-<uid>/<id>, which can carry aggregate limits and
+	// accounts for all the containers of the user.
+	PerUser bool
+}
+
+var layout = Layout{Root: DefaultRoot}
+
+// SetLayout sets where the cgroups are created, it must be called before any
+// cgroup is created.
+func SetLayout(l Layout) error {
+	root := filepath.Clean(l.Root)
+	if !filepath.IsAbs(l.Root) || root == "/" {
+		return fmt.Errorf("cgroup root %q must be an absolute path below the hierarchy root", l.Root)
+	}
+	l.Root = root
+	layout = l
+	return nil
+}
+
+// PathOf returns the path of the cgroup of a container relative to the cgroup
+// root.
+func PathOf(id string, uid uint32) string {
+	if layout.PerUser {
+		return fmt.Sprintf("%s%d/%s", userPrefix, uid, id)
+	}
+	return id
+}
+
+const userPrefix = "user-"
 
 type CGroup struct {
 	cgroups.Manager
+	// path is the path of the cgroup relative to the hierarchy roots.
+	path string
+	// inPlace is set for the cgroups monitored in place, which are never
+	// modified.
+	inPlace bool
+	// origin holds the cgroups of the container process before Apply,
+	// keyed by subsystem as in /proc/<pid>/cgroup.
+	origin map[string]string
+	// stats is kept between samples, the CPU usage being computed from the
+	// previous one.
+	statsMu sync.Mutex
+	stats   *parser.StatManager
 }
 
+// NewCGroup returns the cgroup at path, relative to the cgroup root.
 func NewCGroup(path string) (*CGroup, error) {
 	cg := &configs.Cgroup{Resources: &configs.Resources{}}
-	cg.Path = fmt.Sprintf("/%s/%s", gateway, path)
+	cg.Path = filepath.Join(layout.Root, path)
 	mgr, err := manager.New(cg)
 	if err != nil {
 		return nil, err
 	}
-	return &CGroup{Manager: mgr}, nil
+	return &CGroup{Manager: mgr, path: cg.Path}, nil
+}
+
+// NewInPlace returns the existing cgroup v2 at path, relative to the unified
+// hierarchy root, to monitor it in place.
+func NewInPlace(path string) (*CGroup, error) {
+	if !cgroups.IsCgroup2UnifiedMode() {
+		return nil, errors.New("monitoring cgroups in place needs cgroup v2")
+	}
+	cg := &configs.Cgroup{Resources: &configs.Resources{}}
+	cg.Path = path
+	mgr, err := manager.New(cg)
+	if err != nil {
+		return nil, err
+	}
+	return &CGroup{Manager: mgr, path: path, inPlace: true}, nil
+}
+
+// InPlace reports whether the cgroup is monitored in place, rather than
+// created by apptheus.
+func (c *CGroup) InPlace() bool {
+	return c.inPlace
+}
+
+// UnifiedPathOf returns the cgroup v2 path of the process, relative to the
+// unified hierarchy root.
+func UnifiedPathOf(pid int) (string, error) {
+	if !cgroups.IsCgroup2UnifiedMode() {
+		return "", errors.New("not a cgroup v2 host")
+	}
+	paths, err := cgroups.ParseCgroupFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	path, ok := paths[""]
+	if !ok {
+		return "", fmt.Errorf("process %d has no cgroup v2", pid)
+	}
+	return path, nil
+}
+
+// ProcsOf returns the processes of the cgroup v2 at path, relative to the
+// unified hierarchy root, excluding its descendants.
+func ProcsOf(path string) ([]int, error) {
+	return cgroups.GetPids(filepath.Join(fs2.UnifiedMountpoint, path))
+}
+
+// Managed reports whether the cgroup v2 at path, relative to the unified
+// hierarchy root, is below the cgroup root of apptheus.
+func Managed(path string) bool {
+	return path == layout.Root || strings.HasPrefix(path, layout.Root+"/")
+}
+
+func gatewayManager() (cgroups.Manager, error) {
+	cg := &configs.Cgroup{Resources: &configs.Resources{}}
+	cg.Path = layout.Root
+	return manager.New(cg)
+}
+
+// GatewayPaths returns the directories of the gateway cgroup, i.e. the parent
+// of all the cgroups created by apptheus, in every mounted hierarchy.
+func GatewayPaths() ([]string, error) {
+	mgr, err := gatewayManager()
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, path := range mgr.GetPaths() {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// HierarchyRoots returns the root directories of the mounted cgroup
+// hierarchies, where the processes are moved back from the container cgroups
+// and where the cgroups monitored in place are.
+func HierarchyRoots() ([]string, error) {
+	mgr, err := gatewayManager()
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]struct{})
+	for _, path := range mgr.GetPaths() {
+		found[strings.TrimSuffix(path, layout.Root)] = struct{}{}
+	}
+	roots := make([]string, 0, len(found))
+	for root := range found {
+		roots = append(roots, root)
+	}
+	sort.Strings(roots)
+	return roots, nil
+}
+
+// CreateGateway creates the gateway cgroup and enables its controllers, which
+// needs write access to the cgroup root, without moving any process in it.
+func CreateGateway() error {
+	mgr, err := gatewayManager()
+	if err != nil {
+		return err
+	}
+	return mgr.Apply(-1)
+}
+
+// Existing returns the paths, relative to the cgroup root, of the container
+// cgroups found under it, e.g. left over by a previous run of apptheus.
+func Existing() ([]string, error) {
+	paths, err := GatewayPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]struct{})
+	for _, path := range paths {
+		dirs, err := subdirs(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			if !layout.PerUser {
+				found[dir] = struct{}{}
+				continue
+			}
+			// the per-user parents are kept, with their limits
+			if _, err := parseUserDir(dir); err != nil {
+				continue
+			}
+			ids, err := subdirs(filepath.Join(path, dir))
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range ids {
+				found[dir+"/"+id] = struct{}{}
+			}
+		}
+	}
+
+	existing := make([]string, 0, len(found))
+	for path := range found {
+		existing = append(existing, path)
+	}
+	sort.Strings(existing)
+	return existing, nil
+}
+
+// UserOf returns the owner uid of the container cgroup at path, relative to the
+// cgroup root, and whether the layout has per-user parents.
+func UserOf(path string) (uint32, bool) {
+	if !layout.PerUser {
+		return 0, false
+	}
+	uid, err := parseUserDir(filepath.Dir(path))
+	return uid, err == nil
+}
+
+func parseUserDir(dir string) (uint32, error) {
+	uid, ok := strings.CutPrefix(dir, userPrefix)
+	if !ok {
+		return 0, fmt.Errorf("%q is not a user cgroup", dir)
+	}
+	n, err := strconv.ParseUint(uid, 10, 32)
+	return uint32(n), err
+}
+
+func subdirs(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	return dirs, nil
+}
+
+// ReleaseTargets returns the cgroup.procs files the processes of the existing
+// container cgroups may be moved back to: those of the hierarchy roots, and
+// those of the original cgroups recorded on the container cgroups.
+func ReleaseTargets() ([]string, error) {
+	paths, err := GatewayPaths()
+	if err != nil {
+		return nil, err
+	}
+	existing, err := Existing()
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]struct{})
+	for _, path := range paths {
+		root := strings.TrimSuffix(path, layout.Root)
+		found[filepath.Join(root, cgroups.CgroupProcesses)] = struct{}{}
+		for _, id := range existing {
+			if origin, ok := recordedOrigin(filepath.Join(path, id)); ok {
+				found[filepath.Join(root, origin, cgroups.CgroupProcesses)] = struct{}{}
+			}
+		}
+	}
+	targets := make([]string, 0, len(found))
+	for target := range found {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets, nil
+}
+
+// originXattrs are the extended attributes recording the original cgroup of
+// the container process on the directories of its cgroup, user.* being the
+// fallback for the users who can't set trusted.* ones.
+var originXattrs = []string{"trusted.apptheus.origin", "user.apptheus.origin"}
+
+// Apply moves the process into the cgroup, recording the cgroups it leaves so
+// that Release can move it back. They are also recorded on the cgroup, where
+// extended attributes are supported, for the containers resumed by the next
+// run of apptheus.
+func (c *CGroup) Apply(pid int) error {
+	origin, err := cgroups.ParseCgroupFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return err
+	}
+	if err := c.Manager.Apply(pid); err != nil {
+		return err
+	}
+	c.origin = origin
+
+	for subsystem, path := range c.GetPaths() {
+		if origin, ok := origin[subsystem]; ok {
+			for _, name := range originXattrs {
+				if unix.Setxattr(path, name, []byte(origin), 0) == nil {
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// recordedOrigin returns the original cgroup recorded by Apply on the cgroup
+// directory at path, relative to its hierarchy root.
+func recordedOrigin(path string) (string, bool) {
+	buf := make([]byte, unix.PathMax)
+	for _, name := range originXattrs {
+		if n, err := unix.Getxattr(path, name, buf); err == nil {
+			// the origin can't escape the hierarchy
+			return filepath.Clean("/" + string(buf[:n])), true
+		}
+	}
+	return "", false
+}
+
+// Release moves the processes left in the cgroup back to the cgroups the
+// container process was in when moved by Apply, so that the cgroup can be
+// removed while they keep running. The processes go to the root cgroup of the
+// hierarchies whose original cgroup is unknown, e.g. for the resumed
+// containers when it could not be recorded on the cgroup, or can't be joined
+// anymore, e.g. in the sandbox. The cgroups monitored in place are left
+// untouched.
+func (c *CGroup) Release() error {
+	if c.inPlace {
+		return nil
+	}
+	pids, err := c.GetPids()
+	if err != nil {
+		return err
+	}
+
+	var errs error
+	for subsystem, path := range c.GetPaths() {
+		root := strings.TrimSuffix(path, c.path)
+		target := root
+		origin, ok := c.origin[subsystem]
+		if !ok {
+			origin, ok = recordedOrigin(path)
+		}
+		if ok {
+			target = filepath.Join(root, origin)
+		}
+		for _, pid := range pids {
+			if err := moveProcess(target, root, pid); err != nil {
+				errs = errors.Join(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+// moveProcess moves the process to target, or to root if target can't be
+// joined, e.g. because it has been removed in between.
+func moveProcess(target, root string, pid int) error {
+	err := cgroups.WriteCgroupProc(target, pid)
+	if err != nil && !errors.Is(err, unix.ESRCH) && target != root {
+		err = cgroups.WriteCgroupProc(root, pid)
+	}
+	// the process may have exited in between
+	if errors.Is(err, unix.ESRCH) {
+		return nil
+	}
+	return err
 }
 
 func (c *CGroup) HasProcess() (bool, error) {
@@ -34,18 +398,100 @@ func (c *CGroup) HasProcess() (bool, error) {
 }
 
 func (c *CGroup) CreateStats() ([]parser.StatFunc, error) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	return c.createStats()
+}
+
+// createStats refreshes the stats of the cgroup, c.statsMu must be held until
+// the returned functions are called.
+func (c *CGroup) createStats() ([]parser.StatFunc, error) {
 	stat, err := c.Manager.GetStats()
 	if err != nil {
 		return nil, err
 	}
 
-	statManager := &parser.StatManager{Stats: stat}
+	if c.stats == nil {
+		c.stats = newStatManager(stat)
+	} else {
+		c.stats.Stats = stat
+	}
+	return c.stats.All(), nil
+}
+
+func newStatManager(stats *cgroups.Stats) *parser.StatManager {
+	statManager := &parser.StatManager{Stats: stats}
 	statManager.WithCPU().WithMemory().WithMemorySwap().WithPid().WithBlkIO()
-	return statManager.All(), nil
+	return statManager
+}
+
+// StatNames returns the names of the metrics reported for every container.
+func StatNames() map[string]struct{} {
+	names := make(map[string]struct{})
+	for _, stat := range newStatManager(cgroups.NewStats()).All() {
+		for name := range stat() {
+			names[name] = struct{}{}
+		}
+	}
+	return names
+}
+
+// ContainerOf returns the id of the container whose cgroup the process
+// belongs to, or an empty string if the process is not in a cgroup created by
+// apptheus.
+func ContainerOf(pid int) (string, error) {
+	paths, err := cgroups.ParseCgroupFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+
+	id := ""
+	for _, path := range paths {
+		rel, ok := strings.CutPrefix(path, layout.Root+"/")
+		if !ok {
+			continue
+		}
+		if layout.PerUser {
+			user, rest, _ := strings.Cut(rel, "/")
+			if _, err := parseUserDir(user); err != nil {
+				continue
+			}
+			rel = rest
+		}
+		cid, _, _ := strings.Cut(rel, "/")
+		if cid == "" {
+			continue
+		}
+		if id != "" && cid != id {
+			return "", fmt.Errorf("process %d belongs to several container cgroups", pid)
+		}
+		id = cid
+	}
+	return id, nil
+}
+
+// Sample returns the current stats of the cgroup by metric name.
+func (c *CGroup) Sample() (map[string]float64, error) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	stats, err := c.createStats()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]float64)
+	for _, stat := range stats {
+		for k, v := range stat() {
+			values[k] = v
+		}
+	}
+	return values, nil
 }
 
 func (c *CGroup) Marshal(buffer *bytes.Buffer) (*bytes.Buffer, error) {
-	stats, err := c.CreateStats()
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	stats, err := c.createStats()
 	if err != nil {
 		return nil, err
 	}
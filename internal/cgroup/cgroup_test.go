@@ -2,10 +2,17 @@ package cgroup_test
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/apptainer/apptheus/internal/cgroup"
 	"github.com/opencontainers/runc/libcontainer/cgroups"
+	"github.com/opencontainers/runc/libcontainer/cgroups/manager"
 	"github.com/opencontainers/runc/libcontainer/configs"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -114,3 +121,160 @@ func TestCgroup(t *testing.T) {
 	_, err = cgroup.Marshal(&buffer)
 	require.NoError(t, err)
 }
+
+func TestContainerOf(t *testing.T) {
+	// the test process is not monitored
+	id, err := cgroup.ContainerOf(os.Getpid())
+	require.NoError(t, err)
+	require.Empty(t, id)
+
+	_, err = cgroup.ContainerOf(-1)
+	require.Error(t, err)
+}
+
+func TestStatNames(t *testing.T) {
+	names := cgroup.StatNames()
+	require.Contains(t, names, "cpu_usage_per")
+	require.Contains(t, names, "memory_usage")
+	require.Contains(t, names, "blkio_write")
+}
+
+func TestRelease(t *testing.T) {
+	mgr := &MockCgroupManager{}
+	mgr.On("GetPids").Return([]int{}, nil).Once()
+	mgr.On("GetPaths").Return(map[string]string{"": "/sys/fs/cgroup/metric_gateway/id"})
+
+	// nothing to move
+	c := &cgroup.CGroup{Manager: mgr}
+	require.NoError(t, c.Release())
+
+	mgr.On("GetPids").Return([]int(nil), errors.New("no cgroup")).Once()
+	require.Error(t, c.Release())
+}
+
+func TestLayout(t *testing.T) {
+	t.Cleanup(func() { cgroup.SetLayout(cgroup.Layout{Root: cgroup.DefaultRoot}) })
+
+	require.Error(t, cgroup.SetLayout(cgroup.Layout{Root: "relative"}))
+	require.Error(t, cgroup.SetLayout(cgroup.Layout{Root: "/"}))
+
+	require.NoError(t, cgroup.SetLayout(cgroup.Layout{Root: "/apptheus.slice/"}))
+	require.Equal(t, "id", cgroup.PathOf("id", 1000))
+	_, ok := cgroup.UserOf("id")
+	require.False(t, ok)
+
+	require.NoError(t, cgroup.SetLayout(cgroup.Layout{Root: "/apptheus.slice", PerUser: true}))
+	require.Equal(t, "user-1000/id", cgroup.PathOf("id", 1000))
+	uid, ok := cgroup.UserOf("user-1000/id")
+	require.True(t, ok)
+	require.Equal(t, uint32(1000), uid)
+	_, ok = cgroup.UserOf("other/id")
+	require.False(t, ok)
+
+	require.True(t, cgroup.Managed("/apptheus.slice"))
+	require.True(t, cgroup.Managed("/apptheus.slice/user-1000/id"))
+	require.False(t, cgroup.Managed("/apptheus.slice2/id"))
+	require.False(t, cgroup.Managed("/user.slice/user-1000.slice/session-1.scope"))
+}
+
+func TestLimitStats(t *testing.T) {
+	stats := cgroup.LimitStats(&configs.Resources{
+		Memory:     1 << 30,
+		Unified:    map[string]string{"memory.high": "536870912"},
+		CpuQuota:   150000,
+		CpuPeriod:  100000,
+		CpusetCpus: "0-3,8",
+		PidsLimit:  100,
+	})
+	require.Equal(t, map[string]float64{
+		"limit_memory_max_bytes":  1 << 30,
+		"limit_memory_high_bytes": 1 << 29,
+		"limit_cpu_cores":         1.5,
+		"limit_cpuset_cpus":       5,
+		"limit_pids_max":          100,
+	}, stats)
+	for name := range stats {
+		require.Contains(t, cgroup.LimitNames(), name)
+	}
+
+	require.Empty(t, cgroup.LimitStats(&configs.Resources{CpuQuota: -1, CpuPeriod: 100000, CpusetCpus: "3-1"}))
+}
+
+func TestUpdatedResources(t *testing.T) {
+	previous := &configs.Resources{
+		Memory:     1 << 30,
+		Unified:    map[string]string{"memory.high": "536870912"},
+		CpuQuota:   150000,
+		CpuPeriod:  100000,
+		CpusetCpus: "0-3",
+		PidsLimit:  100,
+	}
+	next := &configs.Resources{Memory: 1 << 29, PidsLimit: 10}
+
+	// the limits no longer set are lifted
+	require.Equal(t, &configs.Resources{
+		Memory:    1 << 29,
+		Unified:   map[string]string{"memory.high": "max"},
+		CpuQuota:  -1,
+		PidsLimit: 10,
+	}, cgroup.UpdatedResources(previous, next))
+	require.Nil(t, next.Unified)
+
+	require.Equal(t, &configs.Resources{
+		Memory:    -1,
+		Unified:   map[string]string{"memory.high": "max"},
+		CpuQuota:  -1,
+		PidsLimit: -1,
+	}, cgroup.UpdatedResources(previous, nil))
+	require.Equal(t, next, cgroup.UpdatedResources(nil, next))
+}
+
+func TestReleaseRecordedOrigin(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to create cgroups")
+	}
+	t.Cleanup(func() { cgroup.SetLayout(cgroup.Layout{Root: cgroup.DefaultRoot}) })
+	root := fmt.Sprintf("/apptheus-test-%d", os.Getpid())
+	require.NoError(t, cgroup.SetLayout(cgroup.Layout{Root: root}))
+
+	var managers []cgroups.Manager
+	for _, path := range []string{root, root + "-origin"} {
+		mgr, err := manager.New(&configs.Cgroup{Path: path, Resources: &configs.Resources{}})
+		require.NoError(t, err)
+		managers = append(managers, mgr)
+	}
+	gateway, origin := managers[0], managers[1]
+
+	cmd := exec.Command("sleep", "60")
+	require.NoError(t, cmd.Start())
+	require.NoError(t, origin.Apply(cmd.Process.Pid))
+
+	c, err := cgroup.NewCGroup("container")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		c.Destroy()
+		gateway.Destroy()
+		origin.Destroy()
+	})
+	require.NoError(t, c.Apply(cmd.Process.Pid))
+
+	targets, err := cgroup.ReleaseTargets()
+	require.NoError(t, err)
+	for _, path := range origin.GetPaths() {
+		require.Contains(t, targets, filepath.Join(path, "cgroup.procs"))
+	}
+
+	// as for a container resumed by the next run
+	resumed, err := cgroup.NewCGroup("container")
+	require.NoError(t, err)
+	require.NoError(t, resumed.Release())
+	paths, err := cgroups.ParseCgroupFile(fmt.Sprintf("/proc/%d/cgroup", cmd.Process.Pid))
+	require.NoError(t, err)
+	for subsystem, path := range origin.GetPaths() {
+		if _, ok := paths[subsystem]; ok {
+			require.True(t, strings.HasSuffix(path, paths[subsystem]), "%s: %s", subsystem, paths[subsystem])
+		}
+	}
+}
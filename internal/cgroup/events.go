@@ -0,0 +1,165 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package cgroup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+	"golang.org/x/sys/unix"
+)
+
+// eventsFile reports whether a cgroup v2 has processes in its subtree, it is
+// modified when this changes.
+const eventsFile = "cgroup.events"
+
+// EventsPath returns the cgroup.events file of the cgroup, or an empty string
+// on cgroup v1 hierarchies which do not have it.
+func (c *CGroup) EventsPath() string {
+	if !cgroups.IsCgroup2UnifiedMode() {
+		return ""
+	}
+	path := c.Path("")
+	if path == "" {
+		return ""
+	}
+	return filepath.Join(path, eventsFile)
+}
+
+// Populated reports whether the cgroup has processes left. It reads
+// cgroup.events when available, which is much cheaper than listing the
+// processes.
+func (c *CGroup) Populated() (bool, error) {
+	if path := c.EventsPath(); path != "" {
+		return ParsePopulated(path)
+	}
+	return c.HasProcess()
+}
+
+// ParsePopulated returns the populated field of a cgroup.events file.
+func ParsePopulated(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), " ")
+		if key == "populated" {
+			return value == "1", nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+	return false, fmt.Errorf("no populated field in %s", path)
+}
+
+// ErrNoEvents is returned by NewEventWatcher on cgroup v1 hierarchies, the
+// cgroups are then polled instead.
+var ErrNoEvents = errors.New("cgroup events are only available on cgroup v2")
+
+// EventWatcher watches the cgroup.events files of many cgroups with a single
+// inotify instance, calling back whenever one of them is modified.
+type EventWatcher struct {
+	// fd is only used while mu is held and the file is not closed, as
+	// calling file.Fd would make it blocking
+	fd   int
+	file *os.File
+
+	mu        sync.Mutex
+	callbacks map[int32]func()
+}
+
+// NewEventWatcher starts watching cgroup events. It fails with ErrNoEvents on
+// cgroup v1 hierarchies, whose release notifications need a host wide release
+// agent.
+func NewEventWatcher() (*EventWatcher, error) {
+	if !cgroups.IsCgroup2UnifiedMode() {
+		return nil, ErrNoEvents
+	}
+
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("while initializing inotify: %w", err)
+	}
+
+	w := &EventWatcher{
+		fd: fd,
+		// a non blocking descriptor is handled by the runtime poller, so
+		// that closing the file interrupts the pending read
+		file:      os.NewFile(uintptr(fd), "inotify"),
+		callbacks: make(map[int32]func()),
+	}
+	go w.loop()
+	return w, nil
+}
+
+// Watch calls fn whenever the cgroup.events file at path is modified, until
+// the returned function is called.
+func (w *EventWatcher) Watch(path string, fn func()) (func(), error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.callbacks == nil {
+		return nil, os.ErrClosed
+	}
+	wd, err := unix.InotifyAddWatch(w.fd, path, unix.IN_MODIFY)
+	if err != nil {
+		return nil, fmt.Errorf("while watching %s: %w", path, err)
+	}
+	w.callbacks[int32(wd)] = fn
+
+	return func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if _, ok := w.callbacks[int32(wd)]; ok {
+			delete(w.callbacks, int32(wd))
+			// the watch is already gone if the cgroup has been removed
+			unix.InotifyRmWatch(w.fd, uint32(wd))
+		}
+	}, nil
+}
+
+// Close stops watching all the cgroups.
+func (w *EventWatcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.callbacks = nil
+	return w.file.Close()
+}
+
+func (w *EventWatcher) loop() {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+
+			w.mu.Lock()
+			fn := w.callbacks[event.Wd]
+			if event.Mask&unix.IN_IGNORED != 0 && w.callbacks != nil {
+				delete(w.callbacks, event.Wd)
+			}
+			w.mu.Unlock()
+
+			if fn != nil && event.Mask&unix.IN_MODIFY != 0 {
+				fn()
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package cgroup_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/cgroup"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePopulated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cgroup.events")
+
+	require.NoError(t, os.WriteFile(path, []byte("populated 1\nfrozen 0\n"), 0o644))
+	populated, err := cgroup.ParsePopulated(path)
+	require.NoError(t, err)
+	require.True(t, populated)
+
+	require.NoError(t, os.WriteFile(path, []byte("populated 0\nfrozen 0\n"), 0o644))
+	populated, err = cgroup.ParsePopulated(path)
+	require.NoError(t, err)
+	require.False(t, populated)
+
+	require.NoError(t, os.WriteFile(path, []byte("frozen 0\n"), 0o644))
+	_, err = cgroup.ParsePopulated(path)
+	require.Error(t, err)
+}
+
+func TestEventWatcher(t *testing.T) {
+	w, err := cgroup.NewEventWatcher()
+	if err != nil {
+		t.Skip(err)
+	}
+	defer w.Close()
+
+	path := filepath.Join(t.TempDir(), "cgroup.events")
+	require.NoError(t, os.WriteFile(path, []byte("populated 1\n"), 0o644))
+
+	modified := make(chan struct{}, 1)
+	unwatch, err := w.Watch(path, func() {
+		select {
+		case modified <- struct{}{}:
+		default:
+		}
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("populated 0\n"), 0o644))
+	select {
+	case <-modified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+	}
+
+	unwatch()
+	// the write may have been reported twice
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-modified:
+	default:
+	}
+	require.NoError(t, os.WriteFile(path, []byte("populated 1\n"), 0o644))
+	select {
+	case <-modified:
+		t.Fatal("event received after unwatch")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
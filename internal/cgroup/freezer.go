@@ -0,0 +1,58 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package cgroup
+
+import (
+	"errors"
+	"os"
+
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+	"github.com/opencontainers/runc/libcontainer/configs"
+	"golang.org/x/sys/unix"
+)
+
+// SetFrozen freezes or thaws all the processes of the cgroup and its
+// descendants.
+func (c *CGroup) SetFrozen(frozen bool) error {
+	state := configs.Thawed
+	if frozen {
+		state = configs.Frozen
+	}
+	return c.Freeze(state)
+}
+
+// Frozen reports whether the cgroup is frozen, it is false when the freezer
+// is not available.
+func (c *CGroup) Frozen() (bool, error) {
+	state, err := c.GetFreezerState()
+	return state == configs.Frozen, err
+}
+
+// Kill kills all the processes of the cgroup and its descendants, with
+// cgroup.kill when the kernel supports it. Otherwise the cgroup is frozen
+// while its processes are killed one by one, so that none can fork in between.
+func (c *CGroup) Kill() error {
+	if cgroups.IsCgroup2UnifiedMode() {
+		err := cgroups.WriteFile(c.Path(""), "cgroup.kill", "1")
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	if err := c.SetFrozen(true); err != nil {
+		return err
+	}
+	pids, err := c.GetAllPids()
+	if err != nil {
+		return errors.Join(err, c.SetFrozen(false))
+	}
+	var errs error
+	for _, pid := range pids {
+		// the process may have exited in between
+		if err := unix.Kill(pid, unix.SIGKILL); err != nil && !errors.Is(err, unix.ESRCH) {
+			errs = errors.Join(errs, err)
+		}
+	}
+	// the killed processes only exit once thawed
+	return errors.Join(errs, c.SetFrozen(false))
+}
@@ -0,0 +1,112 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package cgroup
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runc/libcontainer/configs"
+)
+
+// limit metrics, reported for the limits set on a container
+const (
+	limitMemoryMax  = "limit_memory_max_bytes"
+	limitMemoryHigh = "limit_memory_high_bytes"
+	limitCPU        = "limit_cpu_cores"
+	limitCpuset     = "limit_cpuset_cpus"
+	limitPidsMax    = "limit_pids_max"
+)
+
+// LimitNames returns the names of the metrics reporting the limits of a
+// container.
+func LimitNames() map[string]struct{} {
+	return map[string]struct{}{
+		limitMemoryMax:  {},
+		limitMemoryHigh: {},
+		limitCPU:        {},
+		limitCpuset:     {},
+		limitPidsMax:    {},
+	}
+}
+
+// LimitStats returns the metrics reporting the limits set by r.
+func LimitStats(r *configs.Resources) map[string]float64 {
+	stats := make(map[string]float64)
+	if r.Memory > 0 {
+		stats[limitMemoryMax] = float64(r.Memory)
+	}
+	if high, ok := r.Unified["memory.high"]; ok {
+		if n, err := strconv.ParseInt(high, 10, 64); err == nil {
+			stats[limitMemoryHigh] = float64(n)
+		}
+	}
+	if r.CpuQuota > 0 && r.CpuPeriod > 0 {
+		stats[limitCPU] = float64(r.CpuQuota) / float64(r.CpuPeriod)
+	}
+	if n := countCPUs(r.CpusetCpus); n > 0 {
+		stats[limitCpuset] = float64(n)
+	}
+	if r.PidsLimit > 0 {
+		stats[limitPidsMax] = float64(r.PidsLimit)
+	}
+	return stats
+}
+
+// UpdatedResources returns the resources replacing the limits set by previous
+// on a cgroup with the ones of next, either being nil if there are none. The
+// limits only set by previous are lifted, but for the cpuset which is kept.
+func UpdatedResources(previous, next *configs.Resources) *configs.Resources {
+	r := &configs.Resources{}
+	if next != nil {
+		copied := *next
+		r = &copied
+	}
+	if previous == nil {
+		return r
+	}
+	if previous.Memory > 0 && r.Memory == 0 {
+		r.Memory = -1
+	}
+	if _, ok := previous.Unified["memory.high"]; ok {
+		if _, ok := r.Unified["memory.high"]; !ok {
+			unified := map[string]string{"memory.high": "max"}
+			for k, v := range r.Unified {
+				unified[k] = v
+			}
+			r.Unified = unified
+		}
+	}
+	if previous.CpuQuota > 0 && r.CpuQuota == 0 {
+		r.CpuQuota = -1
+	}
+	if previous.PidsLimit > 0 && r.PidsLimit == 0 {
+		r.PidsLimit = -1
+	}
+	return r
+}
+
+// countCPUs returns the number of CPUs of a cpuset list, e.g. "0-3,8", or 0 if
+// it is invalid.
+func countCPUs(list string) int {
+	n := 0
+	for _, part := range strings.Split(list, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return 0
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil || end < start {
+				return 0
+			}
+		}
+		n += end - start + 1
+	}
+	return n
+}
@@ -11,6 +11,14 @@ import (
 	"time"
 
 	"github.com/opencontainers/runc/libcontainer/cgroups"
+	"github.com/opencontainers/runc/libcontainer/configs"
+)
+
+// names of the stats sampled by the StatManager which are used outside of
+// their metrics
+const (
+	CPUUsagePercent = "cpu_usage_per"
+	MemoryUsage     = "memory_usage"
 )
 
 type Marshal interface {
@@ -37,20 +45,18 @@ func (s *StatManager) WithCPU() *StatManager {
 		curTime := uint64(nowTime.UnixNano())
 		curCPU := s.CpuStats.CpuUsage.TotalUsage
 
-		deltaCPU := float64(curCPU - s.prevCPU)
-		if s.prevTime == 0 {
-			// 500ms earlier by default
-			s.prevTime = uint64(nowTime.Truncate(500 * time.Millisecond).UnixNano())
+		// the usage is only known from the second sample on, the
+		// StatManager being kept between samples
+		var cpuPercent float64
+		if s.prevTime != 0 && curTime > s.prevTime && curCPU >= s.prevCPU {
+			cpuPercent = float64(curCPU-s.prevCPU) / float64(curTime-s.prevTime) * 100
 		}
 
-		deltaTime := float64(curTime - s.prevTime)
-		cpuPercent := (deltaCPU / deltaTime) * 100
-
 		// update the saved metrics
 		s.prevTime = curTime
 		s.prevCPU = curCPU
 		return map[string]float64{
-			"cpu_usage_per": cpuPercent,
+			CPUUsagePercent: cpuPercent,
 			"cpu_prevTime":  float64(s.prevTime),
 			"cpu_prevCpu":   float64(s.prevCPU),
 		}
@@ -76,7 +82,7 @@ func (s *StatManager) WithMemory() *StatManager {
 		}
 		return map[string]float64{
 			"memory_usage_per": memPercent,
-			"memory_usage":     float64(memUsage),
+			MemoryUsage:        float64(memUsage),
 			"memory_limit":     float64(memLimit),
 		}
 	})
@@ -153,8 +159,37 @@ type Stat interface {
 }
 
 type ContainerInfo struct {
-	FullPath string
-	Pid      uint64
-	Exe      string
-	ID       string
+	FullPath  string
+	Pid       uint64
+	StartTime uint64
+	Exe       string
+	ID        string
+	// Labels are additional grouping labels of the container metrics.
+	Labels map[string]string
+	// Owner is the process which registered the container.
+	Owner Owner
+	// ReleaseOnDisconnect stops the monitoring once the owner is gone.
+	ReleaseOnDisconnect bool
+	// HeartbeatTimeout, if not zero, is how long the owner may go without
+	// sending heartbeats before being considered gone.
+	HeartbeatTimeout time.Duration
+	// Interval, if not zero, overrides the sampling interval of the
+	// scheduler.
+	Interval time.Duration
+	// CgroupPath, if not empty, is the existing cgroup v2 the container is
+	// monitored in, instead of moving it into a cgroup of its own.
+	CgroupPath string
+	// Limits is the name of the policy limits applying to the container,
+	// whose Resources are set on its cgroup.
+	Limits    string
+	Resources *configs.Resources
+}
+
+// Owner identifies the process which registered a container, only this
+// process is allowed to act on it.
+type Owner struct {
+	Pid       int32
+	StartTime uint64
+	UID       uint32
+	GID       uint32
 }
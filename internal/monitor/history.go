@@ -0,0 +1,118 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package monitor
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// History keeps the recent samples of a container in a ring buffer, for a
+// quick look at them without Prometheus. The samples are taken at most once
+// per retention/capacity, so that the buffer always covers the retention
+// whatever the sampling interval. It is safe to be used concurrently.
+type History struct {
+	mu        sync.Mutex
+	retention time.Duration
+	step      time.Duration
+
+	// times holds the time of the samples in unix milliseconds.
+	times []int64
+	// series holds the values of every metric, aligned with times, NaN
+	// where a sample lacks the metric.
+	series map[string][]float64
+	// next is the slot of the next sample, size the number of samples held.
+	next int
+	size int
+}
+
+// Point is a sample of a metric.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// NewHistory returns a history of the samples of the last retention, keeping
+// up to capacity samples.
+func NewHistory(retention time.Duration, capacity int) *History {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &History{
+		retention: retention,
+		step:      retention / time.Duration(capacity),
+		times:     make([]int64, capacity),
+		series:    make(map[string][]float64),
+	}
+}
+
+// Add records the sample taken at t, unless the previous one is too recent.
+func (h *History) Add(t time.Time, values map[string]float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ms := t.UnixMilli()
+	if h.size > 0 {
+		last := h.times[(h.next+len(h.times)-1)%len(h.times)]
+		if ms-last < h.step.Milliseconds() {
+			return
+		}
+	}
+
+	slot := h.next
+	h.times[slot] = ms
+	for _, column := range h.series {
+		column[slot] = math.NaN()
+	}
+	for name, value := range values {
+		column, ok := h.series[name]
+		if !ok {
+			column = make([]float64, len(h.times))
+			for n := range column {
+				column[n] = math.NaN()
+			}
+			h.series[name] = column
+		}
+		column[slot] = value
+	}
+
+	h.next = (slot + 1) % len(h.times)
+	if h.size < len(h.times) {
+		h.size++
+	}
+}
+
+// Query returns the samples of the metric taken since the given time and
+// within the retention, oldest first, by metric name. All the metrics are
+// returned if metric is empty.
+func (h *History) Query(metric string, since time.Time) map[string][]Point {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	from := time.Now().Add(-h.retention).UnixMilli()
+	if s := since.UnixMilli(); s > from {
+		from = s
+	}
+
+	result := make(map[string][]Point)
+	for name, column := range h.series {
+		if metric != "" && name != metric {
+			continue
+		}
+		var points []Point
+		for n := 0; n < h.size; n++ {
+			slot := (h.next - h.size + n + len(h.times)) % len(h.times)
+			// a missing sample is NaN, and the infinite values can't be
+			// encoded in JSON
+			if h.times[slot] < from || math.IsNaN(column[slot]) || math.IsInf(column[slot], 0) {
+				continue
+			}
+			points = append(points, Point{Time: time.UnixMilli(h.times[slot]), Value: column[slot]})
+		}
+		if len(points) != 0 {
+			result[name] = points
+		}
+	}
+	return result
+}
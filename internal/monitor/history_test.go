@@ -0,0 +1,49 @@
+package monitor
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	h := NewHistory(time.Hour, 4)
+	require.Equal(t, 15*time.Minute, h.step)
+	require.Empty(t, h.Query("", time.Time{}))
+
+	start := time.Now().Add(-75 * time.Minute)
+	for n := 0; n < 6; n++ {
+		values := map[string]float64{"memory_usage": float64(n)}
+		if n%2 == 0 {
+			values["frozen"] = 1
+		}
+		h.Add(start.Add(time.Duration(n)*15*time.Minute), values)
+		// too close to the previous sample
+		h.Add(start.Add(time.Duration(n)*15*time.Minute+time.Minute), map[string]float64{"memory_usage": -1})
+	}
+
+	// the oldest samples are overwritten
+	series := h.Query("", time.Time{})
+	require.Len(t, series, 2)
+	values := []float64{}
+	for _, p := range series["memory_usage"] {
+		values = append(values, p.Value)
+	}
+	require.Equal(t, []float64{2, 3, 4, 5}, values)
+	require.Len(t, series["frozen"], 2)
+
+	series = h.Query("memory_usage", start.Add(61*time.Minute))
+	require.Len(t, series, 1)
+	require.Len(t, series["memory_usage"], 1)
+	require.Equal(t, 5.0, series["memory_usage"][0].Value)
+
+	require.Empty(t, h.Query("unknown", time.Time{}))
+
+	// the infinite values are left out
+	h.Add(time.Now(), map[string]float64{"memory_usage": math.Inf(1)})
+	series = h.Query("memory_usage", start.Add(61*time.Minute))
+	require.Len(t, series["memory_usage"], 1)
+	require.Equal(t, 5.0, series["memory_usage"][0].Value)
+}
@@ -4,91 +4,643 @@ package monitor
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/apptainer/apptheus/internal/cgroup"
 	"github.com/apptainer/apptheus/internal/cgroup/parser"
+	"github.com/apptainer/apptheus/internal/proc"
 	"github.com/apptainer/apptheus/internal/push"
 	"github.com/apptainer/apptheus/internal/storage"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/opencontainers/runc/libcontainer/configs"
+	"golang.org/x/sys/unix"
 )
 
+var errProcessExited = errors.New("container process exited while being moved into the cgroup")
+
+// ErrNotSetUp is returned when controlling a container whose cgroup is not set
+// up yet.
+var ErrNotSetUp = errors.New("container cgroup is not set up yet")
+
+const (
+	// IntervalMetric reports the effective sampling interval of a container.
+	IntervalMetric = "sampling_interval_seconds"
+	// FrozenMetric reports whether a container is frozen.
+	FrozenMetric = "frozen"
+)
+
+// Instance monitors a container. It has no goroutine of its own, it is
+// sampled by a Scheduler which never runs the same instance concurrently.
 type Instance struct {
 	*cgroup.CGroup
-	ticker *time.Ticker
+	Container *parser.ContainerInfo
+	// Started is the time the monitoring started.
+	Started time.Time
+
+	// pidfd refers to the verified container process, -1 if the host kernel
+	// does not support pidfd_open.
+	pidfd int
+
+	mu sync.Mutex
+	// labels are the additional grouping labels set by the client.
+	labels map[string]string
+
+	// lastHeartbeat is the time of the last heartbeat of the owner.
+	lastHeartbeat time.Time
+	// interval overrides the sampling interval of the scheduler if not zero.
+	interval time.Duration
+	// limitsName is the name of the policy limits applying to the container,
+	// and nextLimits their resources, set on the cgroup before the next
+	// sample if limitsChanged.
+	limitsName    string
+	nextLimits    *configs.Resources
+	limitsChanged bool
+	// control is the cgroup once set up, for the operations requested by
+	// the administrators.
+	control *cgroup.CGroup
+
+	// history holds the recent samples, nil if disabled.
+	history *History
+
+	// state of the monitoring, only accessed by the worker sampling the
+	// instance
+	applied bool
+	resumed bool
+	running bool
+	pushed  map[string]string
+	limits  map[string]float64
+	buffer  bytes.Buffer
+	unwatch func()
+	// previous holds the values of the previous sample
+	previous map[string]float64
+	// effective is the interval until the next sample
+	effective time.Duration
+	// resources are the limits set on the cgroup
+	resources *configs.Resources
+
+	// emptied is set once the cgroup events reported that the container
+	// has no process left
+	emptied atomic.Bool
+
+	// scheduling state, guarded by the scheduler
+	scheduler *Scheduler
+	due       time.Time
+	index     int
+	busy      bool
+	woken     bool
+
+	stop        chan struct{}
+	stopOnce    sync.Once
+	release     chan struct{}
+	releaseOnce sync.Once
+	exited      chan struct{}
+	onExit      func()
 
 	ErrCh chan error
 	Done  chan struct{}
 }
 
-func New(ticker *time.Ticker) *Instance {
+// New creates a monitor instance for the container, taking ownership of
+// pidfd, which is closed once the monitoring is over.
+func New(container *parser.ContainerInfo, pidfd int) *Instance {
 	ins := &Instance{}
-	ins.ticker = ticker
+	ins.Container = container
+	ins.pidfd = pidfd
+	ins.interval = container.Interval
+	ins.limitsName = container.Limits
+	ins.running = true
+	ins.index = -1
+	ins.stop = make(chan struct{})
+	ins.release = make(chan struct{})
+	ins.exited = make(chan struct{})
+	ins.lastHeartbeat = time.Now()
 	ins.ErrCh = make(chan error, 1)
 	ins.Done = make(chan struct{}, 1)
 	return ins
 }
 
-func (i *Instance) Start(container *parser.ContainerInfo, ms storage.MetricStore, logger log.Logger) {
-	defer i.ticker.Stop()
+// Stop stops the monitoring, the metrics of the container are removed.
+func (i *Instance) Stop() {
+	i.stopOnce.Do(func() {
+		close(i.stop)
+		i.wake()
+	})
+}
+
+// Release stops the monitoring after a final sample. The processes left are
+// moved out of the cgroup, which is removed, and the metrics of the container
+// are kept.
+func (i *Instance) Release() {
+	i.releaseOnce.Do(func() {
+		close(i.release)
+		i.wake()
+	})
+}
+
+// wake asks the scheduler to handle the instance right away.
+func (i *Instance) wake() {
+	if i.scheduler != nil {
+		i.scheduler.wake(i)
+	}
+}
+
+// Interval returns the sampling interval of the container, zero if it uses
+// the interval of the scheduler.
+func (i *Instance) Interval() time.Duration {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.interval
+}
+
+// SetInterval sets the sampling interval of the container, zero restores the
+// interval of the scheduler. It applies from the next sample on.
+func (i *Instance) SetInterval(interval time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.interval = interval
+}
+
+// Limits returns the name of the policy limits applying to the container,
+// empty if there are none.
+func (i *Instance) Limits() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.limitsName
+}
+
+// SetLimits replaces the policy limits applying to the container, e.g. once
+// its labels are updated, name being empty if none applies anymore. They are
+// set on the cgroup before the next sample, the cgroups monitored in place
+// being never modified.
+func (i *Instance) SetLimits(name string, r *configs.Resources) {
+	if i.Container.CgroupPath != "" {
+		return
+	}
+	i.mu.Lock()
+	if name == i.limitsName {
+		i.mu.Unlock()
+		return
+	}
+	i.limitsName = name
+	i.nextLimits = r
+	i.limitsChanged = true
+	i.mu.Unlock()
+	i.wake()
+}
+
+// SetFrozen freezes or thaws the processes of the container.
+func (i *Instance) SetFrozen(frozen bool) error {
+	c, err := i.controlled()
+	if err != nil {
+		return err
+	}
+	if err := c.SetFrozen(frozen); err != nil {
+		return err
+	}
+	// sampled right away to report the new state
+	i.wake()
+	return nil
+}
+
+// Kill kills all the processes of the container, the monitoring ends once
+// they exited.
+func (i *Instance) Kill() error {
+	c, err := i.controlled()
+	if err != nil {
+		return err
+	}
+	if err := c.Kill(); err != nil {
+		return err
+	}
+	i.wake()
+	return nil
+}
+
+func (i *Instance) controlled() (*cgroup.CGroup, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.control == nil {
+		return nil, ErrNotSetUp
+	}
+	return i.control, nil
+}
+
+// History returns the recent samples of the container, nil if the history is
+// disabled.
+func (i *Instance) History() *History {
+	return i.history
+}
+
+// Disconnected notifies the instance that its owner closed its connection.
+// It reports whether the monitoring is released, as set by the policy.
+func (i *Instance) Disconnected() bool {
+	if i.Container.ReleaseOnDisconnect {
+		i.Release()
+	}
+	return i.Container.ReleaseOnDisconnect
+}
+
+// Heartbeat records that the owner is still alive.
+func (i *Instance) Heartbeat() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.lastHeartbeat = time.Now()
+}
+
+// Exited is closed once the monitoring is over.
+func (i *Instance) Exited() <-chan struct{} {
+	return i.exited
+}
+
+// Labels returns the additional grouping labels set by the client.
+func (i *Instance) Labels() map[string]string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	labels := make(map[string]string, len(i.labels))
+	for k, v := range i.labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// SetLabels replaces the additional grouping labels set by the client, the
+// metrics are pushed with them from the next sample on.
+func (i *Instance) SetLabels(labels map[string]string) {
+	copied := make(map[string]string, len(labels))
+	for k, v := range labels {
+		copied[k] = v
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.labels = copied
+}
+
+// GroupingLabels returns the grouping labels of the container metrics.
+func (i *Instance) GroupingLabels() map[string]string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	labels := make(map[string]string, len(i.labels)+len(i.Container.Labels)+1)
+	for k, v := range i.labels {
+		labels[k] = v
+	}
+	for k, v := range i.Container.Labels {
+		labels[k] = v
+	}
+	labels["job"] = i.Container.ID
+	return labels
+}
 
-	c, err := cgroup.NewCGroup(container.ID)
+// setup moves the container process into its cgroup, unless it is monitored
+// in place.
+func (i *Instance) setup(logger log.Logger) error {
+	container := i.Container
+	var c *cgroup.CGroup
+	var err error
+	if container.CgroupPath != "" {
+		c, err = cgroup.NewInPlace(container.CgroupPath)
+	} else {
+		c, err = cgroup.NewCGroup(cgroup.PathOf(container.ID, container.Owner.UID))
+	}
 	if err != nil {
 		level.Error(logger).Log("msg", "while validating cgroup info", "err", err, "container id", container.ID)
-		i.ErrCh <- err
-		return
+		return err
 	}
 	i.CGroup = c
 
+	// the processes are already in the cgroup, which is never modified when
+	// monitored in place
+	if c.InPlace() {
+		if err := i.verify(); err != nil {
+			level.Error(logger).Log("msg", "while verifying the container process", "err", err, "container id", container.ID)
+			return err
+		}
+		i.pushed = i.GroupingLabels()
+		i.watch(logger)
+		return nil
+	}
+	if i.resumed {
+		i.applied = true
+		i.pushed = i.GroupingLabels()
+		i.watch(logger)
+		return nil
+	}
+
+	// make sure the pid still refers to the verified process before moving it
+	if err := i.verify(); err != nil {
+		level.Error(logger).Log("msg", "while verifying the container process", "err", err, "container id", container.ID)
+		return err
+	}
+
 	err = i.Apply(int(container.Pid))
 	if err != nil {
 		level.Error(logger).Log("msg", "while adding proc to cgroup info", "err", err, "container id", container.ID)
-		i.ErrCh <- err
+		return err
+	}
+	i.applied = true
+
+	// the process may have exited and its pid may have been reused in between
+	if err := i.verify(); err != nil {
+		err = fmt.Errorf("%w: %w", errProcessExited, err)
+		level.Error(logger).Log("msg", "while verifying the container process", "err", err, "container id", container.ID)
+		return err
+	}
+
+	// the container is still monitored if its limits can't be set
+	if container.Resources != nil {
+		if err := i.Set(container.Resources); err != nil {
+			level.Error(logger).Log("msg", "could not apply the resource limits", "limits", container.Limits, "err", err, "container id", container.ID)
+		} else {
+			i.limits = cgroup.LimitStats(container.Resources)
+			i.resources = container.Resources
+			level.Info(logger).Log("msg", "resource limits applied", "limits", container.Limits, "container id", container.ID)
+		}
+	}
+
+	i.pushed = i.GroupingLabels()
+	i.watch(logger)
+	return nil
+}
+
+// watch gets the instance woken up as soon as its cgroup is empty, instead of
+// finding it out at the next sample. Without cgroup events, the cgroup is
+// polled at every sample.
+func (i *Instance) watch(logger log.Logger) {
+	if i.scheduler == nil || i.scheduler.events == nil {
+		return
+	}
+	path := i.EventsPath()
+	if path == "" {
 		return
 	}
 
-	defer i.Destroy()
+	unwatch, err := i.scheduler.events.Watch(path, func() {
+		if populated, err := cgroup.ParsePopulated(path); err == nil && !populated {
+			i.emptied.Store(true)
+			i.wake()
+		}
+	})
+	if err != nil {
+		level.Warn(logger).Log("msg", "could not watch the cgroup events, polling it instead", "err", err, "container id", i.Container.ID)
+		return
+	}
+	i.unwatch = unwatch
+}
+
+// tick runs one step of the monitoring: the first one moves the container
+// process into its cgroup, all of them sample it. It reports whether the
+// monitoring is over, in which case cleanup must be called.
+func (i *Instance) tick(ms storage.MetricStore, logger log.Logger) bool {
+	container := i.Container
 
-	var buffer bytes.Buffer
-	labels := make(map[string]string)
-	labels["job"] = container.ID
+	if i.CGroup == nil {
+		if err := i.setup(logger); err != nil {
+			i.ErrCh <- err
+			return true
+		}
+		i.mu.Lock()
+		i.control = i.CGroup
+		i.mu.Unlock()
+	}
+
+	select {
+	case <-i.stop:
+		level.Info(logger).Log("msg", "monitoring stopped", "container id", container.ID)
+		ms.SubmitWriteRequest(storage.WriteRequest{
+			Labels:    i.pushed,
+			Timestamp: time.Now(),
+		})
+		i.Done <- struct{}{}
+		return true
+	case <-i.release:
+		i.finalize(ms, logger)
+		return true
+	default:
+	}
+
+	if container.ReleaseOnDisconnect {
+		if reason := i.ownerGone(); reason != "" {
+			level.Info(logger).Log("msg", "container owner is gone", "reason", reason, "container id", container.ID)
+			i.finalize(ms, logger)
+			return true
+		}
+	}
+
+	if i.running {
+		running, err := i.processRunning()
+		if err != nil {
+			level.Error(logger).Log("msg", "while polling the container process", "err", err, "container id", container.ID)
+			i.ErrCh <- err
+			return true
+		}
+		i.running = running
+		if !running && i.pidfd >= 0 {
+			level.Info(logger).Log("msg", "container process exited, waiting for remaining processes", "container id", container.ID)
+		}
+	}
 
-	for range i.ticker.C {
-		ok, err := i.HasProcess()
+	if !i.running || i.emptied.Load() {
+		ok, err := i.Populated()
 		if err != nil {
 			level.Error(logger).Log("msg", "while verifying if there are any processes inside current cgroup", "err", err, "container id", container.ID)
 			i.ErrCh <- err
-			return
+			return true
 		}
 
-		// No processes left in the current cgroup
+		// No processes left in the current cgroup, the stats are still
+		// readable until it is removed
 		if !ok {
 			level.Info(logger).Log("msg", "no processes in current cgroup, exit", "container id", container.ID)
-			// also need to remove the related job metrics
-			ms.SubmitWriteRequest(storage.WriteRequest{
-				Labels:    labels,
-				Timestamp: time.Now(),
-			})
+			if err := i.sample(ms); err != nil {
+				level.Error(logger).Log("msg", "while taking the final sample", "err", err, "container id", container.ID)
+			}
 			i.Done <- struct{}{}
-			return
+			return true
 		}
+	}
 
-		buffer.Reset()
-		buffer, err := i.Marshal(&buffer)
-		if err != nil {
-			level.Error(logger).Log("msg", "while marshing the stat info", "err", err, "container id", container.ID)
-			i.ErrCh <- err
-			return
+	// the labels have been updated, the metrics are moved to the new
+	// grouping key
+	if current := i.GroupingLabels(); !equalLabels(current, i.pushed) {
+		ms.SubmitWriteRequest(storage.WriteRequest{
+			Labels:    i.pushed,
+			Timestamp: time.Now(),
+		})
+		i.pushed = current
+	}
+	i.updateLimits(logger)
+
+	if err := i.sample(ms); err != nil {
+		level.Error(logger).Log("msg", "while sampling the container", "err", err, "container id", container.ID)
+		i.ErrCh <- err
+		return true
+	}
+	return false
+}
+
+// updateLimits sets the policy limits changed since the previous sample on the
+// cgroup.
+func (i *Instance) updateLimits(logger log.Logger) {
+	i.mu.Lock()
+	name, r, changed := i.limitsName, i.nextLimits, i.limitsChanged
+	i.limitsChanged = false
+	i.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	if err := i.Set(cgroup.UpdatedResources(i.resources, r)); err != nil {
+		level.Error(logger).Log("msg", "could not update the resource limits", "limits", name, "err", err, "container id", i.Container.ID)
+		return
+	}
+	i.resources = r
+	i.limits = nil
+	if r != nil {
+		i.limits = cgroup.LimitStats(r)
+	}
+	level.Info(logger).Log("msg", "resource limits updated", "limits", name, "container id", i.Container.ID)
+}
+
+// cleanup removes the cgroup once the monitoring is over, whatever the
+// reason. The processes left are moved back to their original cgroups first,
+// so that none is stranded in a cgroup being removed.
+func (i *Instance) cleanup(logger log.Logger) {
+	if i.unwatch != nil {
+		i.unwatch()
+	}
+	if i.applied {
+		if err := i.CGroup.Release(); err != nil {
+			level.Error(logger).Log("msg", "while moving the processes out of the cgroup", "err", err, "container id", i.Container.ID)
 		}
-		data := buffer.Bytes()
+		if err := i.Destroy(); err != nil {
+			level.Error(logger).Log("msg", "while removing the cgroup", "err", err, "container id", i.Container.ID)
+		}
+	}
+	i.closePidfd()
+	if i.onExit != nil {
+		i.onExit()
+	}
+	close(i.exited)
+}
 
-		// send request to pushgate
-		err = push.Push(ms, data, labels)
-		if err != nil {
-			level.Error(logger).Log("msg", "while pushing data to pushgateway", "err", err, "container id", container.ID)
-			i.ErrCh <- err
-			return
+// sample marshals the cgroup stats and pushes them to the metric store.
+func (i *Instance) sample(ms storage.MetricStore) error {
+	values, err := i.Sample()
+	if err != nil {
+		return fmt.Errorf("while marshaling the stat info: %w", err)
+	}
+
+	if i.scheduler != nil {
+		i.effective = i.scheduler.intervalOf(i, changedQuickly(i.previous, values))
+	}
+	i.previous = values
+
+	for k, v := range i.limits {
+		values[k] = v
+	}
+	if i.effective > 0 {
+		values[IntervalMetric] = i.effective.Seconds()
+	}
+	if frozen, err := i.Frozen(); err == nil {
+		values[FrozenMetric] = boolToFloat(frozen)
+	}
+
+	i.buffer.Reset()
+	for k, v := range values {
+		fmt.Fprintf(&i.buffer, "%s %f\n", k, v)
+	}
+	// send request to pushgate
+	if err := push.Push(ms, i.buffer.Bytes(), i.pushed); err != nil {
+		return fmt.Errorf("while pushing data to pushgateway: %w", err)
+	}
+	if i.history != nil {
+		i.history.Add(time.Now(), values)
+	}
+	return nil
+}
+
+// finalize takes a final sample, the processes left are moved out of the
+// cgroup by cleanup.
+func (i *Instance) finalize(ms storage.MetricStore, logger log.Logger) {
+	if err := i.sample(ms); err != nil {
+		level.Error(logger).Log("msg", "while taking the final sample", "err", err, "container id", i.Container.ID)
+	}
+	level.Info(logger).Log("msg", "monitoring released", "container id", i.Container.ID)
+	i.Done <- struct{}{}
+}
+
+// ownerGone returns why the owner of the container is considered gone, or an
+// empty string if it is not.
+func (i *Instance) ownerGone() string {
+	owner := i.Container.Owner
+	// the owner may have died while its children still hold its connection
+	if owner.Pid != 0 && uint64(owner.Pid) != i.Container.Pid {
+		stat, err := proc.StatOf(int(owner.Pid))
+		if err != nil || stat.StartTime != owner.StartTime {
+			return "owner exited"
+		}
+	}
+
+	if timeout := i.Container.HeartbeatTimeout; timeout > 0 {
+		i.mu.Lock()
+		last := i.lastHeartbeat
+		i.mu.Unlock()
+		if time.Since(last) > timeout {
+			return "no heartbeat received for " + timeout.String()
+		}
+	}
+	return ""
+}
+
+// verify checks that the container process referred by the pidfd is still
+// alive, hence that its pid has not been reused.
+func (i *Instance) verify() error {
+	if i.pidfd < 0 {
+		return nil
+	}
+	return proc.PidfdAlive(i.pidfd)
+}
+
+// processRunning reports whether the container process is still running by
+// polling its pidfd. Without pidfd support, it always reports false so that
+// the cgroup content is checked instead.
+func (i *Instance) processRunning() (bool, error) {
+	if i.pidfd < 0 {
+		return false, nil
+	}
+	exited, err := proc.PidfdExited(i.pidfd)
+	return !exited, err
+}
+
+func (i *Instance) closePidfd() {
+	if i.pidfd >= 0 {
+		unix.Close(i.pidfd)
+		i.pidfd = -1
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func equalLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
 		}
 	}
+	return true
 }
@@ -0,0 +1,57 @@
+package monitor
+
+import (
+	"testing"
+
+	"github.com/apptainer/apptheus/internal/cgroup"
+	"github.com/apptainer/apptheus/internal/cgroup/parser"
+	"github.com/go-kit/log"
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+	"github.com/opencontainers/runc/libcontainer/configs"
+	"github.com/stretchr/testify/require"
+)
+
+// limitsManager records the resources set on a cgroup.
+type limitsManager struct {
+	cgroups.Manager
+	set []*configs.Resources
+}
+
+func (m *limitsManager) Set(r *configs.Resources) error {
+	m.set = append(m.set, r)
+	return nil
+}
+
+func TestUpdateLimits(t *testing.T) {
+	gpu := &configs.Resources{Memory: 8 << 30, PidsLimit: 100}
+	i := New(&parser.ContainerInfo{ID: "test", Limits: "gpu", Resources: gpu}, -1)
+	mgr := &limitsManager{}
+	i.CGroup = &cgroup.CGroup{Manager: mgr}
+	i.resources = gpu
+	i.limits = cgroup.LimitStats(gpu)
+	logger := log.NewNopLogger()
+
+	// the same limits still apply
+	i.SetLimits("gpu", gpu)
+	i.updateLimits(logger)
+	require.Empty(t, mgr.set)
+
+	cpu := &configs.Resources{Memory: 1 << 30}
+	i.SetLimits("cpu", cpu)
+	require.Equal(t, "cpu", i.Limits())
+	i.updateLimits(logger)
+	require.Equal(t, []*configs.Resources{{Memory: 1 << 30, PidsLimit: -1}}, mgr.set)
+	require.Equal(t, map[string]float64{"limit_memory_max_bytes": 1 << 30}, i.limits)
+
+	// no limits apply anymore
+	i.SetLimits("", nil)
+	i.updateLimits(logger)
+	require.Len(t, mgr.set, 2)
+	require.Equal(t, &configs.Resources{Memory: -1}, mgr.set[1])
+	require.Empty(t, i.limits)
+
+	// the cgroups monitored in place are never modified
+	inPlace := New(&parser.ContainerInfo{ID: "in-place", CgroupPath: "/user.slice/scope"}, -1)
+	inPlace.SetLimits("cpu", cpu)
+	require.Empty(t, inPlace.Limits())
+}
@@ -0,0 +1,151 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package monitor
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/cgroup"
+	"github.com/apptainer/apptheus/internal/cgroup/parser"
+)
+
+var ErrRegistered = errors.New("container is already registered")
+
+// Registry keeps track of the monitored containers. All its methods are safe
+// to be called concurrently.
+type Registry struct {
+	mu        sync.RWMutex
+	instances map[string]*Instance
+
+	scheduler *Scheduler
+}
+
+// NewRegistry returns a registry whose containers are sampled by scheduler.
+func NewRegistry(scheduler *Scheduler) *Registry {
+	return &Registry{
+		instances: make(map[string]*Instance),
+		scheduler: scheduler,
+	}
+}
+
+// Register starts monitoring the container, taking ownership of pidfd. The
+// container is tracked until its monitoring is over.
+func (r *Registry) Register(container *parser.ContainerInfo, pidfd int) (*Instance, error) {
+	return r.register(New(container, pidfd))
+}
+
+// Resume resumes monitoring a container whose processes are already in its
+// cgroup, e.g. after a restart of apptheus, taking ownership of pidfd, which
+// is -1 if the container process is gone.
+func (r *Registry) Resume(container *parser.ContainerInfo, pidfd int) (*Instance, error) {
+	instance := New(container, pidfd)
+	instance.resumed = true
+	instance.running = pidfd >= 0
+	return r.register(instance)
+}
+
+func (r *Registry) register(instance *Instance) (*Instance, error) {
+	container := instance.Container
+	instance.Started = time.Now()
+	if config := r.scheduler.config; config.History > 0 {
+		instance.history = NewHistory(config.History, config.HistorySamples)
+	}
+	instance.onExit = func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.instances[container.ID] == instance {
+			delete(r.instances, container.ID)
+		}
+	}
+
+	r.mu.Lock()
+	if _, ok := r.instances[container.ID]; ok {
+		r.mu.Unlock()
+		instance.closePidfd()
+		return nil, ErrRegistered
+	}
+	r.instances[container.ID] = instance
+	r.mu.Unlock()
+
+	r.scheduler.Add(instance)
+	return instance, nil
+}
+
+// Get returns the instance monitoring the container with the given id.
+func (r *Registry) Get(id string) (*Instance, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	instance, ok := r.instances[id]
+	return instance, ok
+}
+
+// List returns the instances for which filter returns true, sorted by
+// container id. A nil filter returns all of them.
+func (r *Registry) List(filter func(*Instance) bool) []*Instance {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	instances := make([]*Instance, 0, len(r.instances))
+	for _, instance := range r.instances {
+		if filter == nil || filter(instance) {
+			instances = append(instances, instance)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Container.ID < instances[j].Container.ID
+	})
+	return instances
+}
+
+// OwnedBy returns a filter for List keeping the containers registered by the
+// given process.
+func OwnedBy(pid int32, startTime uint64) func(*Instance) bool {
+	return func(i *Instance) bool {
+		return i.Container.Owner.Pid == pid && i.Container.Owner.StartTime == startTime
+	}
+}
+
+// ContainerOf returns the instance monitoring the container the process
+// belongs to, either in a cgroup created for it or in place.
+func (r *Registry) ContainerOf(pid int) (*Instance, bool, error) {
+	id, err := cgroup.ContainerOf(pid)
+	if err != nil {
+		return nil, false, err
+	}
+	if id != "" {
+		instance, ok := r.Get(id)
+		return instance, ok, nil
+	}
+
+	r.mu.RLock()
+	inPlace := false
+	for _, instance := range r.instances {
+		if instance.Container.CgroupPath != "" {
+			inPlace = true
+			break
+		}
+	}
+	r.mu.RUnlock()
+	if !inPlace {
+		return nil, false, nil
+	}
+
+	path, err := cgroup.UnifiedPathOf(pid)
+	if err != nil {
+		return nil, false, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, instance := range r.instances {
+		cgroupPath := instance.Container.CgroupPath
+		if cgroupPath != "" && (path == cgroupPath || strings.HasPrefix(path, cgroupPath+"/")) {
+			return instance, true, nil
+		}
+	}
+	return nil, false, nil
+}
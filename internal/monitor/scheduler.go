@@ -0,0 +1,333 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package monitor
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/cgroup"
+	"github.com/apptainer/apptheus/internal/cgroup/parser"
+	"github.com/apptainer/apptheus/internal/storage"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// Scheduler owns the timing of the monitoring. The instances are kept in a
+// queue ordered by their next sample, a single dispatcher hands the due ones
+// over to a fixed pool of workers, so that thousands of containers do not
+// need a goroutine and a ticker each.
+type Scheduler struct {
+	config SchedulerConfig
+
+	ms     storage.MetricStore
+	logger log.Logger
+	// events reports the containers exiting between samples, nil if cgroup
+	// events are not available
+	events *cgroup.EventWatcher
+
+	mu    sync.Mutex
+	queue queue
+	// active counts the queued instances and the ones being sampled
+	active int
+	rand   *rand.Rand
+
+	wakeCh   chan struct{}
+	work     chan *Instance
+	quit     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// SchedulerConfig sets how often the containers are sampled, unless they have
+// their own interval.
+type SchedulerConfig struct {
+	// Interval is the sampling interval without adaptive sampling.
+	Interval time.Duration
+	// Jitter is the fraction of the interval by which each sample is
+	// randomly advanced or delayed, spreading the samples of the containers
+	// registered together. It is at most MaxJitter.
+	Jitter float64
+	// Workers is the number of instances sampled concurrently.
+	Workers int
+
+	// Adaptive samples the containers every MinInterval during their first
+	// Warmup and whenever their usage changes quickly, backing off up to
+	// MaxInterval while it is steady.
+	Adaptive    bool
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	Warmup      time.Duration
+
+	// History is how long the recent samples of every container are kept
+	// for the history API, zero disables it. Up to HistorySamples samples
+	// are kept, evenly spread over it.
+	History        time.Duration
+	HistorySamples int
+}
+
+// MaxJitter is the largest jitter fraction, so that two samples of a container
+// are never less than half its interval apart.
+const MaxJitter = 0.5
+
+// adaptive sampling thresholds, a change of the CPU usage by 10 percentage
+// points or of the memory usage by 10% is considered quick
+const (
+	cpuChange    = 10
+	memoryChange = 0.1
+)
+
+// NewScheduler starts a scheduler sampling the instances as set by config,
+// with a pool of workers.
+func NewScheduler(config SchedulerConfig, ms storage.MetricStore, logger log.Logger) *Scheduler {
+	if config.Workers < 1 {
+		config.Workers = 1
+	}
+	if config.Jitter < 0 {
+		config.Jitter = 0
+	} else if config.Jitter > MaxJitter {
+		config.Jitter = MaxJitter
+	}
+	if config.Adaptive {
+		if config.MinInterval <= 0 {
+			config.MinInterval = config.Interval
+		}
+		if config.MaxInterval < config.MinInterval {
+			config.MaxInterval = config.MinInterval
+		}
+	}
+
+	s := &Scheduler{
+		config: config,
+		ms:     ms,
+		logger: logger,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		wakeCh: make(chan struct{}, 1),
+		work:   make(chan *Instance),
+		quit:   make(chan struct{}),
+	}
+
+	events, err := cgroup.NewEventWatcher()
+	switch {
+	case errors.Is(err, cgroup.ErrNoEvents):
+		level.Warn(logger).Log("msg", "cgroup v1 hierarchy, falling back to polling the cgroups: the containers exit is only detected at each sample")
+	case err != nil:
+		level.Warn(logger).Log("msg", "cgroup events are not available, falling back to polling the cgroups: the containers exit is only detected at each sample", "err", err)
+	default:
+		s.events = events
+	}
+
+	s.wg.Add(config.Workers + 1)
+	for n := 0; n < config.Workers; n++ {
+		go s.worker()
+	}
+	go s.dispatch()
+	return s
+}
+
+// Add schedules the instance right away: its first step moves the container
+// process into its cgroup.
+func (s *Scheduler) Add(i *Instance) {
+	s.mu.Lock()
+	i.scheduler = s
+	i.due = time.Now()
+	heap.Push(&s.queue, i)
+	s.active++
+	s.mu.Unlock()
+	s.notify()
+}
+
+// Stop stops the scheduler once the steps being run are over. The instances
+// still queued are not sampled anymore.
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.quit)
+	})
+	s.wg.Wait()
+	if s.events != nil {
+		s.events.Close()
+	}
+}
+
+// Len returns the number of instances handled by the scheduler.
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.active
+}
+
+// wake moves the instance at the head of the queue, or makes sure it is
+// rescheduled right away if it is being sampled.
+func (s *Scheduler) wake(i *Instance) {
+	s.mu.Lock()
+	switch {
+	case i.busy:
+		i.woken = true
+	case i.index >= 0:
+		i.due = time.Now()
+		heap.Fix(&s.queue, i.index)
+	}
+	s.mu.Unlock()
+	s.notify()
+}
+
+// notify interrupts the wait of the dispatcher.
+func (s *Scheduler) notify() {
+	select {
+	case s.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch hands the due instances over to the workers, and waits for the
+// next one to be due otherwise.
+func (s *Scheduler) dispatch() {
+	defer s.wg.Done()
+	defer close(s.work)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		var next *Instance
+		wait := time.Hour
+		if len(s.queue) > 0 {
+			head := s.queue[0]
+			if d := time.Until(head.due); d > 0 {
+				wait = d
+			} else {
+				next = heap.Pop(&s.queue).(*Instance)
+				next.busy = true
+			}
+		}
+		s.mu.Unlock()
+
+		if next != nil {
+			select {
+			case s.work <- next:
+				continue
+			case <-s.quit:
+				return
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-s.wakeCh:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *Scheduler) worker() {
+	defer s.wg.Done()
+
+	for i := range s.work {
+		if i.tick(s.ms, s.logger) {
+			s.mu.Lock()
+			i.busy = false
+			s.active--
+			s.mu.Unlock()
+			i.cleanup(s.logger)
+			continue
+		}
+
+		s.mu.Lock()
+		i.busy = false
+		if i.woken {
+			i.woken = false
+			i.due = time.Now()
+		} else {
+			i.due = time.Now().Add(s.jittered(i.effective))
+		}
+		heap.Push(&s.queue, i)
+		s.mu.Unlock()
+		s.notify()
+	}
+}
+
+// intervalOf returns the interval until the next sample of the instance,
+// changed reporting whether its usage changed quickly since the previous one.
+func (s *Scheduler) intervalOf(i *Instance, changed bool) time.Duration {
+	if interval := i.Interval(); interval > 0 {
+		return interval
+	}
+	if !s.config.Adaptive {
+		return s.config.Interval
+	}
+	if changed || i.effective == 0 || time.Since(i.Started) < s.config.Warmup {
+		return s.config.MinInterval
+	}
+	// back off while the usage is steady
+	return min(2*i.effective, s.config.MaxInterval)
+}
+
+// changedQuickly reports whether the usage of a container changed quickly
+// between two samples.
+func changedQuickly(prev, cur map[string]float64) bool {
+	if prev == nil {
+		return false
+	}
+	if math.Abs(cur[parser.CPUUsagePercent]-prev[parser.CPUUsagePercent]) >= cpuChange {
+		return true
+	}
+	before, after := prev[parser.MemoryUsage], cur[parser.MemoryUsage]
+	return before > 0 && math.Abs(after-before)/before >= memoryChange
+}
+
+// jittered returns the interval randomly shortened or lengthened by up to the
+// jitter fraction of it, s.mu must be held.
+func (s *Scheduler) jittered(interval time.Duration) time.Duration {
+	if interval <= 0 {
+		interval = s.config.Interval
+	}
+	if s.config.Jitter == 0 {
+		return interval
+	}
+	delta := (s.rand.Float64()*2 - 1) * s.config.Jitter * float64(interval)
+	return interval + time.Duration(delta)
+}
+
+// queue is a heap of instances ordered by their next sample.
+type queue []*Instance
+
+func (q queue) Len() int { return len(q) }
+
+func (q queue) Less(a, b int) bool { return q[a].due.Before(q[b].due) }
+
+func (q queue) Swap(a, b int) {
+	q[a], q[b] = q[b], q[a]
+	q[a].index = a
+	q[b].index = b
+}
+
+func (q *queue) Push(x any) {
+	i := x.(*Instance)
+	i.index = len(*q)
+	*q = append(*q, i)
+}
+
+func (q *queue) Pop() any {
+	old := *q
+	n := len(old)
+	i := old[n-1]
+	old[n-1] = nil
+	i.index = -1
+	*q = old[:n-1]
+	return i
+}
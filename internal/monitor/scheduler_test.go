@@ -0,0 +1,177 @@
+package monitor
+
+import (
+	"container/heap"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/cgroup"
+	"github.com/apptainer/apptheus/internal/cgroup/parser"
+	"github.com/go-kit/log"
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedulerJitter(t *testing.T) {
+	s := &Scheduler{
+		config: SchedulerConfig{Interval: time.Second, Jitter: 0.1},
+		rand:   rand.New(rand.NewSource(1)),
+	}
+
+	for n := 0; n < 1000; n++ {
+		d := s.jittered(0)
+		require.GreaterOrEqual(t, d, 900*time.Millisecond)
+		require.LessOrEqual(t, d, 1100*time.Millisecond)
+
+		d = s.jittered(10 * time.Second)
+		require.GreaterOrEqual(t, d, 9*time.Second)
+		require.LessOrEqual(t, d, 11*time.Second)
+	}
+
+	s.config.Jitter = 0
+	require.Equal(t, time.Second, s.jittered(0))
+
+	// the samples are at least half the interval apart
+	s = NewScheduler(SchedulerConfig{Interval: time.Second, Jitter: 1}, nil, log.NewNopLogger())
+	defer s.Stop()
+	require.Equal(t, MaxJitter, s.config.Jitter)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for n := 0; n < 1000; n++ {
+		require.GreaterOrEqual(t, s.jittered(0), 500*time.Millisecond)
+	}
+}
+
+func TestSchedulerAdaptive(t *testing.T) {
+	s := &Scheduler{config: SchedulerConfig{
+		Interval:    time.Second,
+		Adaptive:    true,
+		MinInterval: time.Second,
+		MaxInterval: 8 * time.Second,
+		Warmup:      time.Minute,
+	}}
+
+	i := New(&parser.ContainerInfo{ID: "test"}, -1)
+	i.Started = time.Now()
+
+	// sampled fast during the warmup
+	i.effective = s.intervalOf(i, false)
+	require.Equal(t, time.Second, i.effective)
+	i.effective = s.intervalOf(i, false)
+	require.Equal(t, time.Second, i.effective)
+
+	// then backing off while steady
+	i.Started = time.Now().Add(-time.Hour)
+	for _, expected := range []time.Duration{2, 4, 8, 8} {
+		i.effective = s.intervalOf(i, false)
+		require.Equal(t, expected*time.Second, i.effective)
+	}
+
+	// until the usage changes
+	i.effective = s.intervalOf(i, true)
+	require.Equal(t, time.Second, i.effective)
+
+	// a container interval is never adapted
+	i.SetInterval(5 * time.Second)
+	require.Equal(t, 5*time.Second, s.intervalOf(i, true))
+
+	s.config.Adaptive = false
+	i.SetInterval(0)
+	require.Equal(t, time.Second, s.intervalOf(i, false))
+}
+
+func TestChangedQuickly(t *testing.T) {
+	prev := map[string]float64{parser.CPUUsagePercent: 50, parser.MemoryUsage: 1000}
+
+	require.False(t, changedQuickly(nil, prev))
+	require.False(t, changedQuickly(prev, map[string]float64{parser.CPUUsagePercent: 55, parser.MemoryUsage: 1050}))
+	require.True(t, changedQuickly(prev, map[string]float64{parser.CPUUsagePercent: 80, parser.MemoryUsage: 1000}))
+	require.True(t, changedQuickly(prev, map[string]float64{parser.CPUUsagePercent: 50, parser.MemoryUsage: 500}))
+}
+
+// busyManager reports a cgroup using a share of a CPU.
+type busyManager struct {
+	cgroups.Manager
+	last  time.Time
+	usage uint64
+	// permille is the share of a CPU used, in thousandths.
+	permille int64
+}
+
+func (m *busyManager) GetStats() (*cgroups.Stats, error) {
+	now := time.Now()
+	m.usage += uint64(now.Sub(m.last).Nanoseconds() * m.permille / 1000)
+	m.last = now
+
+	stats := cgroups.NewStats()
+	stats.CpuStats.CpuUsage.TotalUsage = m.usage
+	return stats, nil
+}
+
+func TestSchedulerAdaptiveSamples(t *testing.T) {
+	s := &Scheduler{config: SchedulerConfig{
+		Interval:    time.Second,
+		Adaptive:    true,
+		MinInterval: time.Second,
+		MaxInterval: 8 * time.Second,
+	}}
+
+	mgr := &busyManager{last: time.Now().Add(-time.Hour), permille: 500}
+	i := New(&parser.ContainerInfo{ID: "test"}, -1)
+	i.CGroup = &cgroup.CGroup{Manager: mgr}
+	i.Started = time.Now().Add(-time.Hour)
+
+	sample := func() bool {
+		time.Sleep(20 * time.Millisecond)
+		values, err := i.Sample()
+		require.NoError(t, err)
+		changed := changedQuickly(i.previous, values)
+		i.effective = s.intervalOf(i, changed)
+		i.previous = values
+		return changed
+	}
+
+	// the CPU usage is known from the second sample on
+	sample()
+	sample()
+	require.InDelta(t, 50, i.previous["cpu_usage_per"], 10)
+
+	// steady, the interval backs off
+	for _, expected := range []time.Duration{2, 4, 8} {
+		require.False(t, sample())
+		require.Equal(t, expected*time.Second, i.effective)
+	}
+
+	// busier, back to the minimum interval
+	mgr.permille = 1000
+	require.True(t, sample())
+	require.Equal(t, time.Second, i.effective)
+}
+
+func TestSchedulerWake(t *testing.T) {
+	s := &Scheduler{wakeCh: make(chan struct{}, 1)}
+	now := time.Now()
+
+	instances := make([]*Instance, 3)
+	for n := range instances {
+		instances[n] = New(&parser.ContainerInfo{ID: string(rune('a' + n))}, -1)
+		instances[n].scheduler = s
+		instances[n].due = now.Add(time.Duration(n+1) * time.Minute)
+		heap.Push(&s.queue, instances[n])
+	}
+	require.Equal(t, instances[0], s.queue[0])
+
+	// stopping an instance moves it at the head of the queue
+	instances[2].Stop()
+	require.Equal(t, instances[2], s.queue[0])
+	require.Len(t, s.wakeCh, 1)
+
+	// an instance being sampled is rescheduled right away
+	popped := heap.Pop(&s.queue).(*Instance)
+	require.Equal(t, -1, popped.index)
+	popped.busy = true
+	popped.Release()
+	require.True(t, popped.woken)
+	require.Len(t, s.queue, 2)
+}
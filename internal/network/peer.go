@@ -0,0 +1,238 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/monitor"
+	"github.com/apptainer/apptheus/internal/policy"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// DoneMessage can be sent by a client holding its connection open instead of
+// closing it, to tell that its containers are done. It is only recognised as
+// the first bytes sent on the connection, or once the HTTP server gave up on
+// the connection.
+const DoneMessage = "done\n"
+
+type peerKey struct{}
+
+type connKey struct{}
+
+// Peer is the verified identity of the process on the other end of a
+// connection to the verification socket.
+type Peer struct {
+	Pid       int32
+	UID       uint32
+	GID       uint32
+	StartTime uint64
+	Exe       string
+	// Trusted is false for the processes of monitored containers, which are
+	// only allowed to push their application metrics.
+	Trusted bool
+	// Rule is the policy rule which accepted the peer.
+	Rule string
+	// Labels are added to the containers registered by the peer.
+	Labels map[string]string
+	// OnDisconnect, HeartbeatTimeout and Interval are the settings of the
+	// policy rule applied to the containers registered by the peer.
+	OnDisconnect     policy.OnDisconnect
+	HeartbeatTimeout time.Duration
+	Interval         time.Duration
+}
+
+// PeerConn is a connection accepted by WrappedListener, carrying the
+// verified identity of its peer.
+//
+// The containers registered through the connection are held by it: once the
+// client closes the connection, or sends DoneMessage, they are notified. As
+// the HTTP server closes the connections of silent clients, closing a
+// connection which still holds containers hands it over to a watcher instead.
+type PeerConn struct {
+	net.Conn
+	Peer *Peer
+
+	logger log.Logger
+
+	mu       sync.Mutex
+	held     []*monitor.Instance
+	read     bool
+	gone     bool
+	watching bool
+}
+
+// Hold ties the monitoring of instance to the connection.
+func (c *PeerConn) Hold(instance *monitor.Instance) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.held = append(c.held, instance)
+}
+
+func (c *PeerConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+
+	c.mu.Lock()
+	first := !c.read
+	c.read = true
+	c.mu.Unlock()
+
+	if first && n > 0 && isDone(p[:n]) {
+		c.disconnect(true)
+		return 0, io.EOF
+	}
+	if isDisconnect(err) {
+		c.disconnect(false)
+	}
+	return n, err
+}
+
+// Close closes the connection, unless it still holds running containers, in
+// which case it is watched until the client is gone.
+func (c *PeerConn) Close() error {
+	c.mu.Lock()
+	if c.gone || c.watching || !c.holding() {
+		watching := c.watching
+		c.mu.Unlock()
+		if watching {
+			return nil
+		}
+		return c.Conn.Close()
+	}
+	c.watching = true
+	c.mu.Unlock()
+
+	go c.watch()
+	return nil
+}
+
+// watch reads the connection until the client closes it, sends DoneMessage,
+// or until all the held containers exited.
+func (c *PeerConn) watch() {
+	defer c.Conn.Close()
+
+	if err := c.Conn.SetReadDeadline(time.Time{}); err != nil {
+		return
+	}
+
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		c.mu.Lock()
+		held := append([]*monitor.Instance{}, c.held...)
+		c.mu.Unlock()
+		for _, instance := range held {
+			select {
+			case <-instance.Exited():
+			case <-exited:
+				return
+			}
+		}
+		// interrupt the pending read
+		c.Conn.SetReadDeadline(time.Now())
+	}()
+
+	buf := make([]byte, 512)
+	for {
+		n, err := c.Conn.Read(buf)
+		if n > 0 && isDone(buf[:n]) {
+			c.disconnect(true)
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				c.disconnect(false)
+			}
+			return
+		}
+	}
+}
+
+// disconnect notifies the held containers that the client is gone. An
+// explicit done releases them, whatever the policy.
+func (c *PeerConn) disconnect(done bool) {
+	c.mu.Lock()
+	if c.gone {
+		c.mu.Unlock()
+		return
+	}
+	c.gone = true
+	held := c.held
+	c.mu.Unlock()
+
+	logger := c.logger
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	for _, instance := range held {
+		select {
+		case <-instance.Exited():
+			continue
+		default:
+		}
+
+		id := instance.Container.ID
+		switch {
+		case done:
+			level.Info(logger).Log("msg", "Client is done with the container, releasing it", "container id", id)
+			instance.Release()
+		case instance.Disconnected():
+			level.Info(logger).Log("msg", "Client disconnected, releasing the container", "container id", id)
+		default:
+			level.Info(logger).Log("msg", "Client disconnected, monitoring the container until it exits", "container id", id)
+		}
+	}
+}
+
+// holding reports whether some held containers are still monitored, c.mu
+// must be held.
+func (c *PeerConn) holding() bool {
+	for _, instance := range c.held {
+		select {
+		case <-instance.Exited():
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+func isDone(data []byte) bool {
+	return bytes.Equal(bytes.TrimSpace(data), bytes.TrimSpace([]byte(DoneMessage)))
+}
+
+func isDisconnect(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// ConnContext is meant to be used as http.Server.ConnContext, so that the
+// handlers can retrieve the peer of a request with PeerFromContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if pc, ok := c.(*PeerConn); ok {
+		ctx = context.WithValue(ctx, connKey{}, pc)
+		return context.WithValue(ctx, peerKey{}, pc.Peer)
+	}
+	return ctx
+}
+
+// PeerFromContext returns the verified peer of the request, if any.
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	peer, ok := ctx.Value(peerKey{}).(*Peer)
+	return peer, ok
+}
+
+// ConnFromContext returns the connection the request has been received on.
+func ConnFromContext(ctx context.Context) (*PeerConn, bool) {
+	conn, ok := ctx.Value(connKey{}).(*PeerConn)
+	return conn, ok
+}
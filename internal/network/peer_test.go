@@ -0,0 +1,56 @@
+package network_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/cgroup/parser"
+	"github.com/apptainer/apptheus/internal/monitor"
+	"github.com/apptainer/apptheus/internal/network"
+	"github.com/stretchr/testify/require"
+)
+
+func newHeldConn(t *testing.T) (*network.PeerConn, net.Conn) {
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	conn := &network.PeerConn{Conn: server, Peer: &network.Peer{Pid: 42}}
+	conn.Hold(monitor.New(&parser.ContainerInfo{ID: "test"}, -1))
+	return conn, client
+}
+
+func TestPeerConnDone(t *testing.T) {
+	conn, client := newHeldConn(t)
+
+	go client.Write([]byte(network.DoneMessage))
+
+	// the HTTP server sees the end of the connection
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	require.Zero(t, n)
+	require.ErrorIs(t, err, io.EOF)
+
+	// the client is gone, the connection is closed right away
+	require.NoError(t, conn.Close())
+	_, err = client.Write([]byte("x"))
+	require.Error(t, err)
+}
+
+func TestPeerConnWatch(t *testing.T) {
+	conn, client := newHeldConn(t)
+
+	// the HTTP server gives up on a silent client, the connection is kept
+	require.NoError(t, conn.Close())
+	_, err := client.Write([]byte("still there\n"))
+	require.NoError(t, err)
+
+	// until the client is done
+	_, err = client.Write([]byte(network.DoneMessage))
+	require.NoError(t, err)
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = client.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,181 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/apptainer/apptheus/internal/proc"
+	"golang.org/x/sys/unix"
+)
+
+// process is a process anchored by a pidfd, along with what has been read
+// about it from /proc/<pid>.
+type process struct {
+	// pidfd is -1 if the host kernel does not support pidfd_open.
+	pidfd  int
+	exe    string
+	digest string
+	stat   *proc.Stat
+}
+
+// openProcess opens a pidfd on the process, reads /proc/<pid>, then checks
+// that the process is still alive through the pidfd and that /proc/<pid> still
+// has the start time read, otherwise what has been read might belong to
+// another process reusing the pid. A pidfd does not prevent the pid from being
+// reused, it only keeps referring to the process it was opened on, which is
+// why the checks come after the reads. Without pidfd support, the start time
+// is the only check. The digest of the executable is only computed if
+// withDigest is true.
+func openProcess(pid int, withDigest bool) (*process, error) {
+	p := &process{pidfd: -1}
+
+	pidfd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return p, err
+		}
+	} else {
+		p.pidfd = pidfd
+	}
+
+	dirfd, err := unix.Open(fmt.Sprintf("/proc/%d", pid), unix.O_DIRECTORY, 0)
+	if err != nil {
+		p.close()
+		return p, err
+	}
+	defer unix.Close(dirfd)
+
+	buf := make([]byte, 4096)
+	n, err := unix.Readlinkat(dirfd, "exe", buf)
+	if err != nil {
+		p.close()
+		return p, err
+	}
+	p.exe = string(buf[:n])
+
+	p.stat, err = proc.ReadStat(dirfd)
+	if err != nil {
+		p.close()
+		return p, err
+	}
+
+	if withDigest {
+		// a missing digest should not prevent the verification, the executable
+		// is only hashed if it changed since a former caller
+		p.digest, _ = digest(dirfd)
+	}
+
+	if p.pidfd >= 0 {
+		if err = proc.PidfdAlive(p.pidfd); err != nil {
+			p.close()
+			return p, err
+		}
+	}
+	if err := sameStartTime(pid, p.stat.StartTime); err != nil {
+		p.close()
+		return p, err
+	}
+
+	return p, nil
+}
+
+// sameStartTime returns proc.ErrExited if the process now holding pid did not
+// start at startTime.
+func sameStartTime(pid int, startTime uint64) error {
+	stat, err := proc.StatOf(pid)
+	if errors.Is(err, os.ErrNotExist) {
+		return proc.ErrExited
+	} else if err != nil {
+		return err
+	}
+	if stat.StartTime != startTime {
+		return proc.ErrExited
+	}
+	return nil
+}
+
+// close releases the pidfd, unless its ownership has been handed over.
+func (p *process) close() {
+	if p.pidfd >= 0 {
+		unix.Close(p.pidfd)
+		p.pidfd = -1
+	}
+}
+
+// digest returns the hex encoded sha256 of the executable of the process
+// referred by the /proc/<pid> directory fd.
+func digest(dirfd int) (string, error) {
+	fd, err := unix.Openat(dirfd, "exe", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return "", err
+	}
+	f := os.NewFile(uintptr(fd), "exe")
+	defer f.Close()
+	return digests.of(f)
+}
+
+// digestCacheSize is the number of executables whose digest is kept, the
+// cache being emptied when it is full.
+const digestCacheSize = 256
+
+// fileVersion identifies the content of a file, as long as it is not
+// modified in place while its times are restored, which only root can do for
+// the change time.
+type fileVersion struct {
+	dev, ino     uint64
+	size         int64
+	mtime, ctime unix.Timespec
+}
+
+// digestCache keeps the digests of the executables, so that the callers are
+// not hashed at every connection, which is done while accepting them.
+type digestCache struct {
+	mu      sync.Mutex
+	digests map[fileVersion]string
+}
+
+var digests = &digestCache{digests: make(map[fileVersion]string)}
+
+// of returns the hex encoded sha256 of f, only reading it if the file changed
+// since it was last hashed.
+func (c *digestCache) of(f *os.File) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(f.Fd()), &st); err != nil {
+		return "", err
+	}
+	version := fileVersion{
+		dev:   st.Dev,
+		ino:   st.Ino,
+		size:  st.Size,
+		mtime: st.Mtim,
+		ctime: st.Ctim,
+	}
+
+	c.mu.Lock()
+	d, ok := c.digests[version]
+	c.mu.Unlock()
+	if ok {
+		return d, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	d = hex.EncodeToString(h.Sum(nil))
+
+	c.mu.Lock()
+	if len(c.digests) >= digestCacheSize {
+		clear(c.digests)
+	}
+	c.digests[version] = d
+	c.mu.Unlock()
+	return d, nil
+}
@@ -0,0 +1,54 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/proc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenProcess(t *testing.T) {
+	p, err := openProcess(os.Getpid(), false)
+	require.NoError(t, err)
+	t.Cleanup(p.close)
+	require.Equal(t, os.Getpid(), p.stat.Pid)
+
+	// the pid now held by another process
+	require.NoError(t, sameStartTime(os.Getpid(), p.stat.StartTime))
+	require.ErrorIs(t, sameStartTime(os.Getpid(), p.stat.StartTime+1), proc.ErrExited)
+}
+
+func TestDigestCache(t *testing.T) {
+	c := &digestCache{digests: make(map[fileVersion]string)}
+	path := filepath.Join(t.TempDir(), "exe")
+	digestOf := func() string {
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		defer f.Close()
+		d, err := c.of(f)
+		require.NoError(t, err)
+		return d
+	}
+	sum := func(data string) string {
+		h := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(h[:])
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte("first"), 0o600))
+	require.Equal(t, sum("first"), digestOf())
+	require.Equal(t, sum("first"), digestOf())
+	require.Len(t, c.digests, 1)
+
+	// the file rewritten with the same size and times is hashed again
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, []byte("other"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Time{}, info.ModTime()))
+	require.Equal(t, sum("other"), digestOf())
+	require.Len(t, c.digests, 2)
+}
@@ -0,0 +1,198 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package network
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/apptainer/apptheus/internal/cgroup"
+	"github.com/apptainer/apptheus/internal/cgroup/parser"
+	"github.com/apptainer/apptheus/internal/proc"
+	"github.com/go-kit/log/level"
+)
+
+// Resume resumes monitoring the containers left in the cgroup root by a
+// previous run of apptheus, and removes the empty cgroups. With the in-place
+// mode, the containers of the persisted metrics still running in a cgroup of
+// their own are also resumed. Their owner process is unknown, so that they can
+// only be managed through the admin API until their processes exit. It
+// returns the number of resumed containers.
+func Resume(option *ServerOption) (int, error) {
+	paths, err := cgroup.Existing()
+	if err != nil {
+		return 0, err
+	}
+
+	// the grouping labels of the containers are recovered from their
+	// persisted metrics, if any
+	persisted := make(map[string]map[string]string)
+	if option.MetricStore != nil {
+		for _, group := range option.MetricStore.GetMetricFamiliesMap() {
+			if job := group.Labels["job"]; job != "" {
+				persisted[job] = group.Labels
+			}
+		}
+	}
+
+	resumed := 0
+	for _, path := range paths {
+		id := filepath.Base(path)
+		c, err := cgroup.NewCGroup(path)
+		if err != nil {
+			level.Error(option.Logger).Log("msg", "Could not open a leftover cgroup", "container id", id, "err", err)
+			continue
+		}
+
+		populated, err := c.Populated()
+		if err != nil {
+			level.Error(option.Logger).Log("msg", "Could not read a leftover cgroup", "container id", id, "err", err)
+			continue
+		}
+		if !populated {
+			if err := c.Destroy(); err != nil {
+				level.Error(option.Logger).Log("msg", "Could not remove an empty leftover cgroup", "container id", id, "err", err)
+			} else {
+				level.Info(option.Logger).Log("msg", "Removed an empty leftover cgroup", "container id", id)
+			}
+			continue
+		}
+
+		container, pidfd, err := resumedContainer(id, persisted[id], c)
+		if err != nil {
+			// the processes can't be monitored, they are moved out of the
+			// cgroup so that it does not stay around forever
+			level.Error(option.Logger).Log("msg", "Could not resume monitoring a leftover cgroup, releasing it", "container id", id, "err", err)
+			if err := errors.Join(c.Release(), c.Destroy()); err != nil {
+				level.Error(option.Logger).Log("msg", "Could not release a leftover cgroup", "container id", id, "err", err)
+			}
+			continue
+		}
+		if uid, ok := cgroup.UserOf(path); ok {
+			container.Owner.UID = uid
+		}
+		delete(persisted, id)
+		if _, err := option.Registry.Resume(container, pidfd); err != nil {
+			level.Error(option.Logger).Log("msg", "Could not resume monitoring a leftover cgroup", "container id", id, "err", err)
+			continue
+		}
+		level.Info(option.Logger).Log("msg", "Resumed monitoring a container", "container id", id, "container pid", container.Pid, "container running", pidfd >= 0)
+		resumed++
+	}
+
+	if option.InPlace {
+		resumed += resumeInPlace(option, persisted)
+	}
+	return resumed, nil
+}
+
+// resumeInPlace resumes monitoring the containers of the persisted metrics
+// whose process still runs in a cgroup of its own, as monitored in place by
+// the previous run. It returns the number of resumed containers.
+func resumeInPlace(option *ServerOption, persisted map[string]map[string]string) int {
+	resumed := 0
+	for id, labels := range persisted {
+		container, pidfd, err := resumedContainer(id, labels, nil)
+		if err != nil || pidfd < 0 {
+			// the container exited, only its final metrics are left
+			continue
+		}
+		p := &process{pidfd: pidfd, stat: &proc.Stat{Pid: int(container.Pid), StartTime: container.StartTime}}
+		path, err := dedicatedCgroup(p)
+		if err != nil {
+			p.close()
+			level.Info(option.Logger).Log("msg", "Container of the persisted metrics not resumed in place", "container id", id, "reason", err)
+			continue
+		}
+		container.CgroupPath = path
+		if _, err := option.Registry.Resume(container, pidfd); err != nil {
+			level.Error(option.Logger).Log("msg", "Could not resume monitoring a container in place", "container id", id, "err", err)
+			continue
+		}
+		level.Info(option.Logger).Log("msg", "Resumed monitoring a container in place", "container id", id, "container pid", container.Pid, "cgroup", path)
+		resumed++
+	}
+	return resumed
+}
+
+// resumedContainer rebuilds the info of a container from its id, as built by
+// newContainer, and its persisted grouping labels. The returned pidfd is -1 if
+// the container process is gone. The ids of the former versions have no start
+// time, the process holding the pid is then only taken for the container
+// process if it is in the cgroup c, if not nil.
+func resumedContainer(id string, labels map[string]string, c *cgroup.CGroup) (*parser.ContainerInfo, int, error) {
+	exe, pid, startTime, err := parseContainerID(id)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	container := &parser.ContainerInfo{
+		FullPath:  exe,
+		Pid:       pid,
+		StartTime: startTime,
+		Exe:       exe,
+		ID:        id,
+		Labels:    make(map[string]string, len(labels)),
+	}
+	for k, v := range labels {
+		if k != "job" {
+			container.Labels[k] = v
+		}
+	}
+
+	// the container process may have exited, and its pid been reused
+	p, err := openProcess(int(pid), false)
+	if err == nil && startTime == 0 && c != nil && memberOf(c, int(pid)) {
+		container.StartTime = p.stat.StartTime
+	}
+	if err != nil || p.stat.StartTime != container.StartTime {
+		p.close()
+		return container, -1, nil
+	}
+	container.FullPath = p.exe
+	return container, p.pidfd, nil
+}
+
+// memberOf reports whether the process is in the cgroup.
+func memberOf(c *cgroup.CGroup, pid int) bool {
+	pids, err := c.GetPids()
+	if err != nil {
+		return false
+	}
+	for _, member := range pids {
+		if member == pid {
+			return true
+		}
+	}
+	return false
+}
+
+// parseContainerID splits a container id built by newContainer,
+// <exe>_<pid>_<start time>, the exe name may contain underscores. The ids
+// built by the former versions, <exe>_<pid>, are also accepted, with a zero
+// start time.
+func parseContainerID(id string) (exe string, pid, startTime uint64, err error) {
+	invalid := fmt.Errorf("invalid container id %q", id)
+
+	n := strings.LastIndexByte(id, '_')
+	if n <= 0 {
+		return "", 0, 0, invalid
+	}
+	last, err := strconv.ParseUint(id[n+1:], 10, 64)
+	if err != nil {
+		return "", 0, 0, invalid
+	}
+	id = id[:n]
+
+	n = strings.LastIndexByte(id, '_')
+	if n > 0 {
+		if pid, err := strconv.ParseUint(id[n+1:], 10, 64); err == nil {
+			return id[:n], pid, last, nil
+		}
+	}
+	// a former id, without start time
+	return id, last, 0, nil
+}
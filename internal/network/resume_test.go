@@ -0,0 +1,153 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/cgroup"
+	"github.com/apptainer/apptheus/internal/monitor"
+	"github.com/apptainer/apptheus/internal/proc"
+	"github.com/apptainer/apptheus/internal/storage"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseContainerID(t *testing.T) {
+	exe, pid, startTime, err := parseContainerID("starter_1234_5678")
+	require.NoError(t, err)
+	require.Equal(t, "starter", exe)
+	require.Equal(t, uint64(1234), pid)
+	require.Equal(t, uint64(5678), startTime)
+
+	exe, pid, startTime, err = parseContainerID("my_starter_1_2")
+	require.NoError(t, err)
+	require.Equal(t, "my_starter", exe)
+	require.Equal(t, uint64(1), pid)
+	require.Equal(t, uint64(2), startTime)
+
+	// the ids of the former versions have no start time
+	exe, pid, startTime, err = parseContainerID("starter_1234")
+	require.NoError(t, err)
+	require.Equal(t, "starter", exe)
+	require.Equal(t, uint64(1234), pid)
+	require.Zero(t, startTime)
+
+	exe, pid, startTime, err = parseContainerID("my_starter_1234")
+	require.NoError(t, err)
+	require.Equal(t, "my_starter", exe)
+	require.Equal(t, uint64(1234), pid)
+	require.Zero(t, startTime)
+
+	for _, id := range []string{"", "starter", "_1", "starter_", "starter_1_y", "1234"} {
+		_, _, _, err = parseContainerID(id)
+		require.Error(t, err, id)
+	}
+}
+
+func TestResumedContainer(t *testing.T) {
+	stat, err := proc.StatOf(os.Getpid())
+	require.NoError(t, err)
+
+	id := fmt.Sprintf("%s_%d_%d", "network.test", stat.Pid, stat.StartTime)
+	container, pidfd, err := resumedContainer(id, map[string]string{"job": id, "slurm_job": "42"}, nil)
+	require.NoError(t, err)
+	if pidfd >= 0 {
+		unix.Close(pidfd)
+	}
+	require.Equal(t, stat.StartTime, container.StartTime)
+	require.Equal(t, map[string]string{"slurm_job": "42"}, container.Labels)
+
+	// without start time, the process holding the pid is only taken for the
+	// container process if it is in the container cgroup
+	container, pidfd, err = resumedContainer(fmt.Sprintf("%s_%d", "network.test", stat.Pid), nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, -1, pidfd)
+	require.Zero(t, container.StartTime)
+
+	_, _, err = resumedContainer("invalid", nil, nil)
+	require.Error(t, err)
+}
+
+func TestResumeInPlace(t *testing.T) {
+	logger := log.NewNopLogger()
+	ms := storage.NewDiskMetricStore("", time.Minute, nil, logger)
+	t.Cleanup(func() { ms.Shutdown() })
+	scheduler := monitor.NewScheduler(monitor.SchedulerConfig{Interval: time.Hour}, ms, logger)
+	t.Cleanup(scheduler.Stop)
+	option := &ServerOption{Registry: monitor.NewRegistry(scheduler), Logger: logger, InPlace: true}
+
+	stat, err := proc.StatOf(os.Getpid())
+	require.NoError(t, err)
+	running := fmt.Sprintf("%s_%d_%d", "network.test", stat.Pid, stat.StartTime)
+	exited := fmt.Sprintf("%s_%d_%d", "network.test", stat.Pid, stat.StartTime+1)
+
+	// the exited containers are left alone, as is the test process whose
+	// cgroup is not dedicated to it
+	resumed := resumeInPlace(option, map[string]map[string]string{
+		running: {"job": running},
+		exited:  {"job": exited},
+		"other": {"job": "other"},
+	})
+	require.Zero(t, resumed)
+	require.Empty(t, option.Registry.List(nil))
+}
+
+func TestResumeLeftovers(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to create cgroups")
+	}
+	root := fmt.Sprintf("/apptheus-resume-%d", os.Getpid())
+	require.NoError(t, cgroup.SetLayout(cgroup.Layout{Root: root}))
+	t.Cleanup(func() { cgroup.SetLayout(cgroup.Layout{Root: cgroup.DefaultRoot}) })
+
+	// a container cgroup left by a former version, and one which can't be
+	// resumed
+	var cmds []*exec.Cmd
+	var cgroups []*cgroup.CGroup
+	t.Cleanup(func() {
+		for _, cmd := range cmds {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+		for _, c := range cgroups {
+			c.Destroy()
+		}
+		if gateway, err := cgroup.NewCGroup(""); err == nil {
+			gateway.Destroy()
+		}
+	})
+	for _, name := range []string{"sleep_%d", "invalid-%d"} {
+		cmd := exec.Command("sleep", "60")
+		require.NoError(t, cmd.Start())
+		cmds = append(cmds, cmd)
+		c, err := cgroup.NewCGroup(fmt.Sprintf(name, cmd.Process.Pid))
+		require.NoError(t, err)
+		cgroups = append(cgroups, c)
+		require.NoError(t, c.Apply(cmd.Process.Pid))
+	}
+
+	logger := log.NewNopLogger()
+	ms := storage.NewDiskMetricStore("", time.Minute, nil, logger)
+	t.Cleanup(func() { ms.Shutdown() })
+	scheduler := monitor.NewScheduler(monitor.SchedulerConfig{Interval: time.Hour}, ms, logger)
+	t.Cleanup(scheduler.Stop)
+	option := &ServerOption{Registry: monitor.NewRegistry(scheduler), MetricStore: ms, Logger: logger}
+
+	resumed, err := Resume(option)
+	require.NoError(t, err)
+	require.Equal(t, 1, resumed)
+
+	// the container of the former version is resumed with its process
+	instance, ok := option.Registry.Get(fmt.Sprintf("sleep_%d", cmds[0].Process.Pid))
+	require.True(t, ok)
+	stat, err := proc.StatOf(cmds[0].Process.Pid)
+	require.NoError(t, err)
+	require.Equal(t, stat.StartTime, instance.Container.StartTime)
+
+	// while the other one is released and destroyed
+	require.False(t, cgroups[1].Exists())
+}
@@ -7,29 +7,48 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/apptainer/apptheus/internal/audit"
+	"github.com/apptainer/apptheus/internal/cgroup"
 	"github.com/apptainer/apptheus/internal/cgroup/parser"
 	"github.com/apptainer/apptheus/internal/monitor"
+	"github.com/apptainer/apptheus/internal/policy"
+	"github.com/apptainer/apptheus/internal/proc"
 	"github.com/apptainer/apptheus/internal/storage"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/opencontainers/runc/libcontainer/configs"
 	"github.com/prometheus/exporter-toolkit/web"
-	"golang.org/x/sys/unix"
 	"toolman.org/net/peercred"
 )
 
+var ErrNotDescendant = errors.New("process is neither the caller nor one of its descendants")
+
+// ErrLimitsLabels is returned when a caller other than root changes the labels
+// the resource limits are selected by, which would lift the limits of its own
+// containers.
+var ErrLimitsLabels = errors.New("only root can change the labels the resource limits are selected by")
+
 type ServerOption struct {
 	Server      *http.Server
 	WebConfig   *web.FlagConfig
 	MetricStore storage.MetricStore
+	Registry    *monitor.Registry
 	Logger      log.Logger
 	SocketPath  string
 	TrustedPath string
-	Interval    *time.Ticker
-	ErrCh       chan error
+	Policy      *policy.Policy
+	Audit       *audit.Sink
+	// InPlace monitors the containers in their current cgroup when they
+	// have one of their own.
+	InPlace bool
+	ErrCh   chan error
+	// Ready, if not nil, is closed once the server listens.
+	Ready chan struct{}
 }
 
 type WrappedInstance struct {
@@ -47,75 +66,144 @@ type WrappedListener struct {
 	DoneCh      chan *WrappedInstance
 }
 
+// Accept verifies the process connecting to the socket. A rejected connection
+// is closed before being returned. Unless the policy requires the containers
+// to be registered explicitly through the API, the caller itself is registered
+// and monitored for as long as it holds the connection.
 func (l *WrappedListener) Accept() (net.Conn, error) {
 	conn, err := l.Listener.Accept()
 	if err != nil {
 		return nil, err
 	}
 
-	pid := conn.(*peercred.Conn).Ucred.Pid
-
-	dirfd, err := unix.Open(fmt.Sprintf("/proc/%d", pid), unix.O_DIRECTORY, 0)
-	if err != nil {
-		return nil, err
+	ucred := conn.(*peercred.Conn).Ucred
+	pid := ucred.Pid
+	entry := audit.Entry{
+		Time: time.Now(),
+		Pid:  ucred.Pid,
+		UID:  ucred.Uid,
+		GID:  ucred.Gid,
 	}
 
-	pidfd, err := unix.PidfdOpen(int(pid), 0)
+	// the digest is only needed for the audit log, skip hashing otherwise
+	p, err := openProcess(int(pid), l.Option.Audit != nil)
 	if err != nil {
-		if !errors.Is(err, errors.ErrUnsupported) {
-			return nil, err
-		}
-		level.Warn(l.Option.Logger).Log("alert", "host kernel does not support pidfd_open, silently ignored")
-	}
-
-	if err == nil {
-		if err = unix.PidfdSendSignal(pidfd, 0, nil, 0); err != nil {
-			return nil, err
-		}
+		conn.Close()
+		level.Error(l.Option.Logger).Log("msg", "Could not verify the caller, connection rejected", "pid", pid, "err", err)
+		record(l.Option, entry, audit.Failed, err)
+		return conn, nil
 	}
-
-	buf := make([]byte, 4096)
-	n, err := unix.Readlinkat(dirfd, "exe", buf)
-	if err != nil {
-		return nil, err
+	if p.pidfd < 0 {
+		level.Warn(l.Option.Logger).Log("alert", "host kernel does not support pidfd_open, silently ignored")
 	}
-	link := string(buf[:n])
+	link := p.exe
+	entry.Exe = link
+	entry.Digest = p.digest
 
-	exe := filepath.Base(link)
 	verify := false
 	for _, path := range strings.Split(l.TrustedPath, ";") {
 		if strings.TrimSpace(link) == strings.TrimSpace(path) {
 			verify = true
+			entry.Rule = "trust.path=" + strings.TrimSpace(path)
 		}
 	}
 
 	if !verify {
-		if conn != nil {
-			conn.Close()
+		p.close()
+		// processes of the monitored containers may push their own metrics
+		if id := l.memberOf(int(pid)); id != "" {
+			entry.Rule = "container.member"
+			entry.ContainerID = id
+			record(l.Option, entry, audit.Accepted, nil)
+			level.Debug(l.Option.Logger).Log("msg", "New container member connection established", "pid", pid, "container id", id)
+			peer := &Peer{
+				Pid:       ucred.Pid,
+				UID:       ucred.Uid,
+				GID:       ucred.Gid,
+				StartTime: p.stat.StartTime,
+				Exe:       link,
+			}
+			return &PeerConn{Conn: conn, Peer: peer, logger: l.Option.Logger}, nil
 		}
+		conn.Close()
 		level.Error(l.Option.Logger).Log("msg", fmt.Sprintf("%s is not trusted, connection rejected", link))
+		record(l.Option, entry, audit.Rejected, errors.New("executable is not trusted"))
 		return conn, nil
 	}
 
-	// container and monitor instance info
-	container := &parser.ContainerInfo{
-		FullPath: link,
-		Pid:      uint64(pid),
-		Exe:      exe,
-		ID:       fmt.Sprintf("%s_%d", exe, pid),
+	// optional policy rules on top of the trusted executables
+	peer := &Peer{
+		Pid:       ucred.Pid,
+		UID:       ucred.Uid,
+		GID:       ucred.Gid,
+		StartTime: p.stat.StartTime,
+		Exe:       link,
+		Trusted:   true,
+		Labels:    make(map[string]string),
 	}
-	instance := monitor.New(l.Option.Interval)
+	caller := &policy.Caller{
+		Pid: int(pid),
+		UID: ucred.Uid,
+		GID: ucred.Gid,
+		Exe: link,
+	}
+	rule := l.Option.Policy.Match(caller)
+	if rule != nil {
+		entry.Rule = rule.Name
+		peer.Rule = rule.Name
+		peer.OnDisconnect = rule.OnDisconnect
+		peer.HeartbeatTimeout = rule.HeartbeatTimeout
+		peer.Interval = rule.Interval
+		if rule.NeedsAncestors() {
+			caller.Ancestors, err = proc.Ancestors(p.stat)
+			if err == nil {
+				entry.Ancestors = proc.FormatChain(caller.Ancestors)
+				peer.Labels["ancestors"] = entry.Ancestors
+				err = rule.Verify(caller)
+			}
+		}
+		if err != nil {
+			p.close()
+			conn.Close()
+			level.Error(l.Option.Logger).Log("msg", fmt.Sprintf("%s does not satisfy the policy, connection rejected", link), "rule", rule.Name, "ancestors", entry.Ancestors, "err", err)
+			record(l.Option, entry, audit.Rejected, err)
+			return conn, nil
+		}
+	}
+
+	pconn := &PeerConn{Conn: conn, Peer: peer, logger: l.Option.Logger}
+
+	// the caller registers its containers through the API, or it is a new
+	// connection of an already registered caller
+	owned := l.Option.Registry.List(monitor.OwnedBy(peer.Pid, peer.StartTime))
+	if (rule != nil && rule.ExplicitRegistration) || len(owned) != 0 {
+		p.close()
+		record(l.Option, entry, audit.Accepted, nil)
+		level.Debug(l.Option.Logger).Log("msg", "New API connection established", "pid", pid, "full path", link)
+		return pconn, nil
+	}
+
+	container := newContainer(p, peer)
+	setCgroup(l.Option, container, p)
+	setLimits(l.Option, container, peer, nil)
+	instance, err := l.Option.Registry.Register(container, p.pidfd)
+	if err != nil {
+		// the pidfd ownership has been handed over, even on error
+		conn.Close()
+		level.Error(l.Option.Logger).Log("msg", "Could not register the container, connection rejected", "container id", container.ID, "err", err)
+		record(l.Option, entry, audit.Failed, err)
+		return conn, nil
+	}
+
+	pconn.Hold(instance)
 
 	// save the container info for further usage
 	wrappedInstance := &WrappedInstance{
 		ContainerInfo: container,
 		Instance:      instance,
-		Conn:          conn,
+		Conn:          pconn,
 	}
 
-	// fire monitor thread
-	go instance.Start(container, l.Option.MetricStore, l.Option.Logger)
-
 	// fire a goroutine to retrieve the error or done message
 	go func() {
 		select {
@@ -129,7 +217,241 @@ func (l *WrappedListener) Accept() (net.Conn, error) {
 		}
 	}()
 
+	entry.ContainerID = container.ID
+	record(l.Option, entry, audit.Accepted, nil)
+
 	level.Info(l.Option.Logger).Log("msg", "New connection established", "container id", container.ID, "container pid", container.Pid, "container full path", container.FullPath)
 
-	return conn, nil
+	return pconn, nil
+}
+
+// memberOf returns the id of the monitored container the process belongs to,
+// if any.
+func (l *WrappedListener) memberOf(pid int) string {
+	instance, ok, err := l.Option.Registry.ContainerOf(pid)
+	if err != nil {
+		level.Debug(l.Option.Logger).Log("msg", "Could not read the cgroup of the caller", "pid", pid, "err", err)
+		return ""
+	}
+	if !ok {
+		return ""
+	}
+	return instance.Container.ID
+}
+
+// Register starts monitoring pid on behalf of peer, which is only allowed if
+// pid is the peer itself or one of its descendants. If the peer itself is
+// already monitored, its container is returned.
+func Register(option *ServerOption, peer *Peer, pid int, labels map[string]string) (*monitor.Instance, error) {
+	entry := audit.Entry{
+		Time: time.Now(),
+		Pid:  peer.Pid,
+		UID:  peer.UID,
+		GID:  peer.GID,
+		Rule: peer.Rule,
+	}
+
+	if pid == int(peer.Pid) {
+		owned := option.Registry.List(func(i *monitor.Instance) bool {
+			return monitor.OwnedBy(peer.Pid, peer.StartTime)(i) && i.Container.Pid == uint64(pid)
+		})
+		if len(owned) != 0 {
+			return owned[0], nil
+		}
+	}
+
+	p, err := openProcess(pid, option.Audit != nil)
+	if err != nil {
+		record(option, entry, audit.Failed, err)
+		return nil, err
+	}
+	entry.Exe = p.exe
+	entry.Digest = p.digest
+
+	if pid != int(peer.Pid) {
+		ancestors, err := proc.Ancestors(p.stat)
+		if err != nil {
+			p.close()
+			record(option, entry, audit.Failed, err)
+			return nil, err
+		}
+		descendant := false
+		for _, a := range ancestors {
+			if a.Pid == int(peer.Pid) && a.StartTime == peer.StartTime {
+				descendant = true
+				break
+			}
+		}
+		if !descendant {
+			p.close()
+			record(option, entry, audit.Rejected, ErrNotDescendant)
+			return nil, ErrNotDescendant
+		}
+	}
+
+	container := newContainer(p, peer)
+	setCgroup(option, container, p)
+	setLimits(option, container, peer, labels)
+	instance, err := option.Registry.Register(container, p.pidfd)
+	if err != nil {
+		record(option, entry, audit.Failed, err)
+		return nil, err
+	}
+	if labels != nil {
+		instance.SetLabels(labels)
+	}
+
+	entry.ContainerID = container.ID
+	record(option, entry, audit.Accepted, nil)
+	level.Info(option.Logger).Log("msg", "New container registered", "container id", container.ID, "container pid", container.Pid, "container full path", container.FullPath, "owner pid", peer.Pid)
+	return instance, nil
+}
+
+// newContainer returns the info of the container whose process is p,
+// registered by peer. The start time makes the id unique across pid reuse.
+func newContainer(p *process, peer *Peer) *parser.ContainerInfo {
+	exe := filepath.Base(p.exe)
+	labels := make(map[string]string, len(peer.Labels))
+	for k, v := range peer.Labels {
+		labels[k] = v
+	}
+	return &parser.ContainerInfo{
+		FullPath:  p.exe,
+		Pid:       uint64(p.stat.Pid),
+		StartTime: p.stat.StartTime,
+		Exe:       exe,
+		ID:        fmt.Sprintf("%s_%d_%d", exe, p.stat.Pid, p.stat.StartTime),
+		Labels:    labels,
+		Owner: parser.Owner{
+			Pid:       peer.Pid,
+			StartTime: peer.StartTime,
+			UID:       peer.UID,
+			GID:       peer.GID,
+		},
+		ReleaseOnDisconnect: peer.OnDisconnect == policy.Release,
+		HeartbeatTimeout:    peer.HeartbeatTimeout,
+		Interval:            peer.Interval,
+	}
+}
+
+// setCgroup monitors the container in its current cgroup in the in-place
+// mode, if the cgroup only holds the container process and its descendants.
+// Otherwise, e.g. if it sits in a session scope, a cgroup of its own is
+// created.
+func setCgroup(option *ServerOption, container *parser.ContainerInfo, p *process) {
+	if !option.InPlace {
+		return
+	}
+	path, err := dedicatedCgroup(p)
+	if err != nil {
+		level.Info(option.Logger).Log("msg", "Container not monitored in place, creating its cgroup", "container id", container.ID, "reason", err)
+		return
+	}
+	container.CgroupPath = path
+	level.Info(option.Logger).Log("msg", "Container monitored in place", "container id", container.ID, "cgroup", path)
+}
+
+// dedicatedCgroup returns the cgroup of the process, if it only holds the
+// process and its descendants.
+func dedicatedCgroup(p *process) (string, error) {
+	path, err := cgroup.UnifiedPathOf(int(p.stat.Pid))
+	if err != nil {
+		return "", err
+	}
+	if path == "/" || cgroup.Managed(path) {
+		return "", fmt.Errorf("cgroup %s is not dedicated to the container", path)
+	}
+	if own, err := cgroup.UnifiedPathOf(os.Getpid()); err == nil && own == path {
+		return "", fmt.Errorf("cgroup %s is the one of apptheus", path)
+	}
+
+	pids, err := cgroup.ProcsOf(path)
+	if err != nil {
+		return "", err
+	}
+	for _, pid := range pids {
+		if pid == int(p.stat.Pid) {
+			continue
+		}
+		if !descendantOf(pid, p.stat) {
+			return "", fmt.Errorf("cgroup %s holds other processes", path)
+		}
+	}
+	return path, nil
+}
+
+// descendantOf reports whether pid is a descendant of the process.
+func descendantOf(pid int, parent *proc.Stat) bool {
+	stat, err := proc.StatOf(pid)
+	if err != nil {
+		return false
+	}
+	ancestors, err := proc.Ancestors(stat)
+	if err != nil {
+		return false
+	}
+	for _, a := range ancestors {
+		if a.Pid == parent.Pid && a.StartTime == parent.StartTime {
+			return true
+		}
+	}
+	return false
+}
+
+// setLimits sets the resources of the container from the policy limits
+// applying to it, labels being the ones supplied by the client.
+func setLimits(option *ServerOption, container *parser.ContainerInfo, peer *Peer, labels map[string]string) {
+	container.Limits, container.Resources = limitsFor(option, peer, labels)
+}
+
+// UpdateLabels replaces the labels of the container on behalf of peer, its
+// owner, evaluating again the policy limits applying to it if the labels they
+// are selected by changed. Only root can change those, ErrLimitsLabels is
+// returned otherwise.
+func UpdateLabels(option *ServerOption, instance *monitor.Instance, peer *Peer, labels map[string]string) error {
+	changed := option.Policy.LimitsLabelsChanged(instance.Labels(), labels)
+	if changed && peer.UID != 0 {
+		return ErrLimitsLabels
+	}
+	instance.SetLabels(labels)
+	if changed {
+		instance.SetLimits(limitsFor(option, peer, labels))
+	}
+	return nil
+}
+
+// limitsFor returns the name and the resources of the policy limits applying
+// to the containers of peer with the labels, empty if none applies.
+func limitsFor(option *ServerOption, peer *Peer, labels map[string]string) (string, *configs.Resources) {
+	limits := option.Policy.LimitsFor(&policy.Subject{
+		Exe:    peer.Exe,
+		UID:    peer.UID,
+		GID:    peer.GID,
+		Labels: labels,
+	})
+	if limits == nil {
+		return "", nil
+	}
+	// the limits have been validated with the policy
+	resources, err := limits.Resources()
+	if err != nil {
+		level.Error(option.Logger).Log("msg", "Invalid resource limits", "limits", limits.Name, "err", err)
+		return "", nil
+	}
+	return limits.Name, resources
+}
+
+// record records the decision made for a connection attempt or a
+// registration, if the audit log is enabled.
+func record(option *ServerOption, entry audit.Entry, decision audit.Decision, reason error) {
+	if option.Audit == nil {
+		return
+	}
+	entry.Decision = decision
+	if reason != nil {
+		entry.Reason = reason.Error()
+	}
+	if err := option.Audit.Record(entry); err != nil {
+		level.Error(option.Logger).Log("msg", "could not write audit log entry", "err", err)
+	}
 }
@@ -0,0 +1,70 @@
+package network
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/apptainer/apptheus/internal/cgroup/parser"
+	"github.com/apptainer/apptheus/internal/monitor"
+	"github.com/apptainer/apptheus/internal/policy"
+	"github.com/apptainer/apptheus/internal/proc"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescendantOf(t *testing.T) {
+	self, err := proc.StatOf(os.Getpid())
+	require.NoError(t, err)
+
+	cmd := exec.Command("sleep", "10")
+	require.NoError(t, cmd.Start())
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	require.True(t, descendantOf(cmd.Process.Pid, self))
+	require.False(t, descendantOf(os.Getppid(), self))
+	require.False(t, descendantOf(-1, self))
+}
+
+func TestUpdateLabelsLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+limits:
+  - name: gpu
+    match:
+      labels: {partition: gpu}
+    memory_max: 8Gi
+`), 0o600))
+	p, err := policy.Load(path)
+	require.NoError(t, err)
+	option := &ServerOption{Policy: p, Logger: log.NewNopLogger()}
+
+	instance := monitor.New(&parser.ContainerInfo{ID: "test", Limits: "gpu"}, -1)
+	instance.SetLabels(map[string]string{"partition": "gpu"})
+
+	// the owner can't escape the limits by changing or removing the labels
+	// they are selected by
+	owner := &Peer{UID: 1000}
+	for _, labels := range []map[string]string{
+		{"partition": "cpu"},
+		{"step": "2"},
+		nil,
+	} {
+		require.ErrorIs(t, UpdateLabels(option, instance, owner, labels), ErrLimitsLabels, labels)
+		require.Equal(t, map[string]string{"partition": "gpu"}, instance.Labels())
+		require.Equal(t, "gpu", instance.Limits())
+	}
+
+	// but it can change the other labels
+	require.NoError(t, UpdateLabels(option, instance, owner, map[string]string{"partition": "gpu", "step": "2"}))
+	require.Equal(t, map[string]string{"partition": "gpu", "step": "2"}, instance.Labels())
+	require.Equal(t, "gpu", instance.Limits())
+
+	// while root can lift the limits
+	require.NoError(t, UpdateLabels(option, instance, &Peer{UID: 0}, map[string]string{"partition": "cpu"}))
+	require.Equal(t, "", instance.Limits())
+}
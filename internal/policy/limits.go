@@ -0,0 +1,206 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package policy
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/runc/libcontainer/configs"
+)
+
+// Limits sets the resource limits of the containers it applies to when they
+// are registered. Limits are evaluated in order, the first applying decides.
+type Limits struct {
+	Name  string        `yaml:"name"`
+	Match LimitsMatcher `yaml:"match,omitempty"`
+	// MemoryMax is the hard memory limit, i.e. memory.max.
+	MemoryMax ByteSize `yaml:"memory_max,omitempty"`
+	// MemoryHigh is the memory throttling threshold, i.e. memory.high. It
+	// is only available on cgroup v2.
+	MemoryHigh ByteSize `yaml:"memory_high,omitempty"`
+	// CPUMax is the CPU bandwidth limit in the cpu.max format, "<quota>
+	// <period>" in microseconds, e.g. "200000 100000" for two CPUs.
+	CPUMax string `yaml:"cpu_max,omitempty"`
+	// Cpuset lists the CPUs the containers may run on, e.g. "0-3,8".
+	Cpuset string `yaml:"cpuset,omitempty"`
+	// PidsMax is the maximum number of processes, i.e. pids.max.
+	PidsMax int64 `yaml:"pids_max,omitempty"`
+}
+
+// LimitsMatcher selects the containers limits apply to. All the set fields
+// must match, an empty matcher applies to all the containers.
+type LimitsMatcher struct {
+	// Exe lists the trusted executables registering the containers.
+	Exe []string `yaml:"exe,omitempty"`
+	// UID and GID list the users and groups of the registering process.
+	UID []uint32 `yaml:"uid,omitempty"`
+	GID []uint32 `yaml:"gid,omitempty"`
+	// Labels must all be set to the given values by the client registering
+	// the containers.
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// Subject describes a container being registered.
+type Subject struct {
+	// Exe, UID and GID are the ones of the registering process.
+	Exe string
+	UID uint32
+	GID uint32
+	// Labels are the labels supplied by the client.
+	Labels map[string]string
+}
+
+// LimitsFor returns the first limits applying to the container, or nil if
+// there is none. It is safe to call on a nil Policy.
+func (p *Policy) LimitsFor(s *Subject) *Limits {
+	if p == nil {
+		return nil
+	}
+	for i := range p.Limits {
+		if p.Limits[i].Match.matches(s) {
+			return &p.Limits[i]
+		}
+	}
+	return nil
+}
+
+// LimitsLabelsChanged reports whether the labels the limits are selected by
+// differ between before and after. It is safe to call on a nil Policy.
+func (p *Policy) LimitsLabelsChanged(before, after map[string]string) bool {
+	if p == nil {
+		return false
+	}
+	for i := range p.Limits {
+		for k := range p.Limits[i].Match.Labels {
+			value, ok := before[k]
+			newValue, newOk := after[k]
+			if ok != newOk || value != newValue {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (m LimitsMatcher) matches(s *Subject) bool {
+	if len(m.Exe) != 0 && !contains(m.Exe, s.Exe) {
+		return false
+	}
+	if len(m.UID) != 0 && !containsID(m.UID, s.UID) {
+		return false
+	}
+	if len(m.GID) != 0 && !containsID(m.GID, s.GID) {
+		return false
+	}
+	for k, v := range m.Labels {
+		if value, ok := s.Labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+func containsID(list []uint32, id uint32) bool {
+	for _, e := range list {
+		if e == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Resources returns the cgroup resources setting the limits.
+func (l *Limits) Resources() (*configs.Resources, error) {
+	r := &configs.Resources{
+		Memory:     int64(l.MemoryMax),
+		CpusetCpus: l.Cpuset,
+		PidsLimit:  l.PidsMax,
+	}
+	if l.MemoryHigh != 0 {
+		r.Unified = map[string]string{"memory.high": strconv.FormatInt(int64(l.MemoryHigh), 10)}
+	}
+	if l.CPUMax != "" {
+		quota, period, err := parseCPUMax(l.CPUMax)
+		if err != nil {
+			return nil, err
+		}
+		r.CpuQuota = quota
+		r.CpuPeriod = period
+	}
+	return r, nil
+}
+
+// parseCPUMax parses the cpu.max format, the quota being "max" or a number of
+// microseconds, optionally followed by the period.
+func parseCPUMax(s string) (quota int64, period uint64, err error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, 0, fmt.Errorf("invalid cpu_max %q, expected \"<quota> [<period>]\"", s)
+	}
+
+	if fields[0] == "max" {
+		quota = -1
+	} else if quota, err = strconv.ParseInt(fields[0], 10, 64); err != nil || quota <= 0 {
+		return 0, 0, fmt.Errorf("invalid cpu_max quota %q", fields[0])
+	}
+
+	period = 100000
+	if len(fields) == 2 {
+		if period, err = strconv.ParseUint(fields[1], 10, 64); err != nil || period == 0 {
+			return 0, 0, fmt.Errorf("invalid cpu_max period %q", fields[1])
+		}
+	}
+	return quota, period, nil
+}
+
+func (l *Limits) validate() error {
+	if l.MemoryMax < 0 || l.MemoryHigh < 0 {
+		return fmt.Errorf("limits %q: negative memory limit", l.Name)
+	}
+	if l.PidsMax < 0 {
+		return fmt.Errorf("limits %q: negative pids_max", l.Name)
+	}
+	if _, err := l.Resources(); err != nil {
+		return fmt.Errorf("limits %q: %w", l.Name, err)
+	}
+	return nil
+}
+
+// ByteSize is a number of bytes, which can be written with a binary unit
+// suffix in any case, e.g. 512M, 512mb or 8Gi.
+type ByteSize int64
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (b *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	units := []struct {
+		suffix string
+		shift  uint
+	}{{"T", 40}, {"G", 30}, {"M", 20}, {"K", 10}}
+
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	shift := uint(0)
+	for _, unit := range units {
+		if n, ok := strings.CutSuffix(number, unit.suffix); ok {
+			number, shift = n, unit.shift
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64>>shift || n < math.MinInt64>>shift {
+		return fmt.Errorf("size %q out of range", s)
+	}
+	*b = ByteSize(n << shift)
+	return nil
+}
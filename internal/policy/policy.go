@@ -0,0 +1,207 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/proc"
+	"gopkg.in/yaml.v2"
+)
+
+// Policy holds the optional rules applied on top of --trust.path when a
+// caller connects to the verification socket. Rules are evaluated in order,
+// the first rule applying to the caller decides.
+type Policy struct {
+	Rules []Rule `yaml:"rules"`
+	// Limits are the resource limits set on the containers when they are
+	// registered.
+	Limits []Limits `yaml:"limits,omitempty"`
+}
+
+// Rule constrains the callers it applies to.
+type Rule struct {
+	Name string `yaml:"name"`
+	// Exe lists the trusted executables the rule applies to, an empty list
+	// applies to all of them.
+	Exe []string `yaml:"exe,omitempty"`
+	// Ancestors, if not empty, requires the caller to have been spawned,
+	// directly or not, by a process matching at least one of the entries.
+	Ancestors []AncestorMatcher `yaml:"ancestors,omitempty"`
+	// ExplicitRegistration disables the registration of the caller upon
+	// connection, containers must then be registered through the API.
+	ExplicitRegistration bool `yaml:"explicit_registration,omitempty"`
+	// OnDisconnect is what happens to the containers registered by the
+	// caller once it is gone, see the OnDisconnect constants.
+	OnDisconnect OnDisconnect `yaml:"on_disconnect,omitempty"`
+	// HeartbeatTimeout, if not zero, considers the caller gone when it has
+	// not sent a heartbeat for that long, e.g. because it died while its
+	// connection is still held by its reparented children.
+	HeartbeatTimeout time.Duration `yaml:"heartbeat_timeout,omitempty"`
+	// Interval, if not zero, overrides the sampling interval of the
+	// containers registered by the caller.
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// OnDisconnect is the action taken when the caller which registered a
+// container closes its connection, or is detected dead.
+type OnDisconnect string
+
+const (
+	// Keep keeps monitoring the container until its processes exit.
+	Keep OnDisconnect = "keep"
+	// Release stops monitoring the container after a final sample, and
+	// releases its cgroup.
+	Release OnDisconnect = "release"
+)
+
+// AncestorMatcher matches a process of the parent chain of a caller.
+type AncestorMatcher struct {
+	// Comm, if not empty, is the command name of the ancestor, e.g.
+	// "slurmstepd". As any process can set its own, it only narrows Exe.
+	Comm string `yaml:"comm,omitempty"`
+	// Exe lists the allowed executable paths of the ancestor, it is required.
+	Exe []string `yaml:"exe,omitempty"`
+	// MaxDepth is how far up the chain the ancestor may be, 1 being the
+	// direct parent. Zero means anywhere in the chain.
+	MaxDepth int `yaml:"max_depth,omitempty"`
+}
+
+// Caller describes the process connecting to the verification socket.
+type Caller struct {
+	Pid int
+	UID uint32
+	GID uint32
+	Exe string
+	// Ancestors is the parent chain of the caller, the closest first.
+	Ancestors []proc.Process
+}
+
+// Load reads and validates a policy file.
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policy{}
+	if err := yaml.UnmarshalStrict(data, p); err != nil {
+		return nil, fmt.Errorf("parsing policy file %s: %w", path, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+	return p, nil
+}
+
+func (p *Policy) validate() error {
+	names := make(map[string]struct{}, len(p.Rules))
+	for i, r := range p.Rules {
+		if r.Name == "" {
+			return fmt.Errorf("rule %d has no name", i)
+		}
+		if _, ok := names[r.Name]; ok {
+			return fmt.Errorf("duplicated rule name %q", r.Name)
+		}
+		names[r.Name] = struct{}{}
+
+		switch r.OnDisconnect {
+		case "", Keep, Release:
+		default:
+			return fmt.Errorf("rule %q: unknown on_disconnect action %q", r.Name, r.OnDisconnect)
+		}
+		if r.HeartbeatTimeout < 0 {
+			return fmt.Errorf("rule %q: negative heartbeat_timeout", r.Name)
+		}
+		if r.Interval < 0 {
+			return fmt.Errorf("rule %q: negative interval", r.Name)
+		}
+
+		for _, a := range r.Ancestors {
+			if len(a.Exe) == 0 {
+				return fmt.Errorf("rule %q: ancestor matcher needs an exe", r.Name)
+			}
+			if a.MaxDepth < 0 {
+				return fmt.Errorf("rule %q: negative max_depth", r.Name)
+			}
+		}
+	}
+
+	names = make(map[string]struct{}, len(p.Limits))
+	for i := range p.Limits {
+		l := &p.Limits[i]
+		if l.Name == "" {
+			return fmt.Errorf("limits %d have no name", i)
+		}
+		if _, ok := names[l.Name]; ok {
+			return fmt.Errorf("duplicated limits name %q", l.Name)
+		}
+		names[l.Name] = struct{}{}
+		if err := l.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match returns the first rule applying to the caller, or nil if there is
+// none. It is safe to call on a nil Policy.
+func (p *Policy) Match(c *Caller) *Rule {
+	if p == nil {
+		return nil
+	}
+	for i := range p.Rules {
+		if p.Rules[i].applies(c) {
+			return &p.Rules[i]
+		}
+	}
+	return nil
+}
+
+func (r *Rule) applies(c *Caller) bool {
+	return len(r.Exe) == 0 || contains(r.Exe, c.Exe)
+}
+
+// NeedsAncestors reports whether verifying the rule needs the parent chain of
+// the caller.
+func (r *Rule) NeedsAncestors() bool {
+	return len(r.Ancestors) != 0
+}
+
+// Verify checks the constraints of the rule against the caller.
+func (r *Rule) Verify(c *Caller) error {
+	if !r.NeedsAncestors() {
+		return nil
+	}
+
+	for _, matcher := range r.Ancestors {
+		for depth, ancestor := range c.Ancestors {
+			if matcher.MaxDepth != 0 && depth >= matcher.MaxDepth {
+				break
+			}
+			if matcher.matches(ancestor) {
+				return nil
+			}
+		}
+	}
+	return errors.New("no ancestor of the caller matches the policy rule " + r.Name)
+}
+
+func (a AncestorMatcher) matches(p proc.Process) bool {
+	if a.Comm != "" && a.Comm != p.Comm {
+		return false
+	}
+	return contains(a.Exe, p.Exe)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,190 @@
+package policy_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/policy"
+	"github.com/apptainer/apptheus/internal/proc"
+	"github.com/stretchr/testify/require"
+)
+
+const starter = "/usr/local/libexec/apptainer/bin/starter"
+
+func writePolicy(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "policy.yml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	p, err := policy.Load(writePolicy(t, `
+rules:
+  - name: apptainer
+    exe: [`+starter+`]
+    ancestors:
+      - comm: apptainer
+        exe: [/usr/local/bin/apptainer]
+        max_depth: 1
+      - comm: slurmstepd
+        exe: [/usr/sbin/slurmstepd]
+    on_disconnect: release
+    heartbeat_timeout: 30s
+`))
+	require.NoError(t, err)
+	require.Len(t, p.Rules, 1)
+	require.Len(t, p.Rules[0].Ancestors, 2)
+	require.Equal(t, 1, p.Rules[0].Ancestors[0].MaxDepth)
+	require.Equal(t, policy.Release, p.Rules[0].OnDisconnect)
+	require.Equal(t, 30*time.Second, p.Rules[0].HeartbeatTimeout)
+
+	_, err = policy.Load(writePolicy(t, "rules:\n  - exe: [/bin/sh]\n"))
+	require.Error(t, err)
+
+	_, err = policy.Load(writePolicy(t, "rules:\n  - name: a\n  - name: a\n"))
+	require.Error(t, err)
+
+	_, err = policy.Load(writePolicy(t, "rules:\n  - name: a\n    ancestors:\n      - max_depth: 2\n"))
+	require.Error(t, err)
+
+	// the command name alone can be set by any process
+	_, err = policy.Load(writePolicy(t, "rules:\n  - name: a\n    ancestors:\n      - comm: slurmstepd\n"))
+	require.ErrorContains(t, err, "needs an exe")
+
+	_, err = policy.Load(writePolicy(t, "rules:\n  - name: a\n    unknown: field\n"))
+	require.Error(t, err)
+
+	_, err = policy.Load(writePolicy(t, "rules:\n  - name: a\n    on_disconnect: kill\n"))
+	require.Error(t, err)
+}
+
+func TestMatchAndVerify(t *testing.T) {
+	p := &policy.Policy{
+		Rules: []policy.Rule{
+			{
+				Name: "apptainer",
+				Exe:  []string{starter},
+				Ancestors: []policy.AncestorMatcher{
+					{Comm: "apptainer", Exe: []string{"/usr/local/bin/apptainer"}, MaxDepth: 1},
+					{Comm: "slurmstepd", Exe: []string{"/usr/sbin/slurmstepd"}},
+				},
+			},
+			{Name: "others"},
+		},
+	}
+
+	var nilPolicy *policy.Policy
+	require.Nil(t, nilPolicy.Match(&policy.Caller{Exe: starter}))
+
+	rule := p.Match(&policy.Caller{Exe: "/opt/other"})
+	require.NotNil(t, rule)
+	require.Equal(t, "others", rule.Name)
+	require.False(t, rule.NeedsAncestors())
+	require.NoError(t, rule.Verify(&policy.Caller{Exe: "/opt/other"}))
+
+	apptainer := proc.Process{Pid: 10, Comm: "apptainer", Exe: "/usr/local/bin/apptainer"}
+	fakeApptainer := proc.Process{Pid: 10, Comm: "apptainer", Exe: "/tmp/apptainer"}
+	bash := proc.Process{Pid: 9, Comm: "bash", Exe: "/bin/bash"}
+	slurm := proc.Process{Pid: 5, Comm: "slurmstepd", Exe: "/usr/sbin/slurmstepd"}
+	fakeSlurm := proc.Process{Pid: 5, Comm: "slurmstepd", Exe: "/tmp/slurmstepd"}
+	systemd := proc.Process{Pid: 1, Comm: "systemd", Exe: "/usr/lib/systemd/systemd"}
+
+	tests := []struct {
+		name      string
+		ancestors []proc.Process
+		ok        bool
+	}{
+		{"spawned by apptainer", []proc.Process{apptainer, bash, systemd}, true},
+		{"spawned by apptainer from another path", []proc.Process{fakeApptainer, bash, systemd}, false},
+		{"apptainer is not the direct parent", []proc.Process{bash, apptainer, systemd}, false},
+		{"spawned by a slurm step", []proc.Process{bash, fakeApptainer, slurm, systemd}, true},
+		{"spawned by a process named as a slurm step", []proc.Process{bash, fakeSlurm, systemd}, false},
+		{"no matching ancestor", []proc.Process{bash, systemd}, false},
+		{"no ancestor", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caller := &policy.Caller{Exe: starter, Ancestors: tt.ancestors}
+			rule := p.Match(caller)
+			require.NotNil(t, rule)
+			require.Equal(t, "apptainer", rule.Name)
+			require.True(t, rule.NeedsAncestors())
+			if tt.ok {
+				require.NoError(t, rule.Verify(caller))
+			} else {
+				require.Error(t, rule.Verify(caller))
+			}
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	p, err := policy.Load(writePolicy(t, `
+limits:
+  - name: gpu
+    match:
+      labels: {partition: gpu}
+    memory_max: 8Gi
+    memory_high: 6G
+    cpu_max: 400000 100000
+    cpuset: 0-3
+    pids_max: 1000
+  - name: users
+    match:
+      exe: [`+starter+`]
+      uid: [1000, 1001]
+    memory_max: 1073741824
+`))
+	require.NoError(t, err)
+	require.Len(t, p.Limits, 2)
+
+	limits := p.LimitsFor(&policy.Subject{Exe: starter, UID: 0, Labels: map[string]string{"partition": "gpu"}})
+	require.NotNil(t, limits)
+	require.Equal(t, "gpu", limits.Name)
+	r, err := limits.Resources()
+	require.NoError(t, err)
+	require.Equal(t, int64(8<<30), r.Memory)
+	require.Equal(t, "6442450944", r.Unified["memory.high"])
+	require.Equal(t, int64(400000), r.CpuQuota)
+	require.Equal(t, uint64(100000), r.CpuPeriod)
+	require.Equal(t, "0-3", r.CpusetCpus)
+	require.Equal(t, int64(1000), r.PidsLimit)
+
+	limits = p.LimitsFor(&policy.Subject{Exe: starter, UID: 1001})
+	require.NotNil(t, limits)
+	require.Equal(t, "users", limits.Name)
+	require.Equal(t, policy.ByteSize(1<<30), limits.MemoryMax)
+
+	require.Nil(t, p.LimitsFor(&policy.Subject{Exe: starter, UID: 1002}))
+
+	// the suffixes are case insensitive
+	p, err = policy.Load(writePolicy(t, "limits:\n  - name: a\n    memory_max: 8gi\n    memory_high: 512mb\n"))
+	require.NoError(t, err)
+	require.Equal(t, policy.ByteSize(8<<30), p.Limits[0].MemoryMax)
+	require.Equal(t, policy.ByteSize(512<<20), p.Limits[0].MemoryHigh)
+	require.Nil(t, (*policy.Policy)(nil).LimitsFor(&policy.Subject{}))
+
+	// only the labels the limits are selected by matter
+	gpu := map[string]string{"partition": "gpu"}
+	p = &policy.Policy{Limits: []policy.Limits{{Match: policy.LimitsMatcher{Labels: gpu}}}}
+	require.False(t, p.LimitsLabelsChanged(gpu, map[string]string{"partition": "gpu", "step": "2"}))
+	require.True(t, p.LimitsLabelsChanged(gpu, map[string]string{"partition": "cpu"}))
+	require.True(t, p.LimitsLabelsChanged(gpu, nil))
+	require.False(t, (*policy.Policy)(nil).LimitsLabelsChanged(gpu, nil))
+
+	for _, content := range []string{
+		"limits:\n  - memory_max: 1G\n",
+		"limits:\n  - name: a\n  - name: a\n",
+		"limits:\n  - name: a\n    memory_max: lots\n",
+		"limits:\n  - name: a\n    cpu_max: 1 2 3\n",
+		"limits:\n  - name: a\n    cpu_max: none\n",
+		"limits:\n  - name: a\n    pids_max: -1\n",
+		"limits:\n  - name: a\n    memory_max: 99999999999Ti\n",
+	} {
+		_, err = policy.Load(writePolicy(t, content))
+		require.Error(t, err, content)
+	}
+}
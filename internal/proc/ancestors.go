@@ -0,0 +1,81 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package proc
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// maxAncestors bounds the walk up the process tree.
+const maxAncestors = 64
+
+// Process identifies a process of the tree of a caller.
+type Process struct {
+	Pid       int
+	Comm      string
+	Exe       string
+	StartTime uint64
+}
+
+// String returns the "comm:pid" representation of the process.
+func (p Process) String() string {
+	return p.Comm + ":" + strconv.Itoa(p.Pid)
+}
+
+// Ancestors walks the parent chain of the process described by stat via
+// /proc/<pid>/stat and returns its ancestors, the closest first. The walk
+// stops at pid 1 (included), or at the first process which cannot be read,
+// e.g. because it is not accessible, the chain read so far being returned.
+// The exe of an ancestor is left empty if it cannot be resolved. An error is
+// returned if an ancestor exits during the walk, as the chain is then not
+// reliable.
+func Ancestors(stat *Stat) ([]Process, error) {
+	var ancestors []Process
+
+	child := stat
+	for child.PPid > 0 && len(ancestors) < maxAncestors {
+		parent, err := StatOf(child.PPid)
+		if os.IsNotExist(err) {
+			// the parent exited in the meantime, the caller has been
+			// reparented
+			return nil, fmt.Errorf("parent %d of %d exited during verification", child.PPid, child.Pid)
+		} else if err != nil {
+			break
+		}
+
+		// a parent can't be younger than its child, otherwise its pid has
+		// been reused
+		if parent.StartTime > child.StartTime {
+			return nil, fmt.Errorf("parent %d of %d exited during verification", child.PPid, child.Pid)
+		}
+
+		exe, _ := os.Readlink(fmt.Sprintf("/proc/%d/exe", parent.Pid))
+		// the exe must be the one of the parent, not of a process which
+		// reused its pid in between
+		if again, err := StatOf(parent.Pid); err != nil || again.StartTime != parent.StartTime {
+			return nil, fmt.Errorf("parent %d of %d exited during verification", child.PPid, child.Pid)
+		}
+		ancestors = append(ancestors, Process{
+			Pid:       parent.Pid,
+			Comm:      parent.Comm,
+			Exe:       exe,
+			StartTime: parent.StartTime,
+		})
+		child = parent
+	}
+
+	return ancestors, nil
+}
+
+// FormatChain returns the ancestor chain in a compact form suitable for a
+// label value, e.g. "apptainer:1234,slurmstepd:1200,systemd:1".
+func FormatChain(ancestors []Process) string {
+	chain := make([]string, 0, len(ancestors))
+	for _, a := range ancestors {
+		chain = append(chain, a.String())
+	}
+	return strings.Join(chain, ",")
+}
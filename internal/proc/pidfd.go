@@ -0,0 +1,40 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package proc
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+var ErrExited = errors.New("process exited")
+
+// PidfdExited reports whether the process referred by pidfd has exited, by
+// polling the pidfd which becomes readable at exit. Unlike sending signal 0,
+// this does not require CAP_KILL for processes owned by other users.
+func PidfdExited(pidfd int) (bool, error) {
+	fds := []unix.PollFd{{Fd: int32(pidfd), Events: unix.POLLIN}}
+	for {
+		n, err := unix.Poll(fds, 0)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		return n != 0, nil
+	}
+}
+
+// PidfdAlive returns ErrExited if the process referred by pidfd has exited.
+func PidfdAlive(pidfd int) error {
+	exited, err := PidfdExited(pidfd)
+	if err != nil {
+		return err
+	}
+	if exited {
+		return ErrExited
+	}
+	return nil
+}
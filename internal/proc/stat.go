@@ -0,0 +1,88 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package proc
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// Stat holds the fields of /proc/<pid>/stat used by apptheus.
+type Stat struct {
+	Pid  int
+	Comm string
+	PPid int
+	// StartTime is the time the process started after system boot, in clock
+	// ticks. Together with the pid it uniquely identifies a process.
+	StartTime uint64
+}
+
+// ParseStat parses the content of a /proc/<pid>/stat file.
+func ParseStat(data []byte) (*Stat, error) {
+	// comm is enclosed in parentheses and may itself contain spaces and
+	// parentheses, so look for the last closing one.
+	open := bytes.IndexByte(data, '(')
+	closing := bytes.LastIndexByte(data, ')')
+	if open < 0 || closing < open {
+		return nil, fmt.Errorf("malformed stat content: %q", data)
+	}
+
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(data[:open])))
+	if err != nil {
+		return nil, fmt.Errorf("malformed pid in stat content: %w", err)
+	}
+
+	// fields after comm, starting with state (field 3)
+	fields := bytes.Fields(data[closing+1:])
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("malformed stat content, only %d fields after comm", len(fields))
+	}
+
+	ppid, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return nil, fmt.Errorf("malformed ppid in stat content: %w", err)
+	}
+
+	startTime, err := strconv.ParseUint(string(fields[19]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed starttime in stat content: %w", err)
+	}
+
+	return &Stat{
+		Pid:       pid,
+		Comm:      string(data[open+1 : closing]),
+		PPid:      ppid,
+		StartTime: startTime,
+	}, nil
+}
+
+// ReadStat reads the stat file of the process whose /proc/<pid> directory is
+// opened as dirfd.
+func ReadStat(dirfd int) (*Stat, error) {
+	fd, err := unix.Openat(dirfd, "stat", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "stat")
+	defer f.Close()
+
+	buf := make([]byte, 4096)
+	n, err := f.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return ParseStat(buf[:n])
+}
+
+// StatOf reads /proc/<pid>/stat.
+func StatOf(pid int) (*Stat, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	return ParseStat(data)
+}
@@ -0,0 +1,54 @@
+package proc_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/apptainer/apptheus/internal/proc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStat(t *testing.T) {
+	data := []byte("4242 (starter (x) y) S 4200 4242 4200 0 -1 4194560 560 0 0 0 1 2 0 0 20 0 1 0 987654 2412544 343 18446744073709551615 1 1 0 0 0 0 0 4096 0 0 0 0 17 3 0 0 0 0 0\n")
+
+	stat, err := proc.ParseStat(data)
+	require.NoError(t, err)
+	require.Equal(t, 4242, stat.Pid)
+	require.Equal(t, "starter (x) y", stat.Comm)
+	require.Equal(t, 4200, stat.PPid)
+	require.Equal(t, uint64(987654), stat.StartTime)
+
+	_, err = proc.ParseStat([]byte("1 (init) S 0"))
+	require.Error(t, err)
+
+	_, err = proc.ParseStat([]byte("garbage"))
+	require.Error(t, err)
+}
+
+func TestStatOf(t *testing.T) {
+	stat, err := proc.StatOf(os.Getpid())
+	require.NoError(t, err)
+	require.Equal(t, os.Getpid(), stat.Pid)
+	require.Equal(t, os.Getppid(), stat.PPid)
+	require.NotZero(t, stat.StartTime)
+}
+
+func TestAncestors(t *testing.T) {
+	stat, err := proc.StatOf(os.Getpid())
+	require.NoError(t, err)
+
+	ancestors, err := proc.Ancestors(stat)
+	require.NoError(t, err)
+	require.NotEmpty(t, ancestors)
+	require.Equal(t, os.Getppid(), ancestors[0].Pid)
+	for _, a := range ancestors {
+		require.LessOrEqual(t, a.StartTime, stat.StartTime)
+	}
+
+	// a parent gone during the walk makes the chain unreliable
+	orphan := *stat
+	orphan.PPid = 1 << 30
+	ancestors, err = proc.Ancestors(&orphan)
+	require.Error(t, err)
+	require.Empty(t, ancestors)
+}
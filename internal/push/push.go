@@ -5,22 +5,32 @@ package push
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"time"
 
 	"github.com/apptainer/apptheus/internal/storage"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 )
 
 func Push(ms storage.MetricStore, data []byte, labels map[string]string) error {
-	if _, ok := labels["job"]; !ok {
-		return errors.New("job should be set in labels")
-	}
-
-	var parser expfmt.TextParser
-	metricFamilies, err := parser.TextToMetricFamilies(bytes.NewReader(data))
+	metricFamilies, err := Parse(bytes.NewReader(data), "")
 	if err != nil {
 		return err
 	}
+	return Submit(ms, metricFamilies, labels)
+}
+
+// Submit writes the metric families into the group identified by labels. The
+// write request is sanitised and checked for consistency by the store, whose
+// verdict is returned.
+func Submit(ms storage.MetricStore, metricFamilies map[string]*dto.MetricFamily, labels map[string]string) error {
+	if _, ok := labels["job"]; !ok {
+		return errors.New("job should be set in labels")
+	}
 
 	errCh := make(chan error, 1)
 	ms.SubmitWriteRequest(storage.WriteRequest{
@@ -36,3 +46,34 @@ func Push(ms storage.MetricStore, data []byte, labels map[string]string) error {
 	}
 	return nil
 }
+
+// Parse reads metric families in the exposition format given by contentType,
+// the same way the Pushgateway does: length-delimited protobuf if requested,
+// text otherwise.
+func Parse(r io.Reader, contentType string) (map[string]*dto.MetricFamily, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != expfmt.ProtoType ||
+		params["proto"] != expfmt.ProtoProtocol || params["encoding"] != "delimited" {
+		var parser expfmt.TextParser
+		return parser.TextToMetricFamilies(r)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	metricFamilies := map[string]*dto.MetricFamily{}
+	buf := proto.NewBuffer(data)
+	for len(buf.Unread()) != 0 {
+		mf := &dto.MetricFamily{}
+		if err := buf.DecodeMessage(mf); err != nil {
+			return nil, fmt.Errorf("invalid protobuf metric family: %w", err)
+		}
+		if _, ok := metricFamilies[mf.GetName()]; ok {
+			return nil, fmt.Errorf("metric family %q appears more than once", mf.GetName())
+		}
+		metricFamilies[mf.GetName()] = mf
+	}
+	return metricFamilies, nil
+}
@@ -0,0 +1,56 @@
+package push_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/apptainer/apptheus/internal/push"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+const protoContentType = `application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited`
+
+func TestParseText(t *testing.T) {
+	mfs, err := push.Parse(strings.NewReader("# TYPE training_loss gauge\ntraining_loss 0.25\nsteps_total 10\n"), "text/plain; version=0.0.4")
+	require.NoError(t, err)
+	require.Len(t, mfs, 2)
+	require.Equal(t, dto.MetricType_GAUGE, mfs["training_loss"].GetType())
+	require.Equal(t, 0.25, mfs["training_loss"].GetMetric()[0].GetGauge().GetValue())
+
+	// no content type defaults to text
+	_, err = push.Parse(strings.NewReader("invalid metric {\n"), "")
+	require.Error(t, err)
+}
+
+func TestParseProtobuf(t *testing.T) {
+	var buf bytes.Buffer
+	for _, name := range []string{"training_loss", "steps_total"} {
+		mf := &dto.MetricFamily{
+			Name: proto.String(name),
+			Type: dto.MetricType_UNTYPED.Enum(),
+			Metric: []*dto.Metric{
+				{Untyped: &dto.Untyped{Value: proto.Float64(1)}},
+			},
+		}
+		b := proto.NewBuffer(nil)
+		require.NoError(t, b.EncodeMessage(mf))
+		buf.Write(b.Bytes())
+	}
+	data := buf.Bytes()
+
+	mfs, err := push.Parse(bytes.NewReader(data), protoContentType)
+	require.NoError(t, err)
+	require.Len(t, mfs, 2)
+	require.Equal(t, 1.0, mfs["steps_total"].GetMetric()[0].GetUntyped().GetValue())
+
+	// truncated message
+	_, err = push.Parse(bytes.NewReader(data[:len(data)-2]), protoContentType)
+	require.Error(t, err)
+
+	// duplicated family
+	_, err = push.Parse(bytes.NewReader(append(data, data...)), protoContentType)
+	require.Error(t, err)
+}
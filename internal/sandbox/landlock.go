@@ -0,0 +1,161 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package sandbox
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// accessFile are the access rights applying to regular files, the only
+	// ones allowed in a rule on a file rather than a directory.
+	accessFile = unix.LANDLOCK_ACCESS_FS_EXECUTE |
+		unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		unix.LANDLOCK_ACCESS_FS_TRUNCATE
+
+	accessRead = unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_DIR
+
+	accessWrite = accessRead |
+		unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_TRUNCATE
+
+	accessWriteFile = accessRead |
+		unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_TRUNCATE
+)
+
+// handledAccess returns the access rights known by the given Landlock ABI
+// version, all of them are denied unless explicitly allowed by a rule.
+func handledAccess(abi int) uint64 {
+	access := uint64(unix.LANDLOCK_ACCESS_FS_EXECUTE |
+		unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM)
+	if abi >= 2 {
+		access |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		access |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	return access
+}
+
+var enabled = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "apptheus_sandbox_enabled",
+	Help: "Whether apptheus restricted itself with Landlock (1) or runs without sandbox (0).",
+})
+
+func init() {
+	prometheus.MustRegister(enabled)
+}
+
+// Rules lists the paths apptheus is allowed to access once sandboxed, any
+// other path is denied.
+type Rules struct {
+	// ReadWrite paths can be read, written, created and removed beneath.
+	ReadWrite []string
+	// ReadOnly paths can only be read beneath.
+	ReadOnly []string
+	// WriteFile paths can be read and written, but nothing can be created
+	// or removed beneath them, e.g. the cgroup.procs files of the cgroups
+	// the processes are moved back to.
+	WriteFile []string
+}
+
+// Restrict restricts the whole process, all its threads included, with a
+// Landlock ruleset built from rules. Paths which do not exist are skipped. On
+// success, the apptheus_sandbox_enabled metric is set. The returned error
+// wraps errors.ErrUnsupported if the kernel lacks Landlock, or if the Go
+// runtime can't apply it to all threads (cgo builds), in which case the
+// caller should carry on unsandboxed.
+func Restrict(rules Rules) error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return fmt.Errorf("landlock is not available: %w", errno)
+	}
+
+	handled := handledAccess(int(abi))
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("while creating the landlock ruleset: %w", errno)
+	}
+	rulesetFd := int(fd)
+	defer unix.Close(rulesetFd)
+
+	for _, path := range rules.ReadWrite {
+		if err := addRule(rulesetFd, path, accessWrite&handled); err != nil {
+			return err
+		}
+	}
+	for _, path := range rules.ReadOnly {
+		if err := addRule(rulesetFd, path, accessRead&handled); err != nil {
+			return err
+		}
+	}
+	for _, path := range rules.WriteFile {
+		if err := addRule(rulesetFd, path, accessWriteFile&handled); err != nil {
+			return err
+		}
+	}
+
+	// AllThreadsSyscall is what makes the restriction apply to every thread
+	// of the Go runtime, it is not supported when cgo is used.
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		return fmt.Errorf("while setting no_new_privs: %w", errno)
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(rulesetFd), 0, 0); errno != 0 {
+		return fmt.Errorf("while enforcing the landlock ruleset: %w", errno)
+	}
+
+	enabled.Set(1)
+	return nil
+}
+
+func addRule(rulesetFd int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("while opening %s for the landlock ruleset: %w", path, err)
+	}
+	defer unix.Close(fd)
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("while opening %s for the landlock ruleset: %w", path, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= accessFile
+	}
+
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(rulesetFd), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&attr)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("while adding %s to the landlock ruleset: %w", path, errno)
+	}
+	return nil
+}
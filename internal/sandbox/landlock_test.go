@@ -0,0 +1,112 @@
+package sandbox_test
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/apptainer/apptheus/internal/sandbox"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+const helperEnv = "APPTHEUS_SANDBOX_HELPER"
+
+// TestRestrictHelper is run in a subprocess by TestRestrict, as the
+// restriction can't be lifted once applied.
+func TestRestrictHelper(t *testing.T) {
+	dir := os.Getenv(helperEnv)
+	if dir == "" {
+		t.Skip("only run as a helper process")
+	}
+
+	allowed := filepath.Join(dir, "allowed")
+	denied := filepath.Join(dir, "denied")
+	// a cgroup hierarchy, the gateway cgroup being fully writable
+	hierarchy := filepath.Join(dir, "hierarchy")
+	gateway := filepath.Join(hierarchy, "gateway")
+
+	err := sandbox.Restrict(sandbox.Rules{
+		ReadWrite: []string{allowed, gateway},
+		ReadOnly:  []string{"/proc", filepath.Join(dir, "missing")},
+		WriteFile: []string{filepath.Join(hierarchy, "cgroup.procs"), filepath.Join(hierarchy, "user.slice", "cgroup.procs")},
+	})
+	if errors.Is(err, errors.ErrUnsupported) {
+		os.Exit(3)
+	}
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(allowed, "file"), []byte("ok"), 0o600))
+	require.NoError(t, os.Mkdir(filepath.Join(allowed, "dir"), 0o755))
+	require.Error(t, os.WriteFile(filepath.Join(denied, "file"), []byte("ko"), 0o600))
+	_, err = os.ReadDir(denied)
+	require.Error(t, err)
+	_, err = os.ReadFile("/proc/self/stat")
+	require.NoError(t, err)
+
+	// processes are moved back to the cgroups allowed, as
+	// cgroups.WriteCgroupProc opens their cgroup.procs file
+	for _, procs := range []string{filepath.Join(hierarchy, "cgroup.procs"), filepath.Join(hierarchy, "user.slice", "cgroup.procs")} {
+		f, err := os.OpenFile(procs, os.O_WRONLY|os.O_TRUNC, 0)
+		require.NoError(t, err)
+		_, err = f.WriteString("1")
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	// but not to the other cgroups, whose other files can't be written
+	// either
+	require.Error(t, os.WriteFile(filepath.Join(hierarchy, "system.slice", "cgroup.procs"), []byte("1"), 0))
+	require.Error(t, os.WriteFile(filepath.Join(hierarchy, "user.slice", "memory.max"), []byte("0"), 0))
+	require.Error(t, os.WriteFile(filepath.Join(hierarchy, "system.slice", "memory.max"), []byte("0"), 0))
+	// and cgroups are only created and removed below the gateway
+	require.NoError(t, os.Mkdir(filepath.Join(gateway, "container"), 0o755))
+	require.NoError(t, os.Remove(filepath.Join(gateway, "container")))
+	require.Error(t, os.Mkdir(filepath.Join(hierarchy, "user.slice", "other"), 0o755))
+	require.Error(t, os.Remove(filepath.Join(hierarchy, "user.slice", "cgroup.procs")))
+	require.Error(t, os.WriteFile(filepath.Join(hierarchy, "new"), nil, 0o600))
+}
+
+func TestRestrict(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "allowed"), 0o755))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "denied"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "hierarchy", "gateway"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "hierarchy", "user.slice"), 0o755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "hierarchy", "system.slice"), 0o755))
+	for _, procs := range []string{"cgroup.procs", "user.slice/cgroup.procs", "user.slice/memory.max", "system.slice/cgroup.procs", "system.slice/memory.max"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "hierarchy", procs), nil, 0o600))
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRestrictHelper$", "-test.v")
+	cmd.Env = append(os.Environ(), helperEnv+"="+dir)
+	out, err := cmd.CombinedOutput()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 3 {
+		t.Skip("landlock is not supported")
+	}
+	require.NoError(t, err, string(out))
+	require.FileExists(t, filepath.Join(dir, "allowed", "file"))
+	require.NoFileExists(t, filepath.Join(dir, "denied", "file"))
+	require.FileExists(t, filepath.Join(dir, "hierarchy", "user.slice", "cgroup.procs"))
+	require.NoDirExists(t, filepath.Join(dir, "hierarchy", "user.slice", "other"))
+	for _, file := range []string{"system.slice/cgroup.procs", "user.slice/memory.max", "system.slice/memory.max"} {
+		data, err := os.ReadFile(filepath.Join(dir, "hierarchy", file))
+		require.NoError(t, err)
+		require.Empty(t, data)
+	}
+
+	// the parent process is not sandboxed
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	found := false
+	for _, mf := range mfs {
+		if mf.GetName() == "apptheus_sandbox_enabled" {
+			found = true
+			require.Zero(t, mf.GetMetric()[0].GetGauge().GetValue())
+		}
+	}
+	require.True(t, found)
+}
@@ -0,0 +1,370 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-kit/log/level"
+	//nolint:staticcheck // Ignore SA1019. Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// familyIndex tracks the metric families held by the groups, and which groups
+// changed which families since the exposition was last merged. It is guarded
+// by the lock of the DiskMetricStore, every change of the groups going through
+// its methods.
+type familyIndex struct {
+	families map[string]*familyEntry
+	// dirty holds the keys of the groups whose metric family changed since
+	// the last merge, by metric family name.
+	dirty map[string]map[string]struct{}
+	// generation is incremented by every change.
+	generation atomic.Uint64
+	// seq orders the changes of the metric families.
+	seq uint64
+}
+
+// familyEntry is what the groups holding a metric family have in common.
+type familyEntry struct {
+	// typ and help are those of the family last set among the groups
+	// holding it, the help of the latter having priority in the exposition.
+	typ  dto.MetricType
+	help string
+	// groups holds the groups holding the family by key.
+	groups map[string]familyMember
+	// series counts the metrics of the family by the hash of their labels.
+	series map[uint64]int
+}
+
+// familyMember is the metric family as set by a group.
+type familyMember struct {
+	seq  uint64
+	typ  dto.MetricType
+	help string
+}
+
+// others returns the number of groups other than key holding the family.
+func (e *familyEntry) others(key string) int {
+	if _, ok := e.groups[key]; ok {
+		return len(e.groups) - 1
+	}
+	return len(e.groups)
+}
+
+// setMetric sets a metric family of the group, dms.lock must be held for
+// writing.
+func (dms *DiskMetricStore) setMetric(key string, group MetricGroup, name string, tmf TimestampedMetricFamily) {
+	if old, ok := group.Metrics[name]; ok {
+		dms.index.remove(key, name, old.GetMetricFamily())
+	}
+	group.Metrics[name] = tmf
+	dms.index.add(key, name, tmf.GetMetricFamily())
+	dms.changed(name, key)
+}
+
+// deleteMetric removes a metric family of the group, dms.lock must be held for
+// writing.
+func (dms *DiskMetricStore) deleteMetric(key string, group MetricGroup, name string) {
+	old, ok := group.Metrics[name]
+	if !ok {
+		return
+	}
+	delete(group.Metrics, name)
+	dms.index.remove(key, name, old.GetMetricFamily())
+	dms.changed(name, key)
+}
+
+// deleteGroup removes a group, dms.lock must be held for writing.
+func (dms *DiskMetricStore) deleteGroup(key string) {
+	group, ok := dms.metricGroups[key]
+	if !ok {
+		return
+	}
+	for name := range group.Metrics {
+		dms.deleteMetric(key, group, name)
+	}
+	delete(dms.metricGroups, key)
+}
+
+func (dms *DiskMetricStore) changed(name, key string) {
+	keys, ok := dms.index.dirty[name]
+	if !ok {
+		keys = make(map[string]struct{})
+		dms.index.dirty[name] = keys
+	}
+	keys[key] = struct{}{}
+	dms.index.generation.Add(1)
+}
+
+// reindex indexes all the groups once restored, before the store is used.
+func (dms *DiskMetricStore) reindex() {
+	dms.index.families = make(map[string]*familyEntry)
+	dms.index.dirty = make(map[string]map[string]struct{})
+	for key, group := range dms.metricGroups {
+		for name, tmf := range group.Metrics {
+			dms.index.add(key, name, tmf.GetMetricFamily())
+			dms.changed(name, key)
+		}
+	}
+}
+
+// add indexes the metric family of a group.
+func (idx *familyIndex) add(key, name string, mf *dto.MetricFamily) {
+	e, ok := idx.families[name]
+	if !ok {
+		e = &familyEntry{
+			groups: make(map[string]familyMember),
+			series: make(map[uint64]int),
+		}
+		idx.families[name] = e
+	}
+	idx.seq++
+	member := familyMember{seq: idx.seq}
+	if mf != nil {
+		member.typ = mf.GetType()
+		member.help = mf.GetHelp()
+		for _, m := range mf.GetMetric() {
+			e.series[seriesHash(m)]++
+		}
+	}
+	e.groups[key] = member
+	e.typ = member.typ
+	e.help = member.help
+}
+
+// remove removes the metric family of a group from the index, the type and
+// help of the family falling back to those of the group which set it last.
+func (idx *familyIndex) remove(key, name string, mf *dto.MetricFamily) {
+	e, ok := idx.families[name]
+	if !ok {
+		return
+	}
+	removed, ok := e.groups[key]
+	if !ok {
+		return
+	}
+	delete(e.groups, key)
+	if len(e.groups) == 0 {
+		delete(idx.families, name)
+		return
+	}
+	for _, m := range mf.GetMetric() {
+		h := seriesHash(m)
+		if e.series[h]--; e.series[h] <= 0 {
+			delete(e.series, h)
+		}
+	}
+
+	if removed.seq < idx.seq && removed.typ == e.typ && removed.help == e.help {
+		// cheap path, another group set the same type and help later
+		for _, member := range e.groups {
+			if member.seq > removed.seq {
+				return
+			}
+		}
+	}
+	var last familyMember
+	for _, member := range e.groups {
+		if member.seq > last.seq {
+			last = member
+		}
+	}
+	e.typ = last.typ
+	e.help = last.help
+}
+
+// seriesHash hashes the labels of a metric, which are sorted once sanitized.
+func seriesHash(m *dto.Metric) uint64 {
+	h := fnv.New64a()
+	for _, lp := range m.GetLabel() {
+		h.Write([]byte(lp.GetName()))
+		h.Write([]byte{model.SeparatorByte})
+		h.Write([]byte(lp.GetValue()))
+		h.Write([]byte{model.SeparatorByte})
+	}
+	return h.Sum64()
+}
+
+// exposition is the merged exposition of all the groups, as returned by
+// GetMetricFamilies. The metrics of each group are spliced into the merged
+// metric families as the group changes.
+type exposition struct {
+	mu         sync.Mutex
+	generation uint64
+	families   map[string]*mergedFamily
+	// sorted holds the merged families by name, nil once a family is added
+	// or removed.
+	sorted []*mergedFamily
+}
+
+// mergedFamily is a metric family merging the metrics of all the groups
+// holding it, made of a part per group.
+type mergedFamily struct {
+	family *dto.MetricFamily
+	parts  []familyPart
+	// slots holds the index of the part of each group by key.
+	slots map[string]int
+}
+
+// familyPart is the metrics of a group in a merged family, starting at offset
+// in its metrics.
+type familyPart struct {
+	key     string
+	offset  int
+	metrics []*dto.Metric
+}
+
+// familyChange is a metric family as changed by some groups, collected under
+// the lock of the DiskMetricStore and merged once it is released.
+type familyChange struct {
+	name string
+	// exists is false once no group holds the family anymore.
+	exists bool
+	typ    dto.MetricType
+	help   string
+	// groups holds the families of the groups changed by key, nil if
+	// removed.
+	groups map[string]*dto.MetricFamily
+}
+
+// refresh returns a copy of the merged exposition, merging the changes of the
+// groups since the previous call. Only the families of the changed groups are
+// collected while the writers are excluded, they are merged afterwards.
+func (dms *DiskMetricStore) refresh() []*dto.MetricFamily {
+	dms.exposition.mu.Lock()
+	defer dms.exposition.mu.Unlock()
+
+	if dms.index.generation.Load() != dms.exposition.generation {
+		var changes []familyChange
+		dms.lock.RLock()
+		// the dirty groups are only read and reset here, under the
+		// exposition lock, while the writers are excluded
+		dirty := dms.index.dirty
+		dms.index.dirty = make(map[string]map[string]struct{})
+		generation := dms.index.generation.Load()
+		for name, keys := range dirty {
+			change := familyChange{name: name, groups: make(map[string]*dto.MetricFamily, len(keys))}
+			if e, ok := dms.index.families[name]; ok {
+				change.exists, change.typ, change.help = true, e.typ, e.help
+			}
+			for key := range keys {
+				tmf, ok := dms.metricGroups[key].Metrics[name]
+				if ok && tmf.GetMetricFamily() == nil {
+					level.Warn(dms.logger).Log("msg", "storage corruption detected, consider wiping the persistence file")
+				}
+				change.groups[key] = tmf.GetMetricFamily()
+			}
+			changes = append(changes, change)
+		}
+		dms.lock.RUnlock()
+
+		for _, change := range changes {
+			dms.splice(change)
+		}
+		dms.exposition.generation = generation
+	}
+
+	if dms.exposition.sorted == nil {
+		sorted := make([]*mergedFamily, 0, len(dms.exposition.families))
+		for _, mf := range dms.exposition.families {
+			sorted = append(sorted, mf)
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].family.GetName() < sorted[j].family.GetName() })
+		dms.exposition.sorted = sorted
+	}
+
+	// the merged families are changed in place by the next refresh
+	result := make([]*dto.MetricFamily, 0, len(dms.exposition.sorted))
+	for _, mf := range dms.exposition.sorted {
+		result = append(result, copyMetricFamily(mf.family))
+	}
+	return result
+}
+
+// splice replaces the metrics of the changed groups in their merged family,
+// dms.exposition.mu must be held.
+func (dms *DiskMetricStore) splice(change familyChange) {
+	if dms.exposition.families == nil {
+		dms.exposition.families = make(map[string]*mergedFamily)
+	}
+	merged, ok := dms.exposition.families[change.name]
+	if !change.exists {
+		if ok {
+			delete(dms.exposition.families, change.name)
+			dms.exposition.sorted = nil
+		}
+		return
+	}
+	if !ok {
+		merged = &mergedFamily{
+			family: &dto.MetricFamily{Name: proto.String(change.name)},
+			slots:  make(map[string]int),
+		}
+		dms.exposition.families[change.name] = merged
+		dms.exposition.sorted = nil
+	}
+
+	help := change.help
+	if predefined, ok := dms.predefinedHelp[change.name]; ok && help != predefined {
+		level.Info(dms.logger).Log("msg", "metric families overlap", "err", "Metric family has the same name as a metric family used by the Pushgateway itself but it has a different help string. Changing it to the standard help string. This is bad. Fix your pushed metrics!", "metric_family", change.name, "help", help, "standard_help", predefined)
+		help = predefined
+	}
+	merged.family.Help = nil
+	if help != "" {
+		merged.family.Help = proto.String(help)
+	}
+	merged.family.Type = change.typ.Enum()
+
+	// the parts of the same size are replaced in place, any other change
+	// lays the metrics out again
+	layout := false
+	for key, mf := range change.groups {
+		if mf != nil && mf.GetHelp() != change.help {
+			level.Info(dms.logger).Log("msg", "metric families inconsistent help strings", "err", "Metric families have inconsistent help strings. The latter will have priority. This is bad. Fix your pushed metrics!", "new", change.help, "old", mf)
+		}
+		// Type inconsistency cannot be fixed here. We will detect it during
+		// gathering anyway, so no reason to log anything here.
+		slot, ok := merged.slots[key]
+		switch {
+		case mf == nil && ok:
+			last := len(merged.parts) - 1
+			merged.parts[slot] = merged.parts[last]
+			merged.slots[merged.parts[slot].key] = slot
+			merged.parts = merged.parts[:last]
+			delete(merged.slots, key)
+			layout = true
+		case mf == nil:
+		case ok && len(mf.Metric) == len(merged.parts[slot].metrics) && !layout:
+			part := &merged.parts[slot]
+			part.metrics = mf.Metric
+			copy(merged.family.Metric[part.offset:], part.metrics)
+		case ok:
+			merged.parts[slot].metrics = mf.Metric
+			layout = true
+		default:
+			merged.slots[key] = len(merged.parts)
+			merged.parts = append(merged.parts, familyPart{key: key, metrics: mf.Metric})
+			layout = true
+		}
+	}
+	if !layout {
+		return
+	}
+	previous := merged.family.Metric
+	metrics := previous[:0]
+	for i := range merged.parts {
+		merged.parts[i].offset = len(metrics)
+		metrics = append(metrics, merged.parts[i].metrics...)
+	}
+	if len(metrics) < len(previous) {
+		// drop the references to the metrics removed
+		clear(previous[len(metrics):])
+	}
+	merged.family.Metric = metrics
+}
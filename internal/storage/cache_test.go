@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/testutil"
+	"github.com/go-kit/log"
+	//nolint:staticcheck // Ignore SA1019. Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpositionCache(t *testing.T) {
+	dms := NewDiskMetricStore("", time.Hour, nil, log.NewNopLogger())
+	t.Cleanup(func() { dms.Shutdown() })
+
+	job1 := map[string]string{"job": "job1"}
+	job2 := map[string]string{"job": "job2"}
+	ts := time.Now()
+	submit(t, dms, WriteRequest{Labels: job1, Timestamp: ts, MetricFamilies: testutil.MetricFamiliesMap(mf3)})
+	submit(t, dms, WriteRequest{Labels: job2, Timestamp: ts, MetricFamilies: testutil.MetricFamiliesMap(mf4)})
+
+	require.Equal(t, map[string]int{"mf3": 1, "mf4": 1, pushMetricName: 2, pushFailedMetricName: 2}, metricCounts(dms))
+	generation := dms.exposition.generation
+	require.Empty(t, dms.index.dirty)
+
+	// nothing changed, the cached exposition is kept
+	first := dms.GetMetricFamilies()
+	require.Equal(t, generation, dms.exposition.generation)
+	// the callers get their own copies
+	first[0].Metric = nil
+	require.NotEqual(t, first[0].GetMetric(), dms.GetMetricFamilies()[0].GetMetric())
+
+	// only the metrics of the groups changed are spliced, in place
+	ts2 := ts.Add(time.Minute)
+	pushed := dms.exposition.families[pushMetricName]
+	job2Pushed := pushed.family.Metric[pushed.parts[pushed.slots[groupingKeyFor(job2)]].offset]
+	unchanged := dms.exposition.families[mf4.GetName()].family.Metric[0]
+	submit(t, dms, WriteRequest{Labels: job1, Timestamp: ts2, MetricFamilies: testutil.MetricFamiliesMap(mf3)})
+	require.ElementsMatch(t, []string{mf3.GetName(), pushMetricName}, keys(dms.index.dirty))
+	require.ElementsMatch(t, []string{groupingKeyFor(job1)}, keys(dms.index.dirty[pushMetricName]))
+	require.Equal(t, map[string]int{"mf3": 1, "mf4": 1, pushMetricName: 2, pushFailedMetricName: 2}, metricCounts(dms))
+	require.Same(t, pushed, dms.exposition.families[pushMetricName])
+	require.Contains(t, pushed.family.Metric, job2Pushed)
+	require.Same(t, unchanged, dms.exposition.families[mf4.GetName()].family.Metric[0])
+
+	// deleting a group removes the families no other group holds
+	submit(t, dms, WriteRequest{Labels: job2})
+	require.NoError(t, checkMetricFamilies(dms, mf3,
+		newPushTimestampGauge(job1, ts2), newPushFailedTimestampGauge(job1, time.Time{}),
+	))
+	require.NotContains(t, dms.index.families, mf4.GetName())
+	require.Greater(t, dms.exposition.generation, generation)
+}
+
+// metricCounts returns the number of metrics of each metric family exposed.
+func metricCounts(dms *DiskMetricStore) map[string]int {
+	counts := map[string]int{}
+	for _, mf := range dms.GetMetricFamilies() {
+		counts[mf.GetName()] = len(mf.GetMetric())
+	}
+	return counts
+}
+
+func keys[V any](m map[string]V) []string {
+	var result []string
+	for k := range m {
+		result = append(result, k)
+	}
+	return result
+}
+
+func TestExpositionHelpAfterDelete(t *testing.T) {
+	dms := NewDiskMetricStore("", time.Hour, nil, log.NewNopLogger())
+	t.Cleanup(func() { dms.Shutdown() })
+
+	job1 := map[string]string{"job": "job1"}
+	job2 := map[string]string{"job": "job2"}
+	mf1 := newFamily("requests", dto.MetricType_COUNTER, "instance", "a")
+	mf2 := newFamily("requests", dto.MetricType_COUNTER, "instance", "b")
+	mf2.Help = proto.String("other help")
+	require.NoError(t, push(dms, job1, false, mf1))
+	require.NoError(t, push(dms, job2, false, mf2))
+	require.Equal(t, "other help", familyHelp(dms, "requests"))
+
+	// the help falls back to the one of the group left
+	submit(t, dms, WriteRequest{Labels: job2})
+	require.Equal(t, mf1.GetHelp(), dms.index.families["requests"].help)
+	require.Equal(t, mf1.GetHelp(), familyHelp(dms, "requests"))
+	require.Equal(t, map[string]int{"requests": 1, pushMetricName: 1, pushFailedMetricName: 1}, metricCounts(dms))
+}
+
+// familyHelp returns the help of a metric family exposed.
+func familyHelp(dms *DiskMetricStore, name string) string {
+	for _, mf := range dms.GetMetricFamilies() {
+		if mf.GetName() == name {
+			return mf.GetHelp()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,168 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	//nolint:staticcheck // Ignore SA1019. Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// predefinedFamily is a metric family of apptheus itself, as gathered once
+// when the store is created.
+type predefinedFamily struct {
+	typ    dto.MetricType
+	series map[uint64]struct{}
+}
+
+// checkConsistency returns why applying wr would make the exposition
+// inconsistent, nil if it would not. Only the metric families of wr are
+// checked, on their own, against the other groups through the index and
+// against the metrics of apptheus itself as gathered once, so that the cost of
+// a push does not grow with the number of groups nor involve gathering. It is
+// only called by the loop, the only writer of the metric groups.
+func (dms *DiskMetricStore) checkConsistency(wr WriteRequest) error {
+	key := groupingKeyFor(wr.Labels)
+	group, exists := dms.metricGroups[key]
+
+	// typeAfter returns the type of a metric family once wr is applied.
+	typeAfter := func(name string) (dto.MetricType, bool) {
+		if mf, ok := wr.MetricFamilies[name]; ok {
+			return mf.GetType(), true
+		}
+		e, ok := dms.index.families[name]
+		if !ok {
+			p, ok := dms.predefined[name]
+			return p.typ, ok
+		}
+		if e.others(key) > 0 {
+			return e.typ, true
+		}
+		// the family is only held by the group itself, kept unless
+		// replaced
+		if tmf, ok := group.Metrics[name]; exists && ok && (!wr.Replace || name == pushMetricName || name == pushFailedMetricName) {
+			return tmf.GetMetricFamily().GetType(), true
+		}
+		return 0, false
+	}
+
+	var errs prometheus.MultiError
+	pushed := make([]*dto.MetricFamily, 0, len(wr.MetricFamilies))
+	for name, mf := range wr.MetricFamilies {
+		if name == pushMetricName {
+			// replaced by the push timestamp
+			continue
+		}
+		if help, ok := dms.predefinedHelp[name]; ok && mf.GetHelp() != help {
+			mf = copyMetricFamily(mf)
+			mf.Help = proto.String(help)
+		}
+		pushed = append(pushed, mf)
+
+		if err := checkSuffixCollisions(name, mf.GetType(), typeAfter); err != nil {
+			errs.Append(err)
+			continue
+		}
+		if p, ok := dms.predefined[name]; ok {
+			if err := checkPredefined(name, mf, p); err != nil {
+				errs.Append(err)
+				continue
+			}
+		}
+		e, ok := dms.index.families[name]
+		if !ok || e.others(key) == 0 {
+			continue
+		}
+		if e.typ != mf.GetType() {
+			errs.Append(fmt.Errorf(
+				"gathered metric family %s has type %s but should have %s",
+				name, mf.GetType(), e.typ,
+			))
+			continue
+		}
+		// the metrics of the group are replaced by those pushed
+		own := map[uint64]int{}
+		if exists {
+			for _, m := range group.Metrics[name].GetMetricFamily().GetMetric() {
+				own[seriesHash(m)]++
+			}
+		}
+		for _, m := range mf.GetMetric() {
+			h := seriesHash(m)
+			if e.series[h]-own[h] > 0 {
+				errs.Append(fmt.Errorf(
+					"collected metric %q { %s} was collected before with the same name and label values",
+					name, m,
+				))
+			}
+		}
+	}
+	if len(errs) != 0 {
+		return errs
+	}
+
+	// Check the pushed metric families on their own.
+	tg := prometheus.Gatherers{
+		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return pushed, nil
+		}),
+	}
+	_, err := tg.Gather()
+	return err
+}
+
+// checkPredefined checks a pushed metric family against the metric family of
+// apptheus itself with the same name.
+func checkPredefined(name string, mf *dto.MetricFamily, p predefinedFamily) error {
+	if p.typ != mf.GetType() {
+		return fmt.Errorf(
+			"gathered metric family %s has type %s but should have %s",
+			name, mf.GetType(), p.typ,
+		)
+	}
+	for _, m := range mf.GetMetric() {
+		if _, ok := p.series[seriesHash(m)]; ok {
+			return fmt.Errorf(
+				"collected metric %q { %s} was collected before with the same name and label values",
+				name, m,
+			)
+		}
+	}
+	return nil
+}
+
+// checkSuffixCollisions checks, as the Gatherers do, for collisions with the
+// suffixes added while flattening summaries and histograms, typeOf returning
+// the type of the other metric families.
+func checkSuffixCollisions(name string, typ dto.MetricType, typeOf func(string) (dto.MetricType, bool)) error {
+	for _, suffix := range []string{"_count", "_sum", "_bucket"} {
+		base, ok := strings.CutSuffix(name, suffix)
+		if !ok {
+			continue
+		}
+		baseType, ok := typeOf(base)
+		switch {
+		case ok && baseType == dto.MetricType_SUMMARY && suffix != "_bucket":
+			return fmt.Errorf("collected metric named %q collides with previously collected summary named %q", name, base)
+		case ok && baseType == dto.MetricType_HISTOGRAM:
+			return fmt.Errorf("collected metric named %q collides with previously collected histogram named %q", name, base)
+		}
+	}
+	if typ != dto.MetricType_SUMMARY && typ != dto.MetricType_HISTOGRAM {
+		return nil
+	}
+	suffixes := []string{"_count", "_sum"}
+	if typ == dto.MetricType_HISTOGRAM {
+		suffixes = append(suffixes, "_bucket")
+	}
+	for _, suffix := range suffixes {
+		if _, ok := typeOf(name + suffix); ok {
+			return fmt.Errorf("collected histogram or summary named %q collides with previously collected metric named %q", name, name+suffix)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	//nolint:staticcheck // Ignore SA1019. Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func newFamily(name string, typ dto.MetricType, labels ...string) *dto.MetricFamily {
+	mf := &dto.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String("help of " + name),
+		Type: typ.Enum(),
+	}
+	m := &dto.Metric{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		m.Label = append(m.Label, &dto.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+	}
+	switch typ {
+	case dto.MetricType_GAUGE:
+		m.Gauge = &dto.Gauge{Value: proto.Float64(1)}
+	case dto.MetricType_COUNTER:
+		m.Counter = &dto.Counter{Value: proto.Float64(1)}
+	case dto.MetricType_SUMMARY:
+		m.Summary = &dto.Summary{SampleCount: proto.Uint64(1), SampleSum: proto.Float64(1)}
+	default:
+		m.Untyped = &dto.Untyped{Value: proto.Float64(1)}
+	}
+	mf.Metric = append(mf.Metric, m)
+	return mf
+}
+
+func push(dms *DiskMetricStore, labels map[string]string, replace bool, mfs ...*dto.MetricFamily) error {
+	families := map[string]*dto.MetricFamily{}
+	for _, mf := range mfs {
+		families[mf.GetName()] = mf
+	}
+	done := make(chan error, 1)
+	dms.SubmitWriteRequest(WriteRequest{
+		Labels:         labels,
+		Timestamp:      time.Now(),
+		MetricFamilies: families,
+		Replace:        replace,
+		Done:           done,
+	})
+	return <-done
+}
+
+func TestCheckConsistency(t *testing.T) {
+	dms := NewDiskMetricStore("", time.Hour, prometheus.DefaultGatherer, log.NewNopLogger())
+	t.Cleanup(func() { dms.Shutdown() })
+
+	job1 := map[string]string{"job": "job1"}
+	job2 := map[string]string{"job": "job2"}
+	require.NoError(t, push(dms, job1, false, newFamily("requests", dto.MetricType_COUNTER), newFamily("latency", dto.MetricType_SUMMARY)))
+
+	// the type is set by the other groups
+	require.ErrorContains(t, push(dms, job2, false, newFamily("requests", dto.MetricType_GAUGE)), "has type GAUGE but should have COUNTER")
+	require.NoError(t, push(dms, job2, false, newFamily("requests", dto.MetricType_COUNTER)))
+	// but a group alone holding a family may change its type
+	require.NoError(t, push(dms, job1, false, newFamily("latency", dto.MetricType_GAUGE)))
+
+	// a metric of another group with the same labels
+	instance := map[string]string{"job": "job1", "instance": "a"}
+	require.NoError(t, push(dms, instance, false, newFamily("requests", dto.MetricType_COUNTER)))
+	require.ErrorContains(t, push(dms, job1, false, newFamily("requests", dto.MetricType_COUNTER, "instance", "a")), "was collected before")
+	// the metrics of the group itself are replaced
+	require.NoError(t, push(dms, instance, false, newFamily("requests", dto.MetricType_COUNTER)))
+
+	// the suffixes of the summaries
+	require.NoError(t, push(dms, job1, false, newFamily("duration", dto.MetricType_SUMMARY)))
+	require.ErrorContains(t, push(dms, job2, false, newFamily("duration_count", dto.MetricType_GAUGE)), "collides with previously collected summary")
+	require.ErrorContains(t, push(dms, job2, false, newFamily("requests_count", dto.MetricType_GAUGE), newFamily("requests", dto.MetricType_SUMMARY)), "collides")
+	require.ErrorContains(t, push(dms, job1, false, newFamily("latency_sum", dto.MetricType_GAUGE), newFamily("latency", dto.MetricType_SUMMARY)), "collides")
+	// unless replaced
+	require.NoError(t, push(dms, job1, true, newFamily("duration_count", dto.MetricType_GAUGE)))
+
+	// the metrics of the Pushgateway itself
+	require.ErrorContains(t, push(dms, job1, false, newFamily("go_goroutines", dto.MetricType_COUNTER)), "go_goroutines")
+}
+
+// gatherCounter counts how many times it is collected.
+type gatherCounter struct {
+	desc  *prometheus.Desc
+	count atomic.Int32
+}
+
+func (c *gatherCounter) Describe(ch chan<- *prometheus.Desc) { ch <- c.desc }
+
+func (c *gatherCounter) Collect(ch chan<- prometheus.Metric) {
+	c.count.Add(1)
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, 1)
+}
+
+func TestCheckConsistencyGathersOnce(t *testing.T) {
+	counter := &gatherCounter{desc: prometheus.NewDesc("test_gather_counter", "Counts the gatherings.", nil, nil)}
+	prometheus.MustRegister(counter)
+	t.Cleanup(func() { prometheus.Unregister(counter) })
+
+	dms := NewDiskMetricStore("", time.Hour, prometheus.DefaultGatherer, log.NewNopLogger())
+	t.Cleanup(func() { dms.Shutdown() })
+	gathered := counter.count.Load()
+
+	job := map[string]string{"job": "job1"}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, push(dms, job, true, newFamily("requests", dto.MetricType_COUNTER)))
+	}
+	// the metrics of apptheus itself are still checked
+	require.ErrorContains(t, push(dms, job, false, newFamily("test_gather_counter", dto.MetricType_COUNTER)), "should have GAUGE")
+	require.Equal(t, gathered, counter.count.Load())
+}
+
+// benchmarkGroups is the number of groups of the benchmarks, e.g. one per
+// container monitored.
+const benchmarkGroups = 1000
+
+// newBenchmarkStore returns a store holding benchmarkGroups groups of a few
+// metric families each.
+func newBenchmarkStore(b *testing.B) *DiskMetricStore {
+	dms := NewDiskMetricStore("", time.Hour, prometheus.DefaultGatherer, log.NewNopLogger())
+	b.Cleanup(func() { dms.Shutdown() })
+	for i := 0; i < benchmarkGroups; i++ {
+		if err := push(dms, benchmarkLabels(i), true, benchmarkFamilies()...); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return dms
+}
+
+func benchmarkLabels(i int) map[string]string {
+	return map[string]string{"job": "apptheus", "instance": fmt.Sprintf("container-%d", i)}
+}
+
+func benchmarkFamilies() []*dto.MetricFamily {
+	return []*dto.MetricFamily{
+		newFamily("cpu_usage", dto.MetricType_GAUGE),
+		newFamily("memory_usage", dto.MetricType_GAUGE),
+		newFamily("io_read_bytes", dto.MetricType_COUNTER),
+		newFamily("io_write_bytes", dto.MetricType_COUNTER),
+		newFamily("pids", dto.MetricType_GAUGE),
+	}
+}
+
+func BenchmarkPush(b *testing.B) {
+	dms := newBenchmarkStore(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := push(dms, benchmarkLabels(i%benchmarkGroups), true, benchmarkFamilies()...); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetMetricFamilies(b *testing.B) {
+	dms := newBenchmarkStore(b)
+
+	b.Run("unchanged", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			dms.GetMetricFamilies()
+		}
+	})
+	b.Run("changed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			if err := push(dms, benchmarkLabels(i%benchmarkGroups), true, newFamily("pids", dto.MetricType_GAUGE)); err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+			dms.GetMetricFamilies()
+		}
+	})
+}
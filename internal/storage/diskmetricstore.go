@@ -17,7 +17,7 @@
 package storage
 
 import (
-	"encoding/gob"
+	"bufio"
 	"errors"
 	"fmt"
 	"os"
@@ -58,12 +58,54 @@ type DiskMetricStore struct {
 	metricGroups    GroupingKeyToMetricGroup
 	persistenceFile string
 	predefinedHelp  map[string]string
-	logger          log.Logger
+	// predefined holds the metric families of the default gatherer as
+	// gathered once, which the pushed ones are checked against.
+	predefined map[string]predefinedFamily
+	logger     log.Logger
+	// compress compresses the persistence file.
+	compress bool
+	// walSync is how often the write-ahead log is synced, zero if it is
+	// disabled. wal is nil if disabled or if it could not be opened.
+	walSync time.Duration
+	wal     *wal
+	// walCompact is the size of the log beyond which the snapshot is
+	// persisted right away.
+	walCompact int64
+	// staleness sets what happens to the groups not pushed for a while.
+	staleness Staleness
+	// index tracks the changes of the groups, so that exposition only merges
+	// again the metric families changed since the previous scrape.
+	index      familyIndex
+	exposition exposition
 }
 
-type mfStat struct {
-	pos    int  // Where in the result slice is the MetricFamily?
-	copied bool // Has the MetricFamily already been copied?
+// Option configures a DiskMetricStore.
+type Option func(*DiskMetricStore)
+
+// WithWAL appends every write to a write-ahead log next to the persistence
+// file, synced every syncInterval, so that a crash only loses the writes since
+// the last sync instead of since the last persisting. The log is compacted
+// into the persistence file whenever it is persisted.
+func WithWAL(syncInterval time.Duration) Option {
+	return func(dms *DiskMetricStore) {
+		dms.walSync = syncInterval
+	}
+}
+
+// withWALCompactSize sets the size of the log beyond which the snapshot is
+// persisted right away.
+func withWALCompactSize(size int64) Option {
+	return func(dms *DiskMetricStore) {
+		dms.walCompact = size
+	}
+}
+
+// WithCompression compresses the persistence file with gzip. Files are read
+// whether they are compressed or not.
+func WithCompression() Option {
+	return func(dms *DiskMetricStore) {
+		dms.compress = true
+	}
 }
 
 // NewDiskMetricStore returns a DiskMetricStore ready to use. To cleanly shut it
@@ -84,6 +126,7 @@ func NewDiskMetricStore(
 	persistenceInterval time.Duration,
 	gatherPredefinedHelpFrom prometheus.Gatherer,
 	logger log.Logger,
+	opts ...Option,
 ) *DiskMetricStore {
 	// TODO: Do that outside of the constructor to allow the HTTP server to
 	//  serve /-/healthy and /-/ready earlier.
@@ -94,15 +137,30 @@ func NewDiskMetricStore(
 		metricGroups:    GroupingKeyToMetricGroup{},
 		persistenceFile: persistenceFile,
 		logger:          logger,
+		walCompact:      walCompactSize,
+	}
+	for _, opt := range opts {
+		opt(dms)
 	}
 	if err := dms.restore(); err != nil {
 		level.Error(logger).Log("msg", "could not load persisted metrics", "err", err)
 	}
+	if dms.walSync > 0 && persistenceFile != "" {
+		dms.openWAL()
+	}
+	dms.reindex()
 	if helpStrings, err := extractPredefinedHelpStrings(gatherPredefinedHelpFrom); err == nil {
 		dms.predefinedHelp = helpStrings
 	} else {
 		level.Error(logger).Log("msg", "could not gather metrics for predefined help strings", "err", err)
 	}
+	// the pushed metrics can't collide with the metrics of apptheus itself,
+	// which are only gathered once rather than on every push
+	if families, err := extractPredefinedFamilies(prometheus.DefaultGatherer); err == nil {
+		dms.predefined = families
+	} else {
+		level.Error(logger).Log("msg", "could not gather metrics for predefined metric families", "err", err)
+	}
 
 	go dms.loop(persistenceInterval)
 	return dms
@@ -139,55 +197,11 @@ func (dms *DiskMetricStore) Ready() error {
 	return dms.Healthy()
 }
 
-// GetMetricFamilies implements the MetricStore interface.
+// GetMetricFamilies implements the MetricStore interface. The merged metric
+// families are cached, only the metrics of the groups changed since the
+// previous call being merged again.
 func (dms *DiskMetricStore) GetMetricFamilies() []*dto.MetricFamily {
-	dms.lock.RLock()
-	defer dms.lock.RUnlock()
-
-	result := []*dto.MetricFamily{}
-	mfStatByName := map[string]mfStat{}
-
-	for _, group := range dms.metricGroups {
-		for name, tmf := range group.Metrics {
-			mf := tmf.GetMetricFamily()
-			if mf == nil {
-				level.Warn(dms.logger).Log("msg", "storage corruption detected, consider wiping the persistence file")
-				continue
-			}
-			stat, exists := mfStatByName[name]
-			if exists {
-				existingMF := result[stat.pos]
-				if !stat.copied {
-					mfStatByName[name] = mfStat{
-						pos:    stat.pos,
-						copied: true,
-					}
-					existingMF = copyMetricFamily(existingMF)
-					result[stat.pos] = existingMF
-				}
-				if mf.GetHelp() != existingMF.GetHelp() {
-					level.Info(dms.logger).Log("msg", "metric families inconsistent help strings", "err", "Metric families have inconsistent help strings. The latter will have priority. This is bad. Fix your pushed metrics!", "new", mf, "old", existingMF)
-				}
-				// Type inconsistency cannot be fixed here. We will detect it during
-				// gathering anyway, so no reason to log anything here.
-				existingMF.Metric = append(existingMF.Metric, mf.Metric...)
-			} else {
-				copied := false
-				if help, ok := dms.predefinedHelp[name]; ok && mf.GetHelp() != help {
-					level.Info(dms.logger).Log("msg", "metric families overlap", "err", "Metric family has the same name as a metric family used by the Pushgateway itself but it has a different help string. Changing it to the standard help string. This is bad. Fix your pushed metrics!", "metric_family", mf, "standard_help", help)
-					mf = copyMetricFamily(mf)
-					copied = true
-					mf.Help = proto.String(help)
-				}
-				mfStatByName[name] = mfStat{
-					pos:    len(result),
-					copied: copied,
-				}
-				result = append(result, mf)
-			}
-		}
-	}
-	return result
+	return dms.refresh()
 }
 
 // GetMetricFamiliesMap implements the MetricStore interface.
@@ -212,10 +226,36 @@ func (dms *DiskMetricStore) loop(persistenceInterval time.Duration) {
 	persistDone := make(chan time.Time)
 	var persistTimer *time.Timer
 
+	var syncTick <-chan time.Time
+	if dms.wal != nil {
+		ticker := time.NewTicker(dms.walSync)
+		defer ticker.Stop()
+		syncTick = ticker.C
+	}
+	var sweepTick <-chan time.Time
+	if dms.staleness.enabled() {
+		ticker := time.NewTicker(dms.staleness.sweepInterval())
+		defer ticker.Stop()
+		sweepTick = ticker.C
+	}
+
+	walFull := func() bool {
+		return dms.wal != nil && dms.wal.segmentSize() >= dms.walCompact
+	}
 	checkPersist := func() {
+		if persistScheduled && walFull() && persistTimer.Stop() {
+			// The log outgrew the threshold while the persisting was
+			// pending, compact it now.
+			persistTimer.Reset(0)
+			return
+		}
 		if dms.persistenceFile != "" && !persistScheduled && lastWrite.After(lastPersist) {
+			delay := persistenceInterval - lastWrite.Sub(lastPersist)
+			if walFull() {
+				delay = 0
+			}
 			persistTimer = time.AfterFunc(
-				persistenceInterval-lastWrite.Sub(lastPersist),
+				delay,
 				func() {
 					persistStarted := time.Now()
 					if err := dms.persist(); err != nil {
@@ -239,6 +279,7 @@ func (dms *DiskMetricStore) loop(persistenceInterval time.Duration) {
 			} else {
 				dms.setPushFailedTimestamp(wr)
 			}
+			dms.logWrite(wr)
 			if wr.Done != nil {
 				close(wr.Done)
 			}
@@ -246,6 +287,15 @@ func (dms *DiskMetricStore) loop(persistenceInterval time.Duration) {
 		case lastPersist = <-persistDone:
 			persistScheduled = false
 			checkPersist() // In case something has been written in the meantime.
+		case now := <-sweepTick:
+			if dms.sweepStale(now) {
+				lastWrite = now
+				checkPersist()
+			}
+		case <-syncTick:
+			if err := dms.wal.sync(); err != nil {
+				level.Error(dms.logger).Log("msg", "error syncing the write-ahead log", "err", err)
+			}
 		case <-dms.drain:
 			// Prevent a scheduled persist from firing later.
 			if persistTimer != nil {
@@ -260,8 +310,17 @@ func (dms *DiskMetricStore) loop(persistenceInterval time.Duration) {
 					} else {
 						dms.setPushFailedTimestamp(wr)
 					}
+					dms.logWrite(wr)
 				default:
-					dms.done <- dms.persist()
+					err := dms.persist()
+					if dms.wal != nil {
+						// the log is only needed if the snapshot
+						// could not be persisted
+						if walErr := dms.wal.close(err == nil); walErr != nil {
+							level.Error(dms.logger).Log("msg", "error closing the write-ahead log", "err", walErr)
+						}
+					}
+					dms.done <- err
 					return
 				}
 			}
@@ -269,6 +328,47 @@ func (dms *DiskMetricStore) loop(persistenceInterval time.Duration) {
 	}
 }
 
+// openWAL replays the write-ahead log left by the previous run on top of the
+// restored snapshot and starts a new segment. The metric store works without
+// log if it can't be opened.
+func (dms *DiskMetricStore) openWAL() {
+	replayed, err := replayWAL(dms.persistenceFile, dms.metricGroups)
+	if err != nil {
+		level.Error(dms.logger).Log("msg", "could not replay the whole write-ahead log", "err", err, "replayed", replayed)
+	} else if replayed != 0 {
+		level.Info(dms.logger).Log("msg", "write-ahead log replayed", "replayed", replayed)
+	}
+
+	l, err := openWAL(dms.persistenceFile)
+	if err != nil {
+		level.Error(dms.logger).Log("msg", "could not open the write-ahead log, writes are only persisted periodically", "err", err)
+		return
+	}
+	dms.wal = l
+}
+
+// logWrite appends the state of the group changed by wr to the write-ahead
+// log.
+func (dms *DiskMetricStore) logWrite(wr WriteRequest) {
+	dms.logGroup(wr.Labels)
+}
+
+// logGroup appends the state of the group with the given grouping labels to
+// the write-ahead log. It is only called by the loop, the only writer of the
+// metric groups.
+func (dms *DiskMetricStore) logGroup(labels map[string]string) {
+	if dms.wal == nil {
+		return
+	}
+	var group *MetricGroup
+	if g, ok := dms.metricGroups[groupingKeyFor(labels)]; ok {
+		group = &g
+	}
+	if err := dms.wal.append(labels, group); err != nil {
+		level.Error(dms.logger).Log("msg", "error appending to the write-ahead log", "err", err)
+	}
+}
+
 func (dms *DiskMetricStore) processWriteRequest(wr WriteRequest) {
 	dms.lock.Lock()
 	defer dms.lock.Unlock()
@@ -278,7 +378,7 @@ func (dms *DiskMetricStore) processWriteRequest(wr WriteRequest) {
 	if wr.MetricFamilies == nil {
 		// No MetricFamilies means delete request. Delete the whole
 		// metric group, and we are done here.
-		delete(dms.metricGroups, key)
+		dms.deleteGroup(key)
 		return
 	}
 	// Otherwise, it's an update.
@@ -294,10 +394,12 @@ func (dms *DiskMetricStore) processWriteRequest(wr WriteRequest) {
 		// group except pre-existing push timestamps.
 		for name := range group.Metrics {
 			if name != pushMetricName && name != pushFailedMetricName {
-				delete(group.Metrics, name)
+				dms.deleteMetric(key, group, name)
 			}
 		}
 	}
+	// The group is pushed again, so it is not stale anymore.
+	dms.deleteMetric(key, group, StaleMetricName)
 	wr.MetricFamilies[pushMetricName] = newPushTimestampGauge(wr.Labels, wr.Timestamp)
 	// Only add a zero push-failed metric if none is there yet, so that a
 	// previously added fail timestamp is retained.
@@ -305,10 +407,10 @@ func (dms *DiskMetricStore) processWriteRequest(wr WriteRequest) {
 		wr.MetricFamilies[pushFailedMetricName] = newPushFailedTimestampGauge(wr.Labels, time.Time{})
 	}
 	for name, mf := range wr.MetricFamilies {
-		group.Metrics[name] = TimestampedMetricFamily{
+		dms.setMetric(key, group, name, TimestampedMetricFamily{
 			Timestamp:            wr.Timestamp,
 			GobbableMetricFamily: (*GobbableMetricFamily)(mf),
-		}
+		})
 	}
 }
 
@@ -327,17 +429,18 @@ func (dms *DiskMetricStore) setPushFailedTimestamp(wr WriteRequest) {
 		dms.metricGroups[key] = group
 	}
 
-	group.Metrics[pushFailedMetricName] = TimestampedMetricFamily{
+	dms.deleteMetric(key, group, StaleMetricName)
+	dms.setMetric(key, group, pushFailedMetricName, TimestampedMetricFamily{
 		Timestamp:            wr.Timestamp,
 		GobbableMetricFamily: (*GobbableMetricFamily)(newPushFailedTimestampGauge(wr.Labels, wr.Timestamp)),
-	}
+	})
 	// Only add a zero push metric if none is there yet, so that a
 	// previously added push timestamp is retained.
 	if _, ok := group.Metrics[pushMetricName]; !ok {
-		group.Metrics[pushMetricName] = TimestampedMetricFamily{
+		dms.setMetric(key, group, pushMetricName, TimestampedMetricFamily{
 			Timestamp:            wr.Timestamp,
 			GobbableMetricFamily: (*GobbableMetricFamily)(newPushTimestampGauge(wr.Labels, time.Time{})),
-		}
+		})
 	}
 }
 
@@ -347,8 +450,8 @@ func (dms *DiskMetricStore) setPushFailedTimestamp(wr WriteRequest) {
 // contain the grouping Labels after the check. If false is returned, the
 // causing error is written to the Done channel of the WriteRequest.
 //
-// Special case: If the WriteRequest has no Done channel set, the (expensive)
-// consistency check is skipped. The WriteRequest is still sanitized, and the
+// Special case: If the WriteRequest has no Done channel set, the consistency
+// check is skipped. The WriteRequest is still sanitized, and the
 // presence of timestamps still results in returning false.
 func (dms *DiskMetricStore) checkWriteRequest(wr WriteRequest) bool {
 	if wr.MetricFamilies == nil {
@@ -377,26 +480,8 @@ func (dms *DiskMetricStore) checkWriteRequest(wr WriteRequest) bool {
 		return true
 	}
 
-	// Construct a test dms, acting on a copy of the metrics, to test the
-	// WriteRequest with.
-	tdms := &DiskMetricStore{
-		metricGroups:   dms.GetMetricFamiliesMap(),
-		predefinedHelp: dms.predefinedHelp,
-		logger:         log.NewNopLogger(),
-	}
-	tdms.processWriteRequest(wr)
-
-	// Construct a test Gatherer to check if consistent gathering is possible.
-	tg := prometheus.Gatherers{
-		prometheus.DefaultGatherer,
-		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
-			return tdms.GetMetricFamilies(), nil
-		}),
-	}
-	if _, err = tg.Gather(); err != nil {
-		return false
-	}
-	return true
+	err = dms.checkConsistency(wr)
+	return err == nil
 }
 
 func (dms *DiskMetricStore) persist() error {
@@ -413,11 +498,25 @@ func (dms *DiskMetricStore) persist() error {
 		return err
 	}
 	inProgressFileName := f.Name()
-	e := gob.NewEncoder(f)
+	w := bufio.NewWriter(f)
 
+	// the entries of the former segments are all included in the
+	// snapshot, as the groups are logged once changed
+	var seq uint64
 	dms.lock.RLock()
-	err = e.Encode(dms.metricGroups)
+	if dms.wal != nil {
+		seq, err = dms.wal.rotate()
+	}
+	if err == nil {
+		err = writeGroups(w, dms.metricGroups, dms.compress)
+	}
 	dms.lock.RUnlock()
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
 	if err != nil {
 		f.Close()
 		os.Remove(inProgressFileName)
@@ -427,9 +526,17 @@ func (dms *DiskMetricStore) persist() error {
 		os.Remove(inProgressFileName)
 		return err
 	}
-	return os.Rename(inProgressFileName, dms.persistenceFile)
+	if err := os.Rename(inProgressFileName, dms.persistenceFile); err != nil {
+		return err
+	}
+	if dms.wal != nil {
+		return dms.wal.removeBefore(seq)
+	}
+	return nil
 }
 
+// restore loads the persisted metrics. The corrupt groups are skipped, and
+// the groups read before an unrecoverable error are kept.
 func (dms *DiskMetricStore) restore() error {
 	if dms.persistenceFile == "" {
 		return nil
@@ -442,9 +549,22 @@ func (dms *DiskMetricStore) restore() error {
 		return err
 	}
 	defer f.Close()
-	d := gob.NewDecoder(f)
 
-	return d.Decode(&dms.metricGroups)
+	result, err := readGroups(f)
+	if result == nil {
+		return err
+	}
+	dms.metricGroups = result.groups
+	if result.legacy {
+		level.Info(dms.logger).Log("msg", "persistence file in the former format, it is migrated when next persisted", "file", dms.persistenceFile)
+	}
+	if result.skipped != 0 {
+		level.Warn(dms.logger).Log("msg", "skipped corrupt metric groups in the persistence file", "file", dms.persistenceFile, "skipped", result.skipped, "restored", len(result.groups))
+	}
+	if err != nil {
+		return fmt.Errorf("%w, %d metric groups restored", err, len(result.groups))
+	}
+	return nil
 }
 
 func copyMetricFamily(mf *dto.MetricFamily) *dto.MetricFamily {
@@ -501,6 +621,25 @@ func extractPredefinedHelpStrings(g prometheus.Gatherer) (map[string]string, err
 	return result, nil
 }
 
+// extractPredefinedFamilies extracts the types and series of the metric
+// families of the provided gatherer, so that the pushed metrics are checked
+// against them without gathering again.
+func extractPredefinedFamilies(g prometheus.Gatherer) (map[string]predefinedFamily, error) {
+	mfs, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]predefinedFamily{}
+	for _, mf := range mfs {
+		family := predefinedFamily{typ: mf.GetType(), series: make(map[uint64]struct{}, len(mf.GetMetric()))}
+		for _, m := range mf.GetMetric() {
+			family.series[seriesHash(m)] = struct{}{}
+		}
+		result[mf.GetName()] = family
+	}
+	return result, nil
+}
+
 func newPushTimestampGauge(groupingLabels map[string]string, t time.Time) *dto.MetricFamily {
 	return newTimestampGauge(pushMetricName, pushMetricHelp, groupingLabels, t)
 }
@@ -662,6 +662,7 @@ func TestGetMetricFamilies(t *testing.T) {
 	)
 
 	dms := &DiskMetricStore{metricGroups: mg}
+	dms.reindex()
 
 	if err := checkMetricFamilies(dms, mf1acd, mf2, mf3, mf4); err != nil {
 		t.Error(err)
@@ -0,0 +1,199 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// The persistence file starts with a header made of persistenceMagic, the
+// format version and its flags, all the integers being big endian:
+//
+//	magic   [8]byte
+//	version uint16
+//	flags   uint16
+//
+// It is followed by a record per metric group, compressed with gzip if
+// flagCompressed is set, and a last record of length zero:
+//
+//	length   uint32
+//	checksum uint32, CRC-32C of the payload
+//	payload  [length]byte, the gob encoded MetricGroup
+//
+// Each group being encoded and checksummed on its own, a corrupt group is
+// skipped without losing the others. The files without header are written by
+// the former versions, which gob encoded the whole GroupingKeyToMetricGroup.
+const (
+	persistenceVersion = 1
+	flagCompressed     = 1 << 0
+	// maxRecordSize bounds the size of a group, beyond which the record
+	// length is considered corrupt.
+	maxRecordSize = 64 << 20
+)
+
+var (
+	persistenceMagic = [8]byte{'A', 'P', 'P', 'T', 'H', 'E', 'U', 'S'}
+	crcTable         = crc32.MakeTable(crc32.Castagnoli)
+)
+
+var errTruncated = errors.New("persistence file is truncated")
+
+// restoreResult reports what has been read from a persistence file.
+type restoreResult struct {
+	groups GroupingKeyToMetricGroup
+	// skipped is the number of corrupt groups skipped.
+	skipped int
+	// legacy is set for the files written by the former versions.
+	legacy bool
+}
+
+// writeGroups writes the groups in the current persistence format.
+func writeGroups(w io.Writer, groups GroupingKeyToMetricGroup, compress bool) error {
+	var flags uint16
+	if compress {
+		flags |= flagCompressed
+	}
+	header := make([]byte, len(persistenceMagic)+4)
+	copy(header, persistenceMagic[:])
+	binary.BigEndian.PutUint16(header[8:], persistenceVersion)
+	binary.BigEndian.PutUint16(header[10:], flags)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	body := w
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(w)
+		body = zw
+	}
+
+	var payload bytes.Buffer
+	for _, group := range groups {
+		payload.Reset()
+		if err := gob.NewEncoder(&payload).Encode(group); err != nil {
+			return err
+		}
+		if err := writeRecord(body, payload.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := writeRecord(body, nil); err != nil {
+		return err
+	}
+
+	if zw != nil {
+		return zw.Close()
+	}
+	return nil
+}
+
+func writeRecord(w io.Writer, payload []byte) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], crc32.Checksum(payload, crcTable))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readGroups reads the groups of a persistence file of any version. When an
+// error is returned along a result, the groups read before the error are
+// still usable.
+func readGroups(r io.ReadSeeker) (*restoreResult, error) {
+	result := &restoreResult{groups: GroupingKeyToMetricGroup{}}
+
+	br := bufio.NewReader(r)
+	header := make([]byte, len(persistenceMagic)+4)
+	n, err := io.ReadFull(br, header)
+	if n < len(persistenceMagic) || !bytes.Equal(header[:len(persistenceMagic)], persistenceMagic[:]) {
+		return readLegacyGroups(r)
+	}
+	if err != nil {
+		return nil, errTruncated
+	}
+
+	version := binary.BigEndian.Uint16(header[8:])
+	flags := binary.BigEndian.Uint16(header[10:])
+	if version != persistenceVersion {
+		return nil, fmt.Errorf("unsupported persistence format version %d", version)
+	}
+
+	body := io.Reader(br)
+	if flags&flagCompressed != 0 {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		body = zr
+	}
+
+	for {
+		payload, ok, err := readRecord(body)
+		if err != nil {
+			return result, err
+		}
+		if payload == nil {
+			return result, nil
+		}
+		if !ok {
+			result.skipped++
+			continue
+		}
+
+		var group MetricGroup
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&group); err != nil {
+			result.skipped++
+			continue
+		}
+		if group.Metrics == nil {
+			group.Metrics = NameToTimestampedMetricFamilyMap{}
+		}
+		result.groups[groupingKeyFor(group.Labels)] = group
+	}
+}
+
+// readRecord returns the payload of the next record and whether its checksum
+// matches, or a nil payload for the last record.
+func readRecord(r io.Reader) ([]byte, bool, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, false, errTruncated
+	}
+	length := binary.BigEndian.Uint32(header[0:])
+	if length == 0 {
+		return nil, true, nil
+	}
+	if length > maxRecordSize {
+		return nil, false, fmt.Errorf("corrupt persistence record of %d bytes", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, false, errTruncated
+	}
+	return payload, crc32.Checksum(payload, crcTable) == binary.BigEndian.Uint32(header[4:]), nil
+}
+
+// readLegacyGroups reads a file written by the former versions, the whole
+// file being lost if it is corrupt.
+func readLegacyGroups(r io.ReadSeeker) (*restoreResult, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	result := &restoreResult{groups: GroupingKeyToMetricGroup{}, legacy: true}
+	if err := gob.NewDecoder(r).Decode(&result.groups); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func testGroups() GroupingKeyToMetricGroup {
+	groups := GroupingKeyToMetricGroup{}
+	for _, job := range []string{"job1", "job2", "job3"} {
+		labels := map[string]string{"job": job}
+		groups[groupingKeyFor(labels)] = MetricGroup{
+			Labels: labels,
+			Metrics: NameToTimestampedMetricFamilyMap{
+				pushMetricName: {
+					Timestamp:            time.Unix(1700000000, 0),
+					GobbableMetricFamily: (*GobbableMetricFamily)(newPushTimestampGauge(labels, time.Unix(1700000000, 0))),
+				},
+			},
+		}
+	}
+	return groups
+}
+
+func TestPersistenceFormat(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		require.NoError(t, writeGroups(&buf, testGroups(), compress))
+		require.True(t, bytes.HasPrefix(buf.Bytes(), persistenceMagic[:]))
+
+		result, err := readGroups(bytes.NewReader(buf.Bytes()))
+		require.NoError(t, err)
+		require.False(t, result.legacy)
+		require.Zero(t, result.skipped)
+		require.Len(t, result.groups, 3)
+		for key, group := range testGroups() {
+			require.Equal(t, group.Labels, result.groups[key].Labels)
+			require.Equal(t, group.Metrics[pushMetricName].GetMetricFamily().String(), result.groups[key].Metrics[pushMetricName].GetMetricFamily().String())
+		}
+
+		// a truncated file keeps the groups read before the truncation
+		result, err = readGroups(bytes.NewReader(buf.Bytes()[:buf.Len()-12]))
+		require.ErrorIs(t, err, errTruncated)
+		require.NotNil(t, result)
+		if !compress {
+			require.Len(t, result.groups, 2)
+		}
+	}
+
+	// unknown versions are not loaded
+	var buf bytes.Buffer
+	require.NoError(t, writeGroups(&buf, testGroups(), false))
+	data := buf.Bytes()
+	data[9] = 2
+	_, err := readGroups(bytes.NewReader(data))
+	require.ErrorContains(t, err, "unsupported persistence format version 2")
+}
+
+func TestPersistenceCorruptGroup(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, writeGroups(&buf, testGroups(), false))
+	data := buf.Bytes()
+
+	// corrupt the payload of the first record, right after the header
+	data[len(persistenceMagic)+4+8+10] ^= 0xff
+	result, err := readGroups(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, 1, result.skipped)
+	require.Len(t, result.groups, 2)
+}
+
+func TestPersistenceMigration(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "persistence")
+	f, err := os.Create(fileName)
+	require.NoError(t, err)
+	require.NoError(t, gob.NewEncoder(f).Encode(testGroups()))
+	require.NoError(t, f.Close())
+
+	// the former format is read, and replaced once persisted
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, log.NewNopLogger(), WithCompression())
+	require.Len(t, dms.GetMetricFamiliesMap(), 3)
+	require.NoError(t, dms.Shutdown())
+
+	data, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	require.True(t, bytes.HasPrefix(data, persistenceMagic[:]))
+	require.Equal(t, byte(flagCompressed), data[11])
+
+	dms = NewDiskMetricStore(fileName, time.Hour, nil, log.NewNopLogger())
+	require.Len(t, dms.GetMetricFamiliesMap(), 3)
+	require.NoError(t, dms.Shutdown())
+}
@@ -0,0 +1,146 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-kit/log/level"
+	//nolint:staticcheck // Ignore SA1019. Dependencies use the deprecated package, so we have to, too.
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// StaleMetricName is added to the groups not pushed for a while.
+	StaleMetricName = "apptheus_group_stale"
+	staleMetricHelp = "Set on the groups which have not been pushed for a while, they are removed unless pushed again."
+
+	// maxSweepInterval bounds the interval between two sweeps of the stale
+	// groups.
+	maxSweepInterval = time.Minute
+)
+
+// Staleness sets what happens to the groups which have not been pushed for a
+// while, e.g. those of a container whose monitoring ended on an error.
+type Staleness struct {
+	// MarkAfter marks a group as stale, with an apptheus_group_stale gauge,
+	// once it has not been pushed for this long. Zero disables it.
+	MarkAfter time.Duration
+	// RemoveAfter removes a group once it has not been pushed for this
+	// long. Zero disables it.
+	RemoveAfter time.Duration
+}
+
+func (s Staleness) enabled() bool {
+	return s.MarkAfter > 0 || s.RemoveAfter > 0
+}
+
+// Check returns an error if a threshold is not longer than interval, the
+// longest time between two pushes of a group still written to, which would
+// mark or remove it while it is alive.
+func (s Staleness) Check(interval time.Duration) error {
+	if s.MarkAfter > 0 && s.MarkAfter <= interval {
+		return fmt.Errorf("groups marked stale after %s while pushed every %s", s.MarkAfter, interval)
+	}
+	if s.RemoveAfter > 0 && s.RemoveAfter <= interval {
+		return fmt.Errorf("groups removed after %s while pushed every %s", s.RemoveAfter, interval)
+	}
+	return nil
+}
+
+// sweepInterval returns how often the groups are checked, a fraction of the
+// shortest threshold.
+func (s Staleness) sweepInterval() time.Duration {
+	interval := maxSweepInterval
+	for _, threshold := range []time.Duration{s.MarkAfter, s.RemoveAfter} {
+		if threshold > 0 && threshold/4 < interval {
+			interval = threshold / 4
+		}
+	}
+	return interval
+}
+
+// WithStaleness marks and removes the groups which have not been pushed for a
+// while, as set by s.
+func WithStaleness(s Staleness) Option {
+	return func(dms *DiskMetricStore) {
+		dms.staleness = s
+	}
+}
+
+// sweepStale marks or removes the stale groups, reporting whether any changed.
+// It is only called by the loop, the changed groups are appended to the
+// write-ahead log.
+func (dms *DiskMetricStore) sweepStale(now time.Time) bool {
+	var changed []map[string]string
+
+	dms.lock.Lock()
+	for key, group := range dms.metricGroups {
+		last := lastPush(group)
+		if last.IsZero() {
+			continue
+		}
+		age := now.Sub(last)
+
+		if dms.staleness.RemoveAfter > 0 && age >= dms.staleness.RemoveAfter {
+			dms.deleteGroup(key)
+			changed = append(changed, group.Labels)
+			level.Info(dms.logger).Log("msg", "stale group removed", "job", group.Labels["job"], "last_push", last)
+			continue
+		}
+		if _, ok := group.Metrics[StaleMetricName]; ok {
+			continue
+		}
+		if dms.staleness.MarkAfter > 0 && age >= dms.staleness.MarkAfter {
+			dms.setMetric(key, group, StaleMetricName, TimestampedMetricFamily{
+				Timestamp:            now,
+				GobbableMetricFamily: (*GobbableMetricFamily)(newStaleGauge(group.Labels)),
+			})
+			changed = append(changed, group.Labels)
+		}
+	}
+	dms.lock.Unlock()
+
+	for _, labels := range changed {
+		dms.logGroup(labels)
+	}
+	return len(changed) != 0
+}
+
+// lastPush returns the time of the last push into the group, successful or
+// not, zero if unknown.
+func lastPush(group MetricGroup) time.Time {
+	var last float64
+	for _, name := range []string{pushMetricName, pushFailedMetricName} {
+		mf := group.Metrics[name].GetMetricFamily()
+		if mf == nil || len(mf.GetMetric()) == 0 {
+			continue
+		}
+		if v := mf.GetMetric()[0].GetGauge().GetValue(); v > last {
+			last = v
+		}
+	}
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(last*1e9))
+}
+
+func newStaleGauge(groupingLabels map[string]string) *dto.MetricFamily {
+	mf := &dto.MetricFamily{
+		Name: proto.String(StaleMetricName),
+		Help: proto.String(staleMetricHelp),
+		Type: dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{
+			{
+				Gauge: &dto.Gauge{
+					Value: proto.Float64(1),
+				},
+			},
+		},
+	}
+	sanitizeLabels(mf, groupingLabels)
+	return mf
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/testutil"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaleness(t *testing.T) {
+	require.Equal(t, time.Minute, Staleness{RemoveAfter: time.Hour}.sweepInterval())
+	require.Equal(t, 15*time.Second, Staleness{MarkAfter: time.Minute, RemoveAfter: time.Hour}.sweepInterval())
+	require.False(t, Staleness{}.enabled())
+	require.NoError(t, Staleness{MarkAfter: time.Minute}.Check(30*time.Second))
+	require.Error(t, Staleness{MarkAfter: time.Minute}.Check(time.Minute))
+	require.Error(t, Staleness{MarkAfter: time.Hour, RemoveAfter: time.Second}.Check(30*time.Second))
+
+	dms := NewDiskMetricStore("", time.Hour, nil, log.NewNopLogger(), WithStaleness(Staleness{MarkAfter: time.Minute, RemoveAfter: time.Hour}))
+	t.Cleanup(func() { dms.Shutdown() })
+
+	job1 := map[string]string{"job": "job1"}
+	job2 := map[string]string{"job": "job2"}
+	now := time.Now()
+	submit(t, dms, WriteRequest{Labels: job1, Timestamp: now.Add(-2 * time.Minute), MetricFamilies: testutil.MetricFamiliesMap(mf3)})
+	submit(t, dms, WriteRequest{Labels: job2, Timestamp: now, MetricFamilies: testutil.MetricFamiliesMap(mf4)})
+
+	require.True(t, dms.sweepStale(now))
+	groups := dms.GetMetricFamiliesMap()
+	require.Contains(t, groups[groupingKeyFor(job1)].Metrics, StaleMetricName)
+	require.NotContains(t, groups[groupingKeyFor(job2)].Metrics, StaleMetricName)
+	require.False(t, dms.sweepStale(now))
+
+	// pushing again makes the group fresh
+	submit(t, dms, WriteRequest{Labels: job1, Timestamp: now, MetricFamilies: testutil.MetricFamiliesMap(mf3)})
+	require.NotContains(t, dms.GetMetricFamiliesMap()[groupingKeyFor(job1)].Metrics, StaleMetricName)
+
+	// then removed
+	require.True(t, dms.sweepStale(now.Add(time.Hour+time.Second)))
+	require.Empty(t, dms.GetMetricFamiliesMap())
+}
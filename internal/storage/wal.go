@@ -0,0 +1,301 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The write-ahead log is made of segment files next to the persistence file,
+// <persistence file>.wal.<sequence>. A segment starts with walMagic and the
+// format version, followed by records framed as in the persistence file, each
+// holding a walEntry. The entries of a segment are a single gob stream, the
+// types being only described in the first records, so a segment has to be
+// replayed from its start. Every entry carries the whole state of a group
+// after a write, so that replaying an entry already included in the snapshot
+// is harmless. Persisting the snapshot starts a new segment and removes the
+// former ones once the snapshot is written.
+const (
+	walVersion = 2
+	// walVersionRecordStreams is the former format, where every record is a
+	// gob stream of its own.
+	walVersionRecordStreams = 1
+	walSuffix               = ".wal."
+	// walCompactSize is the size of the log beyond which the snapshot is
+	// persisted right away, compacting the log.
+	walCompactSize = 64 << 20
+)
+
+var walMagic = [8]byte{'A', 'P', 'T', 'H', 'W', 'A', 'L', 0}
+
+// walEntry is the state of a group after a write, Group being nil if it has
+// been deleted.
+type walEntry struct {
+	Labels map[string]string
+	Group  *MetricGroup
+}
+
+// wal appends the writes to the current segment. All its methods are safe to
+// be called concurrently.
+type wal struct {
+	mu      sync.Mutex
+	prefix  string
+	seq     uint64
+	file    *os.File
+	w       *bufio.Writer
+	size    int64
+	payload bytes.Buffer
+	enc     *gob.Encoder
+}
+
+// openWAL starts a new segment after the existing ones of the persistence
+// file.
+func openWAL(persistenceFile string) (*wal, error) {
+	l := &wal{prefix: persistenceFile + walSuffix}
+	segments, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) != 0 {
+		l.seq = segments[len(segments)-1]
+	}
+	if err := l.startSegment(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// segments returns the sequences of the existing segments, in order.
+func (l *wal) segments() ([]uint64, error) {
+	paths, err := filepath.Glob(l.prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, path := range paths {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(path, l.prefix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func (l *wal) path(seq uint64) string {
+	return fmt.Sprintf("%s%08d", l.prefix, seq)
+}
+
+// startSegment closes the current segment and starts the next one, l.mu must
+// be held.
+func (l *wal) startSegment() error {
+	if l.file != nil {
+		if err := l.syncLocked(); err != nil {
+			return err
+		}
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+		l.file = nil
+	}
+
+	f, err := os.OpenFile(l.path(l.seq+1), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, len(walMagic)+2)
+	copy(header, walMagic[:])
+	binary.BigEndian.PutUint16(header[len(walMagic):], walVersion)
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return err
+	}
+
+	l.seq++
+	l.file = f
+	l.w = bufio.NewWriter(f)
+	l.size = int64(len(header))
+	l.payload.Reset()
+	l.enc = gob.NewEncoder(&l.payload)
+	return nil
+}
+
+// append logs the state of a group, deleted if group is nil.
+func (l *wal) append(labels map[string]string, group *MetricGroup) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.payload.Reset()
+	if err := l.enc.Encode(walEntry{Labels: labels, Group: group}); err != nil {
+		return err
+	}
+	if err := writeRecord(l.w, l.payload.Bytes()); err != nil {
+		return err
+	}
+	l.size += int64(8 + l.payload.Len())
+	return nil
+}
+
+// sync makes the entries appended so far durable.
+func (l *wal) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.syncLocked()
+}
+
+func (l *wal) syncLocked() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// segmentSize returns the size of the current segment.
+func (l *wal) segmentSize() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size
+}
+
+// rotate starts a new segment, returning its sequence: the segments before it
+// can be removed once a snapshot including their entries is persisted.
+func (l *wal) rotate() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.startSegment(); err != nil {
+		return 0, err
+	}
+	return l.seq, nil
+}
+
+// removeBefore removes the segments before seq.
+func (l *wal) removeBefore(seq uint64) error {
+	segments, err := l.segments()
+	if err != nil {
+		return err
+	}
+	var errs error
+	for _, s := range segments {
+		if s < seq {
+			if err := os.Remove(l.path(s)); err != nil && !os.IsNotExist(err) {
+				errs = errors.Join(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+// close syncs and closes the current segment, removing all the segments if
+// the snapshot has just been persisted.
+func (l *wal) close(compacted bool) error {
+	l.mu.Lock()
+	err := l.syncLocked()
+	err = errors.Join(err, l.file.Close())
+	seq := l.seq
+	l.mu.Unlock()
+
+	if compacted {
+		err = errors.Join(err, l.removeBefore(seq+1))
+	}
+	return err
+}
+
+// replayWAL applies the entries of the existing segments of the persistence
+// file to groups, in order. A segment is replayed up to its first corrupt or
+// truncated record, i.e. up to its last sync. It returns the number of entries
+// replayed.
+func replayWAL(persistenceFile string, groups GroupingKeyToMetricGroup) (int, error) {
+	l := &wal{prefix: persistenceFile + walSuffix}
+	segments, err := l.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	var errs error
+	for _, seq := range segments {
+		n, err := replaySegment(l.path(seq), groups)
+		replayed += n
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("segment %d: %w", seq, err))
+		}
+	}
+	return replayed, errs
+}
+
+func replaySegment(path string, groups GroupingKeyToMetricGroup) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, len(walMagic)+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		// the segment was just created
+		return 0, nil
+	}
+	if !bytes.Equal(header[:len(walMagic)], walMagic[:]) {
+		return 0, errors.New("not a write-ahead log segment")
+	}
+	version := binary.BigEndian.Uint16(header[len(walMagic):])
+	if version != walVersion && version != walVersionRecordStreams {
+		return 0, fmt.Errorf("unsupported write-ahead log version %d", version)
+	}
+
+	// the records are fed one at a time to the decoder of the segment, which
+	// doesn't read ahead of them as a bytes.Buffer is an io.ByteReader
+	var stream bytes.Buffer
+	dec := gob.NewDecoder(&stream)
+	replayed := 0
+	for {
+		payload, ok, err := readRecord(r)
+		if errors.Is(err, errTruncated) {
+			// the records not synced before a crash
+			return replayed, nil
+		}
+		if err != nil {
+			return replayed, err
+		}
+		if payload == nil {
+			return replayed, nil
+		}
+		if !ok {
+			return replayed, errors.New("corrupt record")
+		}
+
+		if version == walVersionRecordStreams {
+			dec = gob.NewDecoder(&stream)
+		}
+		stream.Reset()
+		stream.Write(payload)
+		var entry walEntry
+		if err := dec.Decode(&entry); err != nil {
+			return replayed, err
+		}
+		key := groupingKeyFor(entry.Labels)
+		if entry.Group == nil {
+			delete(groups, key)
+		} else {
+			if entry.Group.Metrics == nil {
+				entry.Group.Metrics = NameToTimestampedMetricFamilyMap{}
+			}
+			groups[key] = *entry.Group
+		}
+		replayed++
+	}
+}
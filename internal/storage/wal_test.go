@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/testutil"
+	"github.com/go-kit/log"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+// copyState copies the persistence file and the write-ahead log to a new
+// directory, as left by a crash.
+func copyState(t *testing.T, fileName string) string {
+	dir := t.TempDir()
+	paths, err := filepath.Glob(fileName + "*")
+	require.NoError(t, err)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, filepath.Base(path)), data, 0o644))
+	}
+	return filepath.Join(dir, filepath.Base(fileName))
+}
+
+func submit(t *testing.T, dms *DiskMetricStore, wr WriteRequest) {
+	wr.Done = make(chan error, 1)
+	dms.SubmitWriteRequest(wr)
+	for err := range wr.Done {
+		require.NoError(t, err)
+	}
+}
+
+func TestWAL(t *testing.T) {
+	logger := log.NewNopLogger()
+	fileName := filepath.Join(t.TempDir(), "persistence")
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, logger, WithWAL(time.Hour))
+	require.NotNil(t, dms.wal)
+
+	job1 := map[string]string{"job": "job1"}
+	job2 := map[string]string{"job": "job2"}
+	submit(t, dms, WriteRequest{Labels: job1, Timestamp: time.Now(), MetricFamilies: testutil.MetricFamiliesMap(mf3)})
+	submit(t, dms, WriteRequest{Labels: job2, Timestamp: time.Now(), MetricFamilies: testutil.MetricFamiliesMap(mf4)})
+	submit(t, dms, WriteRequest{Labels: job1, Timestamp: time.Now()})
+
+	// the synced writes are replayed after a crash
+	require.NoError(t, dms.wal.sync())
+	crashed := NewDiskMetricStore(copyState(t, fileName), time.Hour, nil, logger, WithWAL(time.Hour))
+	groups := crashed.GetMetricFamiliesMap()
+	require.Len(t, groups, 1)
+	require.Contains(t, groups, groupingKeyFor(job2))
+	require.Contains(t, groups[groupingKeyFor(job2)].Metrics, mf4.GetName())
+	require.NoError(t, crashed.Shutdown())
+
+	// a record partially written is ignored
+	copied := copyState(t, fileName)
+	segment := fmt.Sprintf("%s%s%08d", copied, walSuffix, dms.wal.seq)
+	info, err := os.Stat(segment)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(segment, info.Size()-3))
+	crashed = NewDiskMetricStore(copied, time.Hour, nil, logger, WithWAL(time.Hour))
+	require.Len(t, crashed.GetMetricFamiliesMap(), 2)
+	require.NoError(t, crashed.Shutdown())
+
+	// the log is compacted into the snapshot
+	require.NoError(t, dms.persist())
+	segments, err := dms.wal.segments()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{dms.wal.seq}, segments)
+
+	submit(t, dms, WriteRequest{Labels: job1, Timestamp: time.Now(), MetricFamilies: testutil.MetricFamiliesMap(mf3)})
+	require.NoError(t, dms.wal.sync())
+	crashed = NewDiskMetricStore(copyState(t, fileName), time.Hour, nil, logger, WithWAL(time.Hour))
+	require.Len(t, crashed.GetMetricFamiliesMap(), 2)
+	require.NoError(t, crashed.Shutdown())
+
+	// nothing is left to replay after a clean shutdown
+	require.NoError(t, dms.Shutdown())
+	paths, err := filepath.Glob(fileName + walSuffix + "*")
+	require.NoError(t, err)
+	require.Empty(t, paths)
+	dms = NewDiskMetricStore(fileName, time.Hour, nil, logger)
+	require.Len(t, dms.GetMetricFamiliesMap(), 2)
+	require.NoError(t, dms.Shutdown())
+}
+
+func TestWALCompact(t *testing.T) {
+	const compactSize = 4096
+	fileName := filepath.Join(t.TempDir(), "persistence")
+	dms := NewDiskMetricStore(fileName, time.Hour, nil, log.NewNopLogger(), WithWAL(time.Hour), withWALCompactSize(compactSize))
+	t.Cleanup(func() { dms.Shutdown() })
+
+	// the persisting is scheduled in an hour
+	submit(t, dms, WriteRequest{Labels: map[string]string{"job": "job1"}, Timestamp: time.Now(), MetricFamilies: testutil.MetricFamiliesMap(mf3)})
+	require.Less(t, dms.wal.segmentSize(), int64(compactSize))
+	require.NoFileExists(t, fileName)
+
+	// until the log outgrows the threshold
+	mf := newFamily("requests", dto.MetricType_COUNTER)
+	for i := 0; i < 100; i++ {
+		mf.Metric = append(mf.Metric, newFamily("requests", dto.MetricType_COUNTER, "instance", fmt.Sprint(i)).Metric...)
+	}
+	submit(t, dms, WriteRequest{Labels: map[string]string{"job": "job2"}, Timestamp: time.Now(), MetricFamilies: testutil.MetricFamiliesMap(mf)})
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(fileName)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		segments, err := dms.wal.segments()
+		return err == nil && len(segments) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Less(t, dms.wal.segmentSize(), int64(compactSize))
+}
+
+func TestWALStream(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openWAL(filepath.Join(dir, "persistence"))
+	require.NoError(t, err)
+
+	// the types are only described in the first record of a segment
+	labels := map[string]string{"job": "job1"}
+	group := &MetricGroup{Metrics: NameToTimestampedMetricFamilyMap{}}
+	require.NoError(t, l.append(labels, group))
+	first := l.segmentSize()
+	require.NoError(t, l.append(labels, group))
+	require.Less(t, l.segmentSize()-first, first)
+
+	_, err = l.rotate()
+	require.NoError(t, err)
+	require.NoError(t, l.append(labels, group))
+	require.Equal(t, first, l.segmentSize())
+	require.NoError(t, l.close(false))
+
+	groups := GroupingKeyToMetricGroup{}
+	replayed, err := replayWAL(filepath.Join(dir, "persistence"), groups)
+	require.NoError(t, err)
+	require.Equal(t, 3, replayed)
+	require.Contains(t, groups, groupingKeyFor(labels))
+}
+
+func TestWALRecordStreams(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "persistence")
+
+	// a segment left by the former format, every record being encoded on its
+	// own
+	var segment bytes.Buffer
+	segment.Write(walMagic[:])
+	binary.Write(&segment, binary.BigEndian, uint16(walVersionRecordStreams))
+	for _, entry := range []walEntry{
+		{Labels: map[string]string{"job": "job1"}, Group: &MetricGroup{}},
+		{Labels: map[string]string{"job": "job2"}, Group: &MetricGroup{}},
+		{Labels: map[string]string{"job": "job1"}},
+	} {
+		var payload bytes.Buffer
+		require.NoError(t, gob.NewEncoder(&payload).Encode(entry))
+		require.NoError(t, writeRecord(&segment, payload.Bytes()))
+	}
+	require.NoError(t, os.WriteFile(fmt.Sprintf("%s%s%08d", fileName, walSuffix, 1), segment.Bytes(), 0o600))
+
+	groups := GroupingKeyToMetricGroup{}
+	replayed, err := replayWAL(fileName, groups)
+	require.NoError(t, err)
+	require.Equal(t, 3, replayed)
+	require.Len(t, groups, 1)
+	require.Contains(t, groups, groupingKeyFor(map[string]string{"job": "job2"}))
+}
@@ -3,14 +3,63 @@
 package util
 
 import (
-	"os/user"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
 )
 
-func IsRoot() (bool, error) {
-	u, err := user.Current()
-	if err != nil {
-		return false, err
+// CheckPermissions verifies that the current process has the permissions
+// apptheus needs, instead of requiring it to run as root. The cgroup
+// directories must be writable (or creatable), as well as the cgroup.procs
+// file of the hierarchy roots: on cgroup v2, moving a process needs write
+// access to the cgroup.procs file of the common ancestor of its source and
+// destination cgroups, which is the hierarchy root for the processes started
+// outside the cgroup root. /proc entries of other processes must be readable,
+// which requires either root or CAP_SYS_PTRACE.
+func CheckPermissions(cgroupPaths, hierarchyRoots []string) error {
+	var retErr error
+	for _, path := range cgroupPaths {
+		if err := CheckWritable(path); err != nil {
+			retErr = errors.Join(retErr, fmt.Errorf("cgroup %s: %w", path, err))
+		}
+	}
+	for _, root := range hierarchyRoots {
+		procs := filepath.Join(root, "cgroup.procs")
+		if err := unix.Faccessat(unix.AT_FDCWD, procs, unix.W_OK, unix.AT_EACCESS); err != nil {
+			retErr = errors.Join(retErr, fmt.Errorf("moving processes between cgroups needs write access to %s: %w", procs, err))
+		}
+	}
+
+	// readlink on /proc/<pid>/exe of a process owned by another user needs
+	// the same permissions as the ones needed for verifying callers. pid 1
+	// is always there and usually owned by root.
+	buf := make([]byte, 4096)
+	if _, err := unix.Readlink("/proc/1/exe", buf); err != nil {
+		retErr = errors.Join(retErr, fmt.Errorf("reading /proc entries of other processes (root or CAP_SYS_PTRACE is required): %w", err))
 	}
 
-	return u.Username == "root", nil
+	return retErr
+}
+
+// CheckWritable verifies that the effective user can write into the directory
+// at path, or, if it does not exist yet, create it in its closest existing
+// parent.
+func CheckWritable(path string) error {
+	for {
+		_, err := os.Stat(path)
+		if err == nil {
+			return unix.Faccessat(unix.AT_FDCWD, path, unix.W_OK|unix.X_OK, unix.AT_EACCESS)
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return err
+		}
+		path = parent
+	}
 }
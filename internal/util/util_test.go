@@ -0,0 +1,40 @@
+package util_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apptainer/apptheus/internal/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckPermissions(t *testing.T) {
+	cgroupRoot := filepath.Join(t.TempDir(), "apptheus")
+	hierarchyRoot := t.TempDir()
+
+	// the hierarchy root must have a writable cgroup.procs
+	require.ErrorContains(t, util.CheckPermissions([]string{cgroupRoot}, []string{hierarchyRoot}), "cgroup.procs")
+	require.NoError(t, os.WriteFile(filepath.Join(hierarchyRoot, "cgroup.procs"), nil, 0o644))
+	// /proc entries of other processes may not be readable here
+	err := util.CheckPermissions([]string{cgroupRoot}, []string{hierarchyRoot})
+	if err != nil {
+		require.NotContains(t, err.Error(), "cgroup")
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, util.CheckWritable(dir))
+	require.NoError(t, util.CheckWritable(filepath.Join(dir, "not", "yet", "created")))
+
+	if os.Geteuid() == 0 {
+		t.Skip("root bypasses directory permissions")
+	}
+
+	readonly := filepath.Join(dir, "readonly")
+	require.NoError(t, os.Mkdir(readonly, 0o500))
+	require.Error(t, util.CheckWritable(readonly))
+	require.Error(t, util.CheckWritable(filepath.Join(readonly, "child")))
+}
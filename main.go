@@ -28,6 +28,8 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -47,7 +49,14 @@ import (
 	dto "github.com/prometheus/client_model/go"
 	promlogflag "github.com/prometheus/common/promlog/flag"
 
+	"github.com/apptainer/apptheus/internal/admin"
+	"github.com/apptainer/apptheus/internal/api"
+	"github.com/apptainer/apptheus/internal/audit"
+	"github.com/apptainer/apptheus/internal/cgroup"
+	"github.com/apptainer/apptheus/internal/monitor"
 	"github.com/apptainer/apptheus/internal/network"
+	"github.com/apptainer/apptheus/internal/policy"
+	"github.com/apptainer/apptheus/internal/sandbox"
 	"github.com/apptainer/apptheus/internal/storage"
 	"github.com/apptainer/apptheus/internal/util"
 	"toolman.org/net/peercred"
@@ -77,30 +86,127 @@ func main() {
 		routePrefix         = app.Flag("web.route-prefix", "Prefix for the internal routes of web endpoints. Defaults to the path of --web.external-url.").Default("").String()
 		persistenceFile     = app.Flag("persistence.file", "File to persist metrics. If empty, metrics are only kept in memory.").Default("").String()
 		persistenceInterval = app.Flag("persistence.interval", "The minimum interval at which to write out the persistence file.").Default("5m").Duration()
+		persistenceCompress = app.Flag("persistence.compress", "Compress the persistence file with gzip.").Default("false").Bool()
+		persistenceWAL      = app.Flag("persistence.wal", "Append every write to a write-ahead log next to the persistence file, compacted into it whenever it is persisted, so that a crash only loses the writes since the last sync.").Default("false").Bool()
+		persistenceWALSync  = app.Flag("persistence.wal-sync", "The interval at which the write-ahead log is synced to disk.").Default("1s").Duration()
+		storeStaleAfter     = app.Flag("store.stale-after", "Mark the metric groups not pushed for this long with an apptheus_group_stale gauge. 0 disables it.").Default("0").Duration()
+		storeExpireAfter    = app.Flag("store.expire-after", "Remove the metric groups not pushed for this long, e.g. the final metrics of the exited containers. 0 disables it.").Default("0").Duration()
 		promlogConfig       = promlog.Config{}
 		socketPath          = app.Flag("socket.path", "Socket path for communication.").Default("/run/apptheus/gateway.sock").String()
 		trustedPath         = app.Flag("trust.path", "Multiple trusted apptainer starter paths, use ';' to separate multiple entries").Default("").String()
+		policyFile          = app.Flag("policy.file", "YAML file with additional policy rules verifying the callers, e.g. their process ancestry. If empty, only --trust.path is checked.").Default("").String()
 		monitorInterval     = app.Flag("monitor.inverval", "The internval for sending system status.").Default("0.5s").Duration()
+		monitorJitter       = app.Flag("monitor.jitter", "Fraction of the interval, at most 0.5, by which each sample is randomly advanced or delayed, spreading the samples of the containers.").Default("0.1").Float64()
+		monitorWorkers      = app.Flag("monitor.workers", "Number of workers sampling the containers concurrently.").Default(strconv.Itoa(runtime.NumCPU())).Int()
+		monitorAdaptive     = app.Flag("monitor.adaptive", "Sample the containers every --monitor.min-interval during their warmup and whenever their usage changes quickly, backing off up to --monitor.max-interval while it is steady, instead of every --monitor.inverval.").Default("false").Bool()
+		monitorMinInterval  = app.Flag("monitor.min-interval", "Shortest sampling interval with adaptive sampling.").Default("0.5s").Duration()
+		monitorMaxInterval  = app.Flag("monitor.max-interval", "Longest sampling interval with adaptive sampling.").Default("30s").Duration()
+		monitorWarmup       = app.Flag("monitor.warmup", "How long new containers are sampled every --monitor.min-interval with adaptive sampling.").Default("2m").Duration()
+		monitorHistory      = app.Flag("monitor.history", "How long the recent samples of every container are kept in memory for the history API. 0 disables it.").Default("30m").Duration()
+		monitorHistorySize  = app.Flag("monitor.history-samples", "Maximum number of samples kept per container for the history API, evenly spread over --monitor.history.").Default("360").Int()
+		cgroupRoot          = app.Flag("cgroup.root", "Parent of the cgroups created for the containers, relative to the root of the cgroup hierarchies, e.g. /apptheus.slice.").Default(cgroup.DefaultRoot).String()
+		cgroupInPlace       = app.Flag("cgroup.in-place", "Monitor the containers in their current cgroup v2 when it only holds the container, e.g. created by apptainer --apply-cgroups or a systemd scope, instead of moving them. Such cgroups are never modified.").Default("false").Bool()
+		cgroupPerUser       = app.Flag("cgroup.per-user", "Create the cgroups of the containers under a parent per owner, <root>/user-<uid>/<id>.").Default("false").Bool()
+		auditFile           = app.Flag("audit.file", "Append-only file recording every verification decision as JSON lines. If empty, no audit log is written. Reopened on SIGHUP.").Default("").String()
+		auditHashChain      = app.Flag("audit.hash-chain", "Chain the audit log entries with a running sha256 hash to make tampering evident.").Default("false").Bool()
+		sandboxEnabled      = app.Flag("sandbox.enabled", "Restrict apptheus with Landlock once started, so that it can only write into the cgroup root, the persistence, socket and audit directories. Use --no-sandbox.enabled to disable.").Default("true").Bool()
+		adminSocketPath     = app.Flag("admin.socket-path", "Socket serving the admin API, only accessible to root and to the user running apptheus.").Default("/run/apptheus/admin.sock").String()
+		controlSocketPath   = app.Flag("control.socket-path", "Socket on which the users may freeze, thaw, kill and read the history of their own containers, root and the user running apptheus of any container.").Default("/run/apptheus/control.sock").String()
+
+		serveCmd      = app.Command("serve", "Run the daemon (default).").Default()
+		listCmd       = app.Command("list", "List the containers monitored by the running daemon.")
+		listOutput    = outputFlag(listCmd)
+		inspectCmd    = app.Command("inspect", "Show the details of a monitored container.")
+		inspectID     = inspectCmd.Arg("id", "Container id.").Required().String()
+		inspectOutput = outputFlag(inspectCmd)
+		stopCmd       = app.Command("stop-monitoring", "Stop monitoring a container, its metrics are removed.")
+		stopID        = stopCmd.Arg("id", "Container id.").Required().String()
+		freezeCmd     = app.Command("freeze", "Freeze the processes of a container.")
+		freezeID      = freezeCmd.Arg("id", "Container id.").Required().String()
+		thawCmd       = app.Command("thaw", "Thaw the processes of a frozen container.")
+		thawID        = thawCmd.Arg("id", "Container id.").Required().String()
+		killCmd       = app.Command("kill", "Kill all the processes of a container.")
+		killID        = killCmd.Arg("id", "Container id.").Required().String()
+		historyCmd    = app.Command("history", "Show the recent samples of a container.")
+		historyID     = historyCmd.Arg("id", "Container id.").Required().String()
+		historyMetric = historyCmd.Flag("metric", "Only show the samples of this metric.").String()
+		historySince  = historyCmd.Flag("since", "Only show the samples taken since a RFC 3339 time or a duration ago.").String()
+		historyOutput = outputFlag(historyCmd)
+		healthCmd     = app.Command("health", "Show the status of the running daemon.")
+		healthOutput  = outputFlag(healthCmd)
 	)
 	promlogflag.AddFlags(app, &promlogConfig)
 	version.Version = VERSION
 	app.Version(version.Print("apptheus"))
 	app.HelpFlag.Short('h')
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	adminClient := admin.NewClient(*adminSocketPath)
+	controlClient := admin.NewClient(*controlSocketPath)
+	switch command {
+	case listCmd.FullCommand():
+		os.Exit(runAdminCommand(func(ctx context.Context) error {
+			return listContainers(ctx, adminClient, *listOutput)
+		}))
+	case inspectCmd.FullCommand():
+		os.Exit(runAdminCommand(func(ctx context.Context) error {
+			return inspectContainer(ctx, adminClient, *inspectID, *inspectOutput)
+		}))
+	case stopCmd.FullCommand():
+		os.Exit(runAdminCommand(func(ctx context.Context) error {
+			return adminClient.StopMonitoring(ctx, *stopID)
+		}))
+	case freezeCmd.FullCommand():
+		os.Exit(runAdminCommand(func(ctx context.Context) error {
+			return controlClient.Freeze(ctx, *freezeID)
+		}))
+	case thawCmd.FullCommand():
+		os.Exit(runAdminCommand(func(ctx context.Context) error {
+			return controlClient.Thaw(ctx, *thawID)
+		}))
+	case killCmd.FullCommand():
+		os.Exit(runAdminCommand(func(ctx context.Context) error {
+			return controlClient.Kill(ctx, *killID)
+		}))
+	case historyCmd.FullCommand():
+		os.Exit(runAdminCommand(func(ctx context.Context) error {
+			return showHistory(ctx, controlClient, *historyID, *historyMetric, *historySince, *historyOutput)
+		}))
+	case healthCmd.FullCommand():
+		os.Exit(runAdminCommand(func(ctx context.Context) error {
+			return checkHealth(ctx, adminClient, *healthOutput)
+		}))
+	case serveCmd.FullCommand():
+	}
+
 	logger := promlog.New(&promlogConfig)
 
 	*routePrefix = computeRoutePrefix(*routePrefix, *externalURL)
 	level.Info(logger).Log("msg", "starting apptheus", "version", version.Info())
 
-	// verify the caller is root or not
-	isRoot, err := util.IsRoot()
+	if err := cgroup.SetLayout(cgroup.Layout{Root: *cgroupRoot, PerUser: *cgroupPerUser}); err != nil {
+		level.Error(logger).Log("msg", "Invalid cgroup layout", "err", err)
+		os.Exit(-1)
+	}
+
+	// verify the process has the permissions it needs, a dedicated service
+	// user owning a delegated cgroup subtree is enough
+	cgroupPaths, err := cgroup.GatewayPaths()
 	if err != nil {
-		level.Error(logger).Log("msg", "Could not verify the caller", "err", err)
+		level.Error(logger).Log("msg", "Could not resolve the cgroup root", "err", err)
+		os.Exit(-1)
+	}
+	// the processes are moved from and back to their original cgroups, and
+	// the cgroups monitored in place are frozen or killed, anywhere in the
+	// hierarchies
+	hierarchyRoots, err := cgroup.HierarchyRoots()
+	if err != nil {
+		level.Error(logger).Log("msg", "Could not find the cgroup hierarchies", "err", err)
 		os.Exit(-1)
 	}
 
-	if !isRoot {
-		level.Info(logger).Log("msg", "Please launch using root user", "version", version.Info())
+	if err := util.CheckPermissions(cgroupPaths, hierarchyRoots); err != nil {
+		level.Error(logger).Log("msg", "Missing permissions, please launch as root or as a user owning the cgroup root with CAP_SYS_PTRACE", "err", err)
 		os.Exit(-1)
 	}
 
@@ -114,7 +220,58 @@ func main() {
 		}
 	}
 
-	ms := storage.NewDiskMetricStore(*persistenceFile, *persistenceInterval, prometheus.DefaultGatherer, logger)
+	var callerPolicy *policy.Policy
+	if *policyFile != "" {
+		callerPolicy, err = policy.Load(*policyFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "Could not load the policy file", "err", err)
+			os.Exit(-1)
+		}
+	}
+
+	var auditSink *audit.Sink
+	if *auditFile != "" {
+		auditSink, err = audit.NewSink(*auditFile, *auditHashChain)
+		if err != nil {
+			level.Error(logger).Log("msg", "Could not open the audit log", "file", *auditFile, "err", err)
+			os.Exit(-1)
+		}
+		defer auditSink.Close()
+		go reopenAuditOnHangup(auditSink, logger)
+	}
+
+	var storeOptions []storage.Option
+	if *persistenceCompress {
+		storeOptions = append(storeOptions, storage.WithCompression())
+	}
+	if *persistenceWAL {
+		storeOptions = append(storeOptions, storage.WithWAL(*persistenceWALSync))
+	}
+	if *storeStaleAfter > 0 || *storeExpireAfter > 0 {
+		staleness := storage.Staleness{
+			MarkAfter:   *storeStaleAfter,
+			RemoveAfter: *storeExpireAfter,
+		}
+		// the groups of the containers are pushed at every sample
+		longest := *monitorInterval
+		if *monitorAdaptive && *monitorMaxInterval > longest {
+			longest = *monitorMaxInterval
+		}
+		if callerPolicy != nil {
+			for _, rule := range callerPolicy.Rules {
+				if rule.Interval > longest {
+					longest = rule.Interval
+				}
+			}
+		}
+		longest += time.Duration(float64(longest) * min(*monitorJitter, monitor.MaxJitter))
+		if err := staleness.Check(longest); err != nil {
+			level.Error(logger).Log("msg", "The staleness thresholds must be longer than the longest sampling interval", "err", err)
+			os.Exit(-1)
+		}
+		storeOptions = append(storeOptions, storage.WithStaleness(staleness))
+	}
+	ms := storage.NewDiskMetricStore(*persistenceFile, *persistenceInterval, prometheus.DefaultGatherer, logger, storeOptions...)
 
 	// Create a Gatherer combining the DefaultGatherer and the metrics from the metric store.
 	g := prometheus.Gatherers{
@@ -123,13 +280,13 @@ func main() {
 	}
 
 	// server error channel
-	errCh := make(chan error, 2)
+	errCh := make(chan error, 3)
 
 	// verification server route
 	verifyRoute := route.New()
 	vmux := http.NewServeMux()
 	vmux.Handle("/", decodeRequest(verifyRoute))
-	verifyServer := &http.Server{Handler: vmux, ReadHeaderTimeout: time.Second}
+	verifyServer := &http.Server{Handler: vmux, ReadHeaderTimeout: time.Second, ConnContext: network.ConnContext}
 
 	// create necessary parent folder for socket path
 	parentFolder := path.Dir(*socketPath)
@@ -140,18 +297,76 @@ func main() {
 		}
 	}
 
+	scheduler := monitor.NewScheduler(monitor.SchedulerConfig{
+		Interval:    *monitorInterval,
+		Jitter:      *monitorJitter,
+		Workers:     *monitorWorkers,
+		Adaptive:    *monitorAdaptive,
+		MinInterval: *monitorMinInterval,
+		MaxInterval: *monitorMaxInterval,
+		Warmup:      *monitorWarmup,
+
+		History:        *monitorHistory,
+		HistorySamples: *monitorHistorySize,
+	}, ms, logger)
+	registry := monitor.NewRegistry(scheduler)
 	verificationOption := &network.ServerOption{
 		Server:      verifyServer,
 		WebConfig:   webConfig,
 		MetricStore: ms,
+		Registry:    registry,
 		Logger:      logger,
 		SocketPath:  *socketPath,
 		TrustedPath: *trustedPath,
-		Interval:    time.NewTicker(*monitorInterval),
+		Policy:      callerPolicy,
+		Audit:       auditSink,
+		InPlace:     *cgroupInPlace,
 		ErrCh:       errCh,
+		Ready:       make(chan struct{}),
+	}
+	api.New(verificationOption).Register(verifyRoute)
+
+	// containers monitored before a restart are still in their cgroup
+	if resumed, err := network.Resume(verificationOption); err != nil {
+		level.Error(logger).Log("msg", "Could not resume monitoring the existing cgroups", "err", err)
+	} else if resumed != 0 {
+		level.Info(logger).Log("msg", "Resumed monitoring the existing cgroups", "containers", resumed)
 	}
 	go startVerificationServer(verificationOption)
 
+	// admin server
+	adminFolder := path.Dir(*adminSocketPath)
+	if err := os.MkdirAll(adminFolder, 0o755); err != nil {
+		level.Error(logger).Log("msg", "Failed to create parent folder", "err", err)
+	}
+	adminServer := admin.NewServer(registry, ms, version.Version, logger)
+	adminRoute := route.New()
+	adminServer.Register(adminRoute)
+	adminOption := &network.ServerOption{
+		Server:     &http.Server{Handler: adminRoute, ReadHeaderTimeout: time.Second, ConnContext: admin.ConnContext},
+		Logger:     logger,
+		SocketPath: *adminSocketPath,
+		ErrCh:      errCh,
+		Ready:      make(chan struct{}),
+	}
+	go startAdminServer(adminOption, "admin", admin.Listen)
+
+	// control server, reachable by the owners of the containers
+	controlFolder := path.Dir(*controlSocketPath)
+	if err := os.MkdirAll(controlFolder, 0o755); err != nil {
+		level.Error(logger).Log("msg", "Failed to create parent folder", "err", err)
+	}
+	controlRoute := route.New()
+	adminServer.RegisterControl(controlRoute)
+	controlOption := &network.ServerOption{
+		Server:     &http.Server{Handler: controlRoute, ReadHeaderTimeout: time.Second, ConnContext: admin.ConnContext},
+		Logger:     logger,
+		SocketPath: *controlSocketPath,
+		ErrCh:      errCh,
+		Ready:      make(chan struct{}),
+	}
+	go startAdminServer(controlOption, "control", admin.ListenControl)
+
 	// metrics server
 	metricsRoute := route.New()
 	mmux := http.NewServeMux()
@@ -173,7 +388,66 @@ func main() {
 	}
 	go startMetricsServer(metricOption)
 
-	err = shutdownServerOnQuit(*socketPath, []*network.ServerOption{verificationOption, metricOption}, ms, errCh, logger)
+	if *sandboxEnabled {
+		// the sockets must be bound before restricting ourselves
+		for _, ready := range []chan struct{}{verificationOption.Ready, adminOption.Ready, controlOption.Ready} {
+			select {
+			case <-ready:
+			case err := <-errCh:
+				errCh <- err
+			}
+		}
+
+		// the cgroup root must exist to be allowed, and its controllers
+		// must be enabled while the hierarchy root is still writable
+		if err := cgroup.CreateGateway(); err != nil {
+			level.Error(logger).Log("msg", "Could not create the cgroup root", "err", err)
+			os.Exit(-1)
+		}
+
+		// outside the cgroup root, the processes can only be moved back to
+		// the hierarchy roots, or to the original cgroups of the resumed
+		// containers
+		releaseTargets, err := cgroup.ReleaseTargets()
+		if err != nil {
+			level.Error(logger).Log("msg", "Could not find the original cgroups of the containers", "err", err)
+			os.Exit(-1)
+		}
+
+		rules := sandbox.Rules{
+			ReadWrite: append(append([]string{}, cgroupPaths...), parentFolder, adminFolder, controlFolder),
+			ReadOnly:  []string{"/proc", "/sys"},
+			WriteFile: releaseTargets,
+		}
+		if *persistenceFile != "" {
+			rules.ReadWrite = append(rules.ReadWrite, filepath.Dir(*persistenceFile))
+		}
+		if *auditFile != "" {
+			rules.ReadWrite = append(rules.ReadWrite, filepath.Dir(*auditFile))
+		}
+		// trusted executables are read to compute their digest, and the
+		// web config and its certificates are read for every TLS handshake
+		for _, path := range strings.Split(*trustedPath, ";") {
+			if path = strings.TrimSpace(path); path != "" {
+				rules.ReadOnly = append(rules.ReadOnly, path)
+			}
+		}
+		if *webConfig.WebConfigFile != "" {
+			rules.ReadOnly = append(rules.ReadOnly, filepath.Dir(*webConfig.WebConfigFile))
+		}
+
+		if err := sandbox.Restrict(rules); err != nil {
+			if !errors.Is(err, errors.ErrUnsupported) {
+				level.Error(logger).Log("msg", "Could not restrict apptheus with landlock", "err", err)
+				os.Exit(-1)
+			}
+			level.Warn(logger).Log("msg", "Landlock is not supported, running without sandbox", "err", err)
+		} else {
+			level.Info(logger).Log("msg", "Apptheus restricted with landlock", "read-write", strings.Join(rules.ReadWrite, ","), "read-only", strings.Join(rules.ReadOnly, ","), "write-file", strings.Join(rules.WriteFile, ","))
+		}
+	}
+
+	err = shutdownServerOnQuit([]*network.ServerOption{verificationOption, adminOption, controlOption, metricOption}, scheduler, ms, errCh, logger)
 	if err != nil {
 		level.Error(logger).Log("msg", "Failed to clean up the server", "err", err)
 	}
@@ -224,7 +498,7 @@ func computeRoutePrefix(prefix string, externalURL *url.URL) string {
 
 // shutdownServerOnQuit shutdowns the provided server upon closing the provided
 // quitCh or upon receiving a SIGINT or SIGTERM.
-func shutdownServerOnQuit(socketPath string, options []*network.ServerOption, ms *storage.DiskMetricStore, errCh <-chan error, logger log.Logger) error {
+func shutdownServerOnQuit(options []*network.ServerOption, scheduler *monitor.Scheduler, ms *storage.DiskMetricStore, errCh <-chan error, logger log.Logger) error {
 	notifier := make(chan os.Signal, 1)
 	signal.Notify(notifier, os.Interrupt, syscall.SIGTERM)
 
@@ -237,10 +511,11 @@ func shutdownServerOnQuit(socketPath string, options []*network.ServerOption, ms
 		break
 	}
 
-	defer os.Remove(socketPath)
-
 	var retErr error
 	for _, option := range options {
+		if option.SocketPath != "" {
+			defer os.Remove(option.SocketPath)
+		}
 		err := option.Server.Shutdown(context.Background())
 		if err != nil {
 			level.Error(logger).Log("msg", "unable to shutdown the server", "err", err)
@@ -248,6 +523,9 @@ func shutdownServerOnQuit(socketPath string, options []*network.ServerOption, ms
 		}
 	}
 
+	// no more samples may be submitted once the storage is shut down
+	scheduler.Stop()
+
 	err := ms.Shutdown()
 	if err != nil {
 		level.Error(logger).Log("msg", "unable to shutdown the storage service", "err", err)
@@ -256,6 +534,20 @@ func shutdownServerOnQuit(socketPath string, options []*network.ServerOption, ms
 	return retErr
 }
 
+// reopenAuditOnHangup reopens the audit log upon receiving a SIGHUP, so that
+// it can be rotated by logrotate.
+func reopenAuditOnHangup(sink *audit.Sink, logger log.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := sink.Reopen(); err != nil {
+			level.Error(logger).Log("msg", "unable to reopen the audit log", "err", err)
+			continue
+		}
+		level.Info(logger).Log("msg", "received SIGHUP; audit log reopened")
+	}
+}
+
 // startVerificationServer starts a verification server listening the unix socket
 // it is also responsible for authentication via pid.
 func startVerificationServer(option *network.ServerOption) {
@@ -275,6 +567,10 @@ func startVerificationServer(option *network.ServerOption) {
 		return
 	}
 
+	if option.Ready != nil {
+		close(option.Ready)
+	}
+
 	listener := network.WrappedListener{
 		Listener:    unixListener,
 		TrustedPath: option.TrustedPath,
@@ -320,6 +616,29 @@ func startVerificationServer(option *network.ServerOption) {
 	}
 }
 
+// startAdminServer starts the admin or control server listening its unix
+// socket created by listen.
+func startAdminServer(option *network.ServerOption, name string, listen func(string) (*peercred.Listener, error)) {
+	level.Info(option.Logger).Log("msg", "Start "+name+" server")
+	listener, err := listen(option.SocketPath)
+	if err != nil {
+		level.Error(option.Logger).Log("msg", "Could not create "+name+" unix socket", "err", err)
+		option.ErrCh <- err
+		return
+	}
+	close(option.Ready)
+
+	err = option.Server.Serve(listener)
+	if err != nil {
+		if errors.Is(err, http.ErrServerClosed) {
+			level.Info(option.Logger).Log("msg", "Server stopped", "server", name)
+		} else {
+			level.Error(option.Logger).Log("msg", "Server stopped with error", "server", name, "err", err)
+			option.ErrCh <- err
+		}
+	}
+}
+
 // startMetricsServer starts the `/metrics` endpoints, exposing metrics
 func startMetricsServer(option *network.ServerOption) {
 	level.Info(option.Logger).Log("msg", "Start metrics server")
@@ -0,0 +1,84 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+// Package api defines the types of the versioned API served by apptheus on its
+// verification socket.
+package api
+
+import "time"
+
+// Prefix is the path prefix of the current version of the API served on the
+// verification socket.
+const Prefix = "/api/v1"
+
+// RegisterRequest is the body of POST /api/v1/containers.
+type RegisterRequest struct {
+	// Pid is the process to monitor, it must be the caller or one of its
+	// descendants. Defaults to the caller.
+	Pid int `json:"pid,omitempty"`
+	// Labels are added to the grouping labels of the container metrics.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Interval overrides the sampling interval of the container, as a Go
+	// duration string, e.g. "2s". Defaults to the interval of the daemon.
+	Interval string `json:"interval,omitempty"`
+}
+
+// MinInterval is the shortest sampling interval a container may request.
+const MinInterval = 100 * time.Millisecond
+
+// LabelsRequest is the body of PUT /api/v1/containers/:id/labels.
+type LabelsRequest struct {
+	Labels map[string]string `json:"labels"`
+}
+
+// Container is the status of a monitored container.
+type Container struct {
+	ID        string    `json:"id"`
+	Pid       uint64    `json:"pid"`
+	Exe       string    `json:"exe"`
+	StartTime uint64    `json:"start_time"`
+	Started   time.Time `json:"started"`
+	// Labels are the labels set by the client.
+	Labels map[string]string `json:"labels,omitempty"`
+	// SystemLabels are the labels set by apptheus, e.g. the ancestors.
+	SystemLabels map[string]string `json:"system_labels,omitempty"`
+	Owner        Owner             `json:"owner"`
+	// Interval is the sampling interval of the container, empty if it uses
+	// the interval of the daemon.
+	Interval string `json:"interval,omitempty"`
+	// Limits is the name of the policy limits set on the container, if any.
+	Limits string `json:"limits,omitempty"`
+}
+
+// Owner identifies the process which registered a container.
+type Owner struct {
+	Pid int32  `json:"pid"`
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+}
+
+// Series is the history of a metric of a container, returned by
+// GET /api/v1/containers/:id/history.
+type Series struct {
+	Metric  string   `json:"metric"`
+	Samples []Sample `json:"samples"`
+}
+
+// Sample is a value of a metric at a point in time.
+type Sample struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// MetricsPath is the path of the endpoint receiving the application metrics
+// pushed from inside a monitored container, either in the text or in the
+// delimited protobuf exposition format.
+const MetricsPath = Prefix + "/metrics"
+
+// HeartbeatPath is the path of the endpoint receiving the heartbeats of a
+// client, for all the containers it registered.
+const HeartbeatPath = Prefix + "/heartbeat"
+
+// Error is the body of any unsuccessful response.
+type Error struct {
+	Error string `json:"error"`
+}
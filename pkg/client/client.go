@@ -0,0 +1,303 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+
+// Package client talks to apptheus over its verification socket. It is meant
+// to be used by container launchers registering the containers they start, and
+// by applications running inside a monitored container pushing their own
+// metrics.
+//
+// The identity of the caller is checked by apptheus when the connection is
+// established, the client thus keeps a single connection open for as long as
+// it is in use.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/apptainer/apptheus/pkg/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// DefaultSocketPath is the default path of the verification socket.
+const DefaultSocketPath = "/run/apptheus/gateway.sock"
+
+// Error is returned when apptheus answers a request with an error status.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("apptheus: %s (%d)", e.Message, e.StatusCode)
+}
+
+// IsNotFound reports whether err means that the container is not monitored.
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsForbidden reports whether err means that the caller is not allowed to
+// perform the request, e.g. because it is not trusted by apptheus.
+func IsForbidden(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusForbidden
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithTLSConfig enables TLS on the connection, when apptheus is started with
+// a web config file enabling it.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *Client) {
+		c.transport.TLSClientConfig = config
+		c.scheme = "https"
+	}
+}
+
+// WithTimeout sets the timeout of every request, 10s by default.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.http.Timeout = timeout
+	}
+}
+
+// Client is a client of the apptheus API. It is safe for concurrent use.
+type Client struct {
+	scheme    string
+	transport *http.Transport
+	http      *http.Client
+}
+
+// Connect connects to the verification socket at socketPath. Unless the
+// policy of apptheus requires the containers to be registered explicitly, the
+// caller itself is monitored from then on, for as long as the connection is
+// kept open.
+func Connect(ctx context.Context, socketPath string, opts ...Option) (*Client, error) {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+		// all the requests go through the same verified connection, which is
+		// never closed for being idle
+		MaxConnsPerHost:     1,
+		MaxIdleConnsPerHost: 1,
+		IdleConnTimeout:     0,
+	}
+	c := &Client{
+		scheme:    "http",
+		transport: transport,
+		http:      &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	// establish the connection, a caller which is not trusted is disconnected
+	// right away
+	if _, err := c.List(ctx); err != nil && !IsForbidden(err) {
+		c.Close()
+		return nil, fmt.Errorf("connecting to %s: %w", socketPath, err)
+	}
+	return c, nil
+}
+
+// Close closes the connection. The containers registered through it are
+// released or still monitored until they exit, depending on the policy of
+// apptheus.
+func (c *Client) Close() error {
+	c.transport.CloseIdleConnections()
+	return nil
+}
+
+// Register starts monitoring the process pid, which must be the caller or
+// one of its descendants, 0 meaning the caller. The labels are added to the
+// grouping labels of the container metrics.
+func (c *Client) Register(ctx context.Context, pid int, labels map[string]string) (*api.Container, error) {
+	container := &api.Container{}
+	req := api.RegisterRequest{Pid: pid, Labels: labels}
+	if err := c.do(ctx, http.MethodPost, api.Prefix+"/containers", req, container); err != nil {
+		return nil, err
+	}
+	return container, nil
+}
+
+// List returns the containers registered by the caller.
+func (c *Client) List(ctx context.Context) ([]api.Container, error) {
+	var containers []api.Container
+	if err := c.do(ctx, http.MethodGet, api.Prefix+"/containers", nil, &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+// Status returns the status of a container registered by the caller.
+func (c *Client) Status(ctx context.Context, id string) (*api.Container, error) {
+	container := &api.Container{}
+	if err := c.do(ctx, http.MethodGet, containerPath(id), nil, container); err != nil {
+		return nil, err
+	}
+	return container, nil
+}
+
+// SetLabels replaces the labels of a container registered by the caller. Only
+// root can change the labels the policy limits are selected by.
+func (c *Client) SetLabels(ctx context.Context, id string, labels map[string]string) (*api.Container, error) {
+	container := &api.Container{}
+	req := api.LabelsRequest{Labels: labels}
+	if err := c.do(ctx, http.MethodPut, containerPath(id)+"/labels", req, container); err != nil {
+		return nil, err
+	}
+	return container, nil
+}
+
+// Deregister stops monitoring a container registered by the caller, its
+// metrics are removed.
+func (c *Client) Deregister(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, containerPath(id), nil, nil)
+}
+
+// Done tells that the caller is done with a container it registered: the
+// monitoring stops after a final sample, the container metrics are kept.
+func (c *Client) Done(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodPost, containerPath(id)+"/done", nil, nil)
+}
+
+// History returns the recent samples of a container registered by the caller,
+// of the given metric or of all of them if empty, taken since the given time
+// if not zero.
+func (c *Client) History(ctx context.Context, id, metric string, since time.Time) ([]api.Series, error) {
+	query := url.Values{}
+	if metric != "" {
+		query.Set("metric", metric)
+	}
+	if !since.IsZero() {
+		query.Set("since", since.Format(time.RFC3339Nano))
+	}
+	path := containerPath(id) + "/history"
+	if len(query) != 0 {
+		path += "?" + query.Encode()
+	}
+	var series []api.Series
+	if err := c.do(ctx, http.MethodGet, path, nil, &series); err != nil {
+		return nil, err
+	}
+	return series, nil
+}
+
+// Heartbeat tells apptheus that the caller is still alive, which is needed by
+// the policies expecting heartbeats.
+func (c *Client) Heartbeat(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, api.HeartbeatPath, nil, nil)
+}
+
+// Push gathers the metrics of g and adds them to the metrics of the container
+// the caller runs in.
+func (c *Client) Push(ctx context.Context, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	format := expfmt.NewFormat(expfmt.TypeProtoDelim)
+	enc := expfmt.NewEncoder(&buf, format)
+	for _, mf := range mfs {
+		if err := enc.Encode(mf); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url(api.MetricsPath), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(format))
+	return c.send(req, nil)
+}
+
+// KeepAlive sends a heartbeat every interval until ctx is done, in which case
+// nil is returned, or until apptheus can't be reached.
+func (c *Client) KeepAlive(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		// a container process which is not trusted is answered nonetheless
+		if err := c.Heartbeat(ctx); err != nil && !IsForbidden(err) && ctx.Err() == nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path), body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(req, out)
+}
+
+func (c *Client) send(req *http.Request, out interface{}) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		var body api.Error
+		if err := json.NewDecoder(resp.Body).Decode(&body); err == nil {
+			apiErr.Message = body.Error
+		} else {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return apiErr
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) url(path string) string {
+	// the host is ignored when dialing the socket
+	return c.scheme + "://apptheus" + path
+}
+
+func containerPath(id string) string {
+	return api.Prefix + "/containers/" + url.PathEscape(id)
+}
@@ -0,0 +1,121 @@
+package client_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/apptainer/apptheus/pkg/api"
+	"github.com/apptainer/apptheus/pkg/client"
+	"github.com/apptainer/apptheus/pkg/client/clienttest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func newServer(t *testing.T) *clienttest.Server {
+	s, err := clienttest.NewServer()
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestClient(t *testing.T) {
+	s := newServer(t)
+	ctx := context.Background()
+
+	c, err := client.Connect(ctx, s.SocketPath)
+	require.NoError(t, err)
+	defer c.Close()
+
+	containers, err := c.List(ctx)
+	require.NoError(t, err)
+	require.Empty(t, containers)
+
+	container, err := c.Register(ctx, 0, map[string]string{"job_name": "training"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(os.Getpid()), container.Pid)
+	require.Equal(t, int32(os.Getpid()), container.Owner.Pid)
+	require.Equal(t, "training", container.Labels["job_name"])
+
+	status, err := c.Status(ctx, container.ID)
+	require.NoError(t, err)
+	require.Equal(t, container.ID, status.ID)
+
+	status, err = c.SetLabels(ctx, container.ID, map[string]string{"step": "eval"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"step": "eval"}, status.Labels)
+	require.Equal(t, status.Labels, s.Containers()[0].Labels)
+
+	now := time.Now().Truncate(time.Second)
+	s.SetHistory(container.ID, []api.Series{
+		{Metric: "memory_usage", Samples: []api.Sample{{Time: now.Add(-time.Minute), Value: 1}, {Time: now, Value: 2}}},
+		{Metric: "frozen", Samples: []api.Sample{{Time: now, Value: 0}}},
+	})
+	history, err := c.History(ctx, container.ID, "", time.Time{})
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	history, err = c.History(ctx, container.ID, "memory_usage", now.Add(-time.Second))
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, 2.0, history[0].Samples[0].Value)
+
+	require.NoError(t, c.Deregister(ctx, container.ID))
+	require.Empty(t, s.Containers())
+
+	container, err = c.Register(ctx, 0, nil)
+	require.NoError(t, err)
+	require.NoError(t, c.Done(ctx, container.ID))
+	require.Empty(t, s.Containers())
+	require.Equal(t, []string{container.ID}, s.Released())
+
+	_, err = c.Status(ctx, container.ID)
+	require.True(t, client.IsNotFound(err), err)
+}
+
+func TestClientPush(t *testing.T) {
+	s := newServer(t)
+	ctx := context.Background()
+
+	c, err := client.Connect(ctx, s.SocketPath)
+	require.NoError(t, err)
+	defer c.Close()
+
+	reg := prometheus.NewRegistry()
+	loss := prometheus.NewGauge(prometheus.GaugeOpts{Name: "training_loss"})
+	reg.MustRegister(loss)
+	loss.Set(0.25)
+
+	// the caller is not in a monitored container
+	err = c.Push(ctx, reg)
+	require.True(t, client.IsForbidden(err), err)
+
+	container, err := c.Register(ctx, 0, nil)
+	require.NoError(t, err)
+	s.PushTo(container.ID)
+
+	require.NoError(t, c.Push(ctx, reg))
+	metrics := s.Metrics(container.ID)
+	require.Contains(t, metrics, "training_loss")
+	require.Equal(t, 0.25, metrics["training_loss"].GetMetric()[0].GetGauge().GetValue())
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	s := newServer(t)
+
+	c, err := client.Connect(context.Background(), s.SocketPath)
+	require.NoError(t, err)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.NoError(t, c.KeepAlive(ctx, 10*time.Millisecond))
+	require.NotZero(t, s.Heartbeats())
+
+	// the daemon is gone
+	require.NoError(t, s.Close())
+	require.Error(t, c.KeepAlive(context.Background(), 10*time.Millisecond))
+
+	_, err = client.Connect(context.Background(), s.SocketPath)
+	require.Error(t, err)
+}
@@ -0,0 +1,388 @@
+// SPDX-FileCopyrightText: Copyright (c) 2023, CIQ, Inc. All rights reserved
+// SPDX-License-Identifier: Apache-2.0
+
+// Package clienttest provides an in-process fake of the apptheus API, so that
+// launchers can test their integration without a running daemon, cgroups or
+// privileges.
+//
+// The fake trusts every caller and does not monitor anything: it only keeps
+// track of the registered containers and of the pushed metrics. As in
+// apptheus, a container can only be managed by the process which registered
+// it, identified by the peer credentials of its connection.
+package clienttest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apptainer/apptheus/internal/push"
+	"github.com/apptainer/apptheus/pkg/api"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/route"
+	"golang.org/x/sys/unix"
+)
+
+type credKey struct{}
+
+// Server is a fake apptheus listening on a unix socket.
+type Server struct {
+	// SocketPath is the path of the socket to connect to.
+	SocketPath string
+
+	dir      string
+	listener net.Listener
+	server   *http.Server
+
+	mu         sync.Mutex
+	containers map[string]*api.Container
+	metrics    map[string]map[string]*dto.MetricFamily
+	released   []string
+	history    map[string][]api.Series
+	heartbeats int
+	// pushTo is the container receiving the metrics pushed by any caller.
+	pushTo string
+}
+
+// NewServer starts a fake server listening on a socket in a new temporary
+// directory. It must be closed once done.
+func NewServer() (*Server, error) {
+	dir, err := os.MkdirTemp("", "apptheus-clienttest-")
+	if err != nil {
+		return nil, err
+	}
+	socketPath := filepath.Join(dir, "gateway.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	s := &Server{
+		SocketPath: socketPath,
+		dir:        dir,
+		listener:   listener,
+		containers: make(map[string]*api.Container),
+		metrics:    make(map[string]map[string]*dto.MetricFamily),
+		history:    make(map[string][]api.Series),
+	}
+
+	r := route.New()
+	r.Post(api.Prefix+"/containers", s.register)
+	r.Get(api.Prefix+"/containers", s.list)
+	r.Get(api.Prefix+"/containers/:id", s.status)
+	r.Del(api.Prefix+"/containers/:id", s.deregister)
+	r.Put(api.Prefix+"/containers/:id/labels", s.setLabels)
+	r.Post(api.Prefix+"/containers/:id/done", s.done)
+	r.Get(api.Prefix+"/containers/:id/history", s.containerHistory)
+	r.Post(api.HeartbeatPath, s.heartbeat)
+	r.Post(api.MetricsPath, s.push)
+
+	s.server = &http.Server{
+		Handler:           r,
+		ReadHeaderTimeout: time.Second,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if ucred, err := peerCred(c); err == nil {
+				return context.WithValue(ctx, credKey{}, ucred)
+			}
+			return ctx
+		},
+	}
+	go s.server.Serve(listener)
+	return s, nil
+}
+
+// Close stops the server and removes its socket.
+func (s *Server) Close() error {
+	err := s.server.Close()
+	return errors.Join(err, os.RemoveAll(s.dir))
+}
+
+// Containers returns the registered containers, sorted by id.
+func (s *Server) Containers() []api.Container {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	containers := make([]api.Container, 0, len(s.containers))
+	for _, c := range s.containers {
+		containers = append(containers, *c)
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].ID < containers[j].ID
+	})
+	return containers
+}
+
+// Metrics returns the metrics pushed for the container with the given id.
+func (s *Server) Metrics(id string) map[string]*dto.MetricFamily {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	metrics := make(map[string]*dto.MetricFamily, len(s.metrics[id]))
+	for name, mf := range s.metrics[id] {
+		metrics[name] = mf
+	}
+	return metrics
+}
+
+// Released returns the ids of the containers the clients are done with.
+func (s *Server) Released() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.released...)
+}
+
+// Heartbeats returns the number of heartbeats received.
+func (s *Server) Heartbeats() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.heartbeats
+}
+
+// PushTo sets the container the metrics are pushed to, as the fake can't rely
+// on the cgroup of the callers. The pushes are rejected until it is set.
+func (s *Server) PushTo(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pushTo = id
+}
+
+// SetHistory sets the history returned for the container with the given id,
+// as the fake does not sample anything.
+func (s *Server) SetHistory(id string, series []api.Series) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history[id] = series
+}
+
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	ucred, ok := caller(w, r)
+	if !ok {
+		return
+	}
+
+	var req api.RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Pid == 0 {
+		req.Pid = int(ucred.Pid)
+	}
+
+	c := &api.Container{
+		ID:      fmt.Sprintf("fake_%d", req.Pid),
+		Pid:     uint64(req.Pid),
+		Started: time.Now(),
+		Labels:  req.Labels,
+		Owner: api.Owner{
+			Pid: ucred.Pid,
+			UID: ucred.Uid,
+			GID: ucred.Gid,
+		},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.containers[c.ID]; ok {
+		if existing.Owner.Pid == ucred.Pid && c.Pid == uint64(ucred.Pid) {
+			respond(w, http.StatusOK, existing)
+			return
+		}
+		respondError(w, http.StatusConflict, errors.New("container is already registered"))
+		return
+	}
+	s.containers[c.ID] = c
+	respond(w, http.StatusOK, c)
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	ucred, ok := caller(w, r)
+	if !ok {
+		return
+	}
+
+	containers := []api.Container{}
+	for _, c := range s.Containers() {
+		if c.Owner.Pid == ucred.Pid {
+			containers = append(containers, c)
+		}
+	}
+	respond(w, http.StatusOK, containers)
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.authorize(w, r); ok {
+		respond(w, http.StatusOK, c)
+	}
+}
+
+func (s *Server) deregister(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.authorize(w, r); ok {
+		delete(s.containers, c.ID)
+		delete(s.metrics, c.ID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) done(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.authorize(w, r); ok {
+		// the metrics of a released container are kept
+		delete(s.containers, c.ID)
+		s.released = append(s.released, c.ID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) containerHistory(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			respondError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	metric := r.URL.Query().Get("metric")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.authorize(w, r)
+	if !ok {
+		return
+	}
+	history := []api.Series{}
+	for _, series := range s.history[c.ID] {
+		if metric != "" && series.Metric != metric {
+			continue
+		}
+		samples := []api.Sample{}
+		for _, sample := range series.Samples {
+			if !sample.Time.Before(since) {
+				samples = append(samples, sample)
+			}
+		}
+		if len(samples) != 0 {
+			history = append(history, api.Series{Metric: series.Metric, Samples: samples})
+		}
+	}
+	respond(w, http.StatusOK, history)
+}
+
+func (s *Server) heartbeat(w http.ResponseWriter, r *http.Request) {
+	if _, ok := caller(w, r); !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.heartbeats++
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) setLabels(w http.ResponseWriter, r *http.Request) {
+	var req api.LabelsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.authorize(w, r); ok {
+		c.Labels = req.Labels
+		respond(w, http.StatusOK, c)
+	}
+}
+
+func (s *Server) push(w http.ResponseWriter, r *http.Request) {
+	metricFamilies, err := push.Parse(r.Body, r.Header.Get("Content-Type"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.containers[s.pushTo]; !ok {
+		respondError(w, http.StatusForbidden, errors.New("caller does not belong to a monitored container"))
+		return
+	}
+	if s.metrics[s.pushTo] == nil {
+		s.metrics[s.pushTo] = make(map[string]*dto.MetricFamily)
+	}
+	for name, mf := range metricFamilies {
+		s.metrics[s.pushTo][name] = mf
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorize returns the container addressed by the request if the caller
+// registered it, s.mu must be held.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) (*api.Container, bool) {
+	ucred, ok := caller(w, r)
+	if !ok {
+		return nil, false
+	}
+	id := route.Param(r.Context(), "id")
+	c, ok := s.containers[id]
+	if !ok {
+		respondError(w, http.StatusNotFound, fmt.Errorf("container %s is not monitored", id))
+		return nil, false
+	}
+	if c.Owner.Pid != ucred.Pid {
+		respondError(w, http.StatusForbidden, fmt.Errorf("container %s has not been registered by the caller", id))
+		return nil, false
+	}
+	return c, true
+}
+
+func caller(w http.ResponseWriter, r *http.Request) (*unix.Ucred, bool) {
+	ucred, ok := r.Context().Value(credKey{}).(*unix.Ucred)
+	if !ok {
+		respondError(w, http.StatusForbidden, errors.New("unverified connection"))
+	}
+	return ucred, ok
+}
+
+func peerCred(c net.Conn) (*unix.Ucred, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return nil, errors.New("not a unix connection")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var ucred *unix.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	return ucred, errors.Join(err, credErr)
+}
+
+func respond(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func respondError(w http.ResponseWriter, status int, err error) {
+	respond(w, status, api.Error{Error: err.Error()})
+}